@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/tunnel"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	agentCommand = &cobra.Command{
+		Use:   "agent",
+		Short: "passage agent runs alongside a service, and forwards a reverse tunnel to it",
+		RunE:  runAgent,
+	}
+)
+
+var agentOptions struct {
+	serverAddr  string
+	tunnelID    string
+	serviceAddr string
+
+	user                  string
+	keyFile               string
+	certificateFile       string
+	hostKeys              []string
+	insecureIgnoreHostKey bool
+
+	dialTimeout       time.Duration
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	healthAddr string
+	logLevel   string
+	logFormat  string
+}
+
+func init() {
+	rootCmd.AddCommand(agentCommand)
+
+	flags := agentCommand.Flags()
+	flags.StringVar(&agentOptions.serverAddr, "server", "", "Address of the reverse tunnel SSH server, e.g. tunnels.example.com:22")
+	flags.StringVar(&agentOptions.tunnelID, "tunnel-id", "", "ID of the reverse tunnel to forward")
+	flags.StringVar(&agentOptions.serviceAddr, "service", "", "Address of the service to forward the tunnel to, e.g. localhost:5432")
+
+	flags.StringVar(&agentOptions.user, "user", "passage", "SSH user to authenticate as")
+	flags.StringVar(&agentOptions.keyFile, "key-file", "", "Path to the tunnel's private key")
+	flags.StringVar(&agentOptions.certificateFile, "certificate-file", "", "Path to a user certificate for the private key, signed by a CA that the server trusts")
+	flags.StringArrayVar(&agentOptions.hostKeys, "host-key", nil, "Public key of the server, in authorized_keys format. May be repeated for servers with several host keys")
+	flags.BoolVar(&agentOptions.insecureIgnoreHostKey, "insecure-ignore-host-key", false, "Don't verify the server's host key")
+
+	flags.DurationVar(&agentOptions.dialTimeout, "dial-timeout", 15*time.Second, "Timeout for connecting to the server and the service")
+	flags.DurationVar(&agentOptions.keepaliveInterval, "keepalive-interval", 30*time.Second, "Interval between SSH keepalives")
+	flags.DurationVar(&agentOptions.keepaliveTimeout, "keepalive-timeout", 15*time.Second, "Timeout for SSH keepalives")
+
+	flags.StringVar(&agentOptions.healthAddr, "health-addr", "127.0.0.1:8080", "Bind address for the local health endpoint. Empty disables it")
+	flags.StringVar(&agentOptions.logLevel, "log-level", "info", "Visibility level for logs (debug/info/warn/error/fatal)")
+	flags.StringVar(&agentOptions.logFormat, "log-format", "text", "Format of structured logs (json/text)")
+
+	_ = agentCommand.MarkFlagRequired("server")
+	_ = agentCommand.MarkFlagRequired("tunnel-id")
+	_ = agentCommand.MarkFlagRequired("service")
+	_ = agentCommand.MarkFlagRequired("key-file")
+}
+
+// runAgent forwards a reverse tunnel to a local service until interrupted
+func runAgent(cmd *cobra.Command, args []string) error {
+	log.Init(agentOptions.logLevel, agentOptions.logFormat)
+	logger := log.Get().Named("Agent")
+
+	tunnelID, err := uuid.Parse(agentOptions.tunnelID)
+	if err != nil {
+		return errors.Wrap(err, "invalid tunnel ID")
+	}
+	signer, err := getAgentSigner(agentOptions.keyFile, agentOptions.certificateFile)
+	if err != nil {
+		return err
+	}
+	hostKeyCallback, err := getAgentHostKeyCallback(agentOptions.hostKeys, agentOptions.insecureIgnoreHostKey)
+	if err != nil {
+		return err
+	}
+
+	agent := &tunnel.Agent{
+		ServerAddr:  agentOptions.serverAddr,
+		TunnelID:    tunnelID,
+		ServiceAddr: agentOptions.serviceAddr,
+
+		User:            agentOptions.user,
+		Signer:          signer,
+		HostKeyCallback: hostKeyCallback,
+
+		DialTimeout:       agentOptions.dialTimeout,
+		KeepaliveInterval: agentOptions.keepaliveInterval,
+		KeepaliveTimeout:  agentOptions.keepaliveTimeout,
+
+		Logger: logger.With(zap.String("tunnel_id", tunnelID.String())),
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Report health locally, e.g. for a container orchestrator's liveness probe
+	if agentOptions.healthAddr != "" {
+		listener, err := net.Listen("tcp", agentOptions.healthAddr)
+		if err != nil {
+			return errors.Wrap(err, "listen for health checks")
+		}
+		server := &http.Server{Handler: agent}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Errorw("Health server", zap.Error(err))
+			}
+		}()
+		defer server.Close()
+		logger.Infof("Reporting health on http://%s", listener.Addr())
+	}
+
+	return agent.Run(ctx)
+}
+
+// getAgentSigner reads the agent's private key, and its certificate if there is one
+func getAgentSigner(keyFile, certificateFile string) (gossh.Signer, error) {
+	keyBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read private key")
+	}
+	signer, err := gossh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+	if certificateFile == "" {
+		return signer, nil
+	}
+
+	certBytes, err := os.ReadFile(certificateFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read certificate")
+	}
+	key, _, _, _, err := gossh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse certificate")
+	}
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", certificateFile)
+	}
+	return gossh.NewCertSigner(cert, signer)
+}
+
+// getAgentHostKeyCallback verifies that the server presents one of the given host keys
+func getAgentHostKeyCallback(hostKeys []string, insecureIgnoreHostKey bool) (gossh.HostKeyCallback, error) {
+	if insecureIgnoreHostKey {
+		return gossh.InsecureIgnoreHostKey(), nil
+	}
+	if len(hostKeys) == 0 {
+		return nil, errors.New("--host-key is required, unless --insecure-ignore-host-key is set")
+	}
+
+	var trusted []gossh.PublicKey
+	for _, hostKey := range hostKeys {
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse host key %q", hostKey)
+		}
+		trusted = append(trusted, key)
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		for _, trustedKey := range trusted {
+			if bytes.Equal(trustedKey.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key %s is not trusted", gossh.FingerprintSHA256(key))
+	}, nil
+}
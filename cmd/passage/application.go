@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/hightouchio/passage/log"
 	"github.com/hightouchio/passage/stats"
@@ -49,11 +50,40 @@ const (
 	ConfigTunnelNormalSshUser           = "tunnel.normal.ssh_user"
 	ConfigTunnelNormalDialTimeout       = "tunnel.normal.dial.timeout"
 	ConfigTunnelNormalKeepaliveInterval = "tunnel.normal.keepalive_interval"
+	ConfigTunnelNormalDegradedRTT       = "tunnel.normal.keepalive_degraded_rtt"
+	ConfigTunnelNormalShareConnections  = "tunnel.normal.share_connections"
+	ConfigTunnelNormalProxyURL          = "tunnel.normal.proxy_url"
 
-	ConfigTunnelReverseEnabled  = "tunnel.reverse.enabled"
-	ConfigTunnelReverseHostKey  = "tunnel.reverse.host_key"
-	ConfigTunnelReverseBindHost = "tunnel.reverse.bind_host"
-	ConfigTunnelReverseSshdPort = "tunnel.reverse.sshd_port"
+	ConfigTunnelNormalCryptoKeyExchanges      = "tunnel.normal.crypto.key_exchanges"
+	ConfigTunnelNormalCryptoCiphers           = "tunnel.normal.crypto.ciphers"
+	ConfigTunnelNormalCryptoMACs              = "tunnel.normal.crypto.macs"
+	ConfigTunnelNormalCryptoHostKeyAlgorithms = "tunnel.normal.crypto.host_key_algorithms"
+
+	ConfigTunnelNormalUserCAKeyID          = "tunnel.normal.user_ca.key_id"
+	ConfigTunnelNormalUserCACertificateTTL = "tunnel.normal.user_ca.certificate_ttl"
+
+	ConfigTunnelDynamicEnabled = "tunnel.dynamic.enabled"
+
+	ConfigTunnelReverseEnabled     = "tunnel.reverse.enabled"
+	ConfigTunnelReverseHostKey     = "tunnel.reverse.host_key"
+	ConfigTunnelReverseHostKeyFile = "tunnel.reverse.host_key_file"
+	ConfigTunnelReverseBindHost    = "tunnel.reverse.bind_host"
+	ConfigTunnelReverseSshdPort    = "tunnel.reverse.sshd_port"
+
+	ConfigTunnelReverseDedicatedSshd = "tunnel.reverse.dedicated_sshd"
+
+	ConfigTunnelReverseTrustedUserCAKeysFile = "tunnel.reverse.trusted_user_ca_keys_file"
+
+	ConfigTunnelReverseLimitsHandshakeTimeout              = "tunnel.reverse.limits.handshake_timeout"
+	ConfigTunnelReverseLimitsMaxUnauthenticatedConnections = "tunnel.reverse.limits.max_unauthenticated_connections"
+	ConfigTunnelReverseLimitsMaxAuthFailures               = "tunnel.reverse.limits.max_auth_failures"
+	ConfigTunnelReverseLimitsAuthFailureWindow             = "tunnel.reverse.limits.auth_failure_window"
+	ConfigTunnelReverseLimitsBanDuration                   = "tunnel.reverse.limits.ban_duration"
+
+	ConfigTunnelReverseCryptoKeyExchanges      = "tunnel.reverse.crypto.key_exchanges"
+	ConfigTunnelReverseCryptoCiphers           = "tunnel.reverse.crypto.ciphers"
+	ConfigTunnelReverseCryptoMACs              = "tunnel.reverse.crypto.macs"
+	ConfigTunnelReverseCryptoHostKeyAlgorithms = "tunnel.reverse.crypto.host_key_algorithms"
 
 	ConfigDiscoveryType = "discovery.type"
 
@@ -101,8 +131,16 @@ func initDefaults(config *viper.Viper) {
 	config.SetDefault(ConfigTunnelNormalSshUser, "passage")
 	config.SetDefault(ConfigTunnelNormalDialTimeout, 15*time.Second)
 	config.SetDefault(ConfigTunnelNormalKeepaliveInterval, 1*time.Minute)
+	config.SetDefault(ConfigTunnelNormalDegradedRTT, 2*time.Second)
+	config.SetDefault(ConfigTunnelNormalShareConnections, true)
+	config.SetDefault(ConfigTunnelNormalUserCACertificateTTL, 5*time.Minute)
 	config.SetDefault(ConfigTunnelReverseBindHost, "0.0.0.0")
 	config.SetDefault(ConfigTunnelReverseSshdPort, 22)
+	config.SetDefault(ConfigTunnelReverseLimitsHandshakeTimeout, 30*time.Second)
+	config.SetDefault(ConfigTunnelReverseLimitsMaxUnauthenticatedConnections, 200)
+	config.SetDefault(ConfigTunnelReverseLimitsMaxAuthFailures, 0)
+	config.SetDefault(ConfigTunnelReverseLimitsAuthFailureWindow, 10*time.Minute)
+	config.SetDefault(ConfigTunnelReverseLimitsBanDuration, 15*time.Minute)
 	config.SetDefault(ConfigDiscoveryType, "consul")
 	config.SetDefault(ConfigKeystoreType, "in-memory")
 	config.SetDefault(ConfigLogLevel, "info")
@@ -121,6 +159,8 @@ func startApplication(bootFuncs ...interface{}) error {
 			newPostgres,
 			// Service for storing and retrieving tunnel public and private keys.
 			newTunnelKeystore,
+			// Certificate authority for normal tunnel SSH client certificates.
+			newUserCA,
 			// Service to discover endpoints of currently running tunnels for a distributed system.
 			newTunnelDiscoveryService,
 			// Expose an HTTP server for anything that needs it.
@@ -170,12 +210,31 @@ func startApplication(bootFuncs ...interface{}) error {
 	return nil
 }
 
-func newTunnelAPI(sql *sqlx.DB, stats stats.Stats, keystore keystore.Keystore, discovery discovery.Service) (tunnel.API, error) {
+func newTunnelAPI(sql *sqlx.DB, stats stats.Stats, keystore keystore.Keystore, discovery discovery.Service, userCA *tunnel.UserCertificateAuthority) (tunnel.API, error) {
 	return tunnel.API{
 		SQL:              postgres.NewClient(sql),
 		DiscoveryService: discovery,
 		Keystore:         keystore,
 		Stats:            stats,
+		UserCA:           userCA,
+	}, nil
+}
+
+// newUserCA initializes the user certificate authority for normal tunnels, if one is configured
+func newUserCA(config *viper.Viper, keystore keystore.Keystore) (*tunnel.UserCertificateAuthority, error) {
+	if !config.IsSet(ConfigTunnelNormalUserCAKeyID) {
+		return nil, nil
+	}
+
+	keyID, err := uuid.Parse(config.GetString(ConfigTunnelNormalUserCAKeyID))
+	if err != nil {
+		return nil, newConfigError(ConfigTunnelNormalUserCAKeyID, "must be a valid UUID")
+	}
+
+	return &tunnel.UserCertificateAuthority{
+		Keystore: keystore,
+		KeyID:    keyID,
+		TTL:      config.GetDuration(ConfigTunnelNormalUserCACertificateTTL),
 	}, nil
 }
 
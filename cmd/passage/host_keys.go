@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/fsnotify/fsnotify"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/tunnel"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// watchHostKeyFile reloads the reverse tunnel SSH server's host keys whenever the file changes, or passage receives
+// SIGHUP, until the context is cancelled. The current keys are kept if the file can't be read or parsed.
+func watchHostKeyFile(ctx context.Context, path string, current []byte, sshServer *tunnel.SSHServer, logger *log.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "create host key file watcher")
+	}
+
+	// Watch the directory rather than the file, because the file may be replaced rather than written to, e.g. when a
+	//	Kubernetes secret is updated
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return errors.Wrap(err, "watch host key file")
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	reload := func(force bool) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Errorw("Read host key file", zap.String("path", path), zap.Error(err))
+			return
+		}
+
+		// Other files in the directory change too, so only reload if the keys did
+		if !force && bytes.Equal(data, current) {
+			return
+		}
+		if err := sshServer.SetHostKeys(data); err != nil {
+			logger.Errorw("Reload host keys. Keeping the current host keys", zap.String("path", path), zap.Error(err))
+			return
+		}
+		current = data
+
+		keys, _ := tunnel.ParseHostKeys(data)
+		fingerprints := make([]string, len(keys))
+		for i, key := range keys {
+			fingerprints[i] = gossh.FingerprintSHA256(key.PublicKey())
+		}
+		logger.Infow("Reloaded host keys", zap.Strings("fingerprints", fingerprints))
+	}
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hangup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				reload(false)
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Errorw("Watch host key file", zap.Error(err))
+
+			case <-hangup:
+				reload(true)
+			}
+		}
+	}()
+
+	return nil
+}
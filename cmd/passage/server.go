@@ -19,6 +19,8 @@ import (
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 	"net"
+	"os"
+	"strconv"
 )
 
 var (
@@ -54,6 +56,7 @@ func runTunnels(
 	config *viper.Viper,
 	discovery discovery.Service,
 	keystore keystore.Keystore,
+	userCA *tunnel.UserCertificateAuthority,
 	healthchecks *healthcheckManager,
 	st stats.Stats,
 	logger *log.Logger,
@@ -86,23 +89,75 @@ func runTunnels(
 		})
 	}
 
-	if config.GetBool(ConfigTunnelNormalEnabled) {
-		runTunnelManager(tunnel.Normal, tunnel.InjectNormalTunnelDependencies(server.GetNormalTunnels, tunnel.NormalTunnelServices{
-			SQL:       postgres.NewClient(sql),
-			Keystore:  keystore,
-			Discovery: discovery,
-		}, tunnel.SSHClientOptions{
+	// Normal and dynamic tunnels both connect to bastions, so they share SSH client configuration
+	if config.GetBool(ConfigTunnelNormalEnabled) || config.GetBool(ConfigTunnelDynamicEnabled) {
+		// Share SSH connections between tunnels that connect to the same bastion
+		var sshClientPool *tunnel.SSHClientPool
+		if config.GetBool(ConfigTunnelNormalShareConnections) {
+			sshClientPool = tunnel.NewSSHClientPool()
+		}
+
+		// Connect to bastions through an egress proxy, unless a tunnel specifies its own
+		proxyURL, err := tunnel.ParseProxyURL(config.GetString(ConfigTunnelNormalProxyURL))
+		if err != nil {
+			return newConfigError(ConfigTunnelNormalProxyURL, err.Error())
+		}
+
+		// Restrict the algorithms negotiated with bastions, unless a tunnel specifies its own
+		cryptoPolicy := tunnel.CryptoPolicy{
+			KeyExchanges:      config.GetStringSlice(ConfigTunnelNormalCryptoKeyExchanges),
+			Ciphers:           config.GetStringSlice(ConfigTunnelNormalCryptoCiphers),
+			MACs:              config.GetStringSlice(ConfigTunnelNormalCryptoMACs),
+			HostKeyAlgorithms: config.GetStringSlice(ConfigTunnelNormalCryptoHostKeyAlgorithms),
+		}
+		if err := tunnel.ValidateCryptoPolicy(cryptoPolicy); err != nil {
+			return newConfigError("tunnel.normal.crypto", err.Error())
+		}
+
+		services := tunnel.NormalTunnelServices{
+			SQL:           postgres.NewClient(sql),
+			Keystore:      keystore,
+			Discovery:     discovery,
+			SSHClientPool: sshClientPool,
+			UserCA:        userCA,
+
+			NamedServicePorts: tunnel.NewNamedServicePorts(),
+		}
+		options := tunnel.SSHClientOptions{
 			User:              config.GetString(ConfigTunnelNormalSshUser),
 			DialTimeout:       config.GetDuration(ConfigTunnelNormalDialTimeout),
 			KeepaliveInterval: config.GetDuration(ConfigTunnelNormalKeepaliveInterval),
-		}))
+			ProxyURL:          proxyURL,
+			CryptoPolicy:      cryptoPolicy,
+
+			KeepaliveDegradedThreshold: config.GetDuration(ConfigTunnelNormalDegradedRTT),
+		}
+
+		if config.GetBool(ConfigTunnelNormalEnabled) {
+			runTunnelManager(tunnel.Normal, tunnel.InjectNormalTunnelDependencies(server.GetNormalTunnels, services, options))
+		}
+		if config.GetBool(ConfigTunnelDynamicEnabled) {
+			runTunnelManager(tunnel.Dynamic, tunnel.InjectDynamicTunnelDependencies(server.GetDynamicTunnels, services, options))
+		}
 	}
 
 	if config.GetBool(ConfigTunnelReverseEnabled) {
-		hostKey, err := base64.StdEncoding.DecodeString(config.GetString(ConfigTunnelReverseHostKey))
-		if err != nil {
+		// Host keys are read from a file if one is configured, so that they can be rotated without a restart
+		hostKeyFile := config.GetString(ConfigTunnelReverseHostKeyFile)
+		hostKeyConfig := ConfigTunnelReverseHostKey
+		var hostKey []byte
+		var err error
+		if hostKeyFile != "" {
+			hostKeyConfig = ConfigTunnelReverseHostKeyFile
+			if hostKey, err = os.ReadFile(hostKeyFile); err != nil {
+				return errors.Wrap(err, "read host key file")
+			}
+		} else if hostKey, err = base64.StdEncoding.DecodeString(config.GetString(ConfigTunnelReverseHostKey)); err != nil {
 			return errors.Wrap(err, "decode host key")
 		}
+		if _, err := tunnel.ParseHostKeys(hostKey); err != nil {
+			return newConfigError(hostKeyConfig, err.Error())
+		}
 
 		// Create SSH Server for Reverse Tunnels
 		logger := logger.Named("SSHD")
@@ -115,31 +170,89 @@ func runTunnels(
 			logger,
 			st,
 		)
-		lc.Append(fx.Hook{
-			OnStart: func(ctx context.Context) error {
-				go func() {
-					// We want to pass context.Background() here, not the context.Context accepted from the hook,
-					//	because the hook's context.Context is cancelled after the application has booted completely
-					if err := sshServer.Start(); err != nil {
-						if !errors.Is(err, tunnel.ErrSshServerClosed) {
-							logger.Errorw("SSH", zap.Error(err))
-						}
-					}
-				}()
-				return nil
-			},
-			OnStop: func(ctx context.Context) error {
-				_ = sshServer.Close()
-				return nil
-			},
-		})
 
-		runTunnelManager(tunnel.Reverse, tunnel.InjectReverseTunnelDependencies(server.GetReverseTunnels, tunnel.ReverseTunnelServices{
+		// Restrict the algorithms that reverse tunnel clients may negotiate
+		sshServer.CryptoPolicy = tunnel.CryptoPolicy{
+			KeyExchanges:      config.GetStringSlice(ConfigTunnelReverseCryptoKeyExchanges),
+			Ciphers:           config.GetStringSlice(ConfigTunnelReverseCryptoCiphers),
+			MACs:              config.GetStringSlice(ConfigTunnelReverseCryptoMACs),
+			HostKeyAlgorithms: config.GetStringSlice(ConfigTunnelReverseCryptoHostKeyAlgorithms),
+		}
+		if err := tunnel.ValidateServerCryptoPolicy(sshServer.CryptoPolicy); err != nil {
+			return newConfigError("tunnel.reverse.crypto", err.Error())
+		}
+
+		// Protect the server from brute force attacks and floods of connections
+		sshServer.Limits = tunnel.SSHServerLimits{
+			HandshakeTimeout:              config.GetDuration(ConfigTunnelReverseLimitsHandshakeTimeout),
+			MaxUnauthenticatedConnections: config.GetInt(ConfigTunnelReverseLimitsMaxUnauthenticatedConnections),
+			MaxAuthFailures:               config.GetInt(ConfigTunnelReverseLimitsMaxAuthFailures),
+			AuthFailureWindow:             config.GetDuration(ConfigTunnelReverseLimitsAuthFailureWindow),
+			BanDuration:                   config.GetDuration(ConfigTunnelReverseLimitsBanDuration),
+		}
+		if sshServer.Limits.MaxAuthFailures > 0 && (sshServer.Limits.AuthFailureWindow <= 0 || sshServer.Limits.BanDuration <= 0) {
+			return newConfigError("tunnel.reverse.limits", "auth_failure_window and ban_duration must be set if max_auth_failures is")
+		}
+
+		// Accept user certificates signed by trusted CAs, as well as the public keys authorized for each tunnel
+		if path := config.GetString(ConfigTunnelReverseTrustedUserCAKeysFile); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return errors.Wrap(err, "read trusted user CA keys")
+			}
+			if sshServer.TrustedUserCAKeys, err = tunnel.ParseTrustedUserCAKeys(data); err != nil {
+				return newConfigError(ConfigTunnelReverseTrustedUserCAKeysFile, err.Error())
+			}
+		}
+
+		// Reload the host keys when the file changes or passage receives SIGHUP
+		if hostKeyFile != "" {
+			watchCtx, cancelWatch := context.WithCancel(context.Background())
+			lc.Append(fx.Hook{
+				OnStart: func(ctx context.Context) error {
+					return watchHostKeyFile(watchCtx, hostKeyFile, hostKey, sshServer, logger)
+				},
+				OnStop: func(ctx context.Context) error {
+					cancelWatch()
+					return nil
+				},
+			})
+		}
+
+		services := tunnel.ReverseTunnelServices{
 			SQL:       postgres.NewClient(sql),
 			Keystore:  keystore,
 			Discovery: discovery,
 			SSHServer: sshServer,
-		}))
+		}
+
+		if config.GetBool(ConfigTunnelReverseDedicatedSshd) {
+			// Each tunnel runs its own SSH server on its SSHD port, with the shared server's host key and crypto policy
+			services.NewDedicatedSSHServer = func(sshdPort int) *tunnel.SSHServer {
+				return sshServer.WithBindAddr(net.JoinHostPort(config.GetString(ConfigTunnelReverseBindHost), strconv.Itoa(sshdPort)))
+			}
+		} else {
+			lc.Append(fx.Hook{
+				OnStart: func(ctx context.Context) error {
+					go func() {
+						// We want to pass context.Background() here, not the context.Context accepted from the hook,
+						//	because the hook's context.Context is cancelled after the application has booted completely
+						if err := sshServer.Start(); err != nil {
+							if !errors.Is(err, tunnel.ErrSshServerClosed) {
+								logger.Errorw("SSH", zap.Error(err))
+							}
+						}
+					}()
+					return nil
+				},
+				OnStop: func(ctx context.Context) error {
+					_ = sshServer.Close()
+					return nil
+				},
+			})
+		}
+
+		runTunnelManager(tunnel.Reverse, tunnel.InjectReverseTunnelDependencies(server.GetReverseTunnels, services))
 	}
 
 	return nil
@@ -8,6 +8,7 @@ require (
 	github.com/Masterminds/squirrel v1.5.0
 	github.com/aws/aws-sdk-go v1.44.327
 	github.com/cenkalti/backoff/v4 v4.0.2
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gliderlabs/ssh v0.3.5
 	github.com/golang-migrate/migrate/v4 v4.15.1
 	github.com/google/uuid v1.3.1
@@ -26,6 +27,7 @@ require (
 	go.uber.org/fx v1.14.2
 	go.uber.org/zap v1.26.0
 	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.25.0
 	gopkg.in/DataDog/dd-trace-go.v1 v1.59.0
 )
 
@@ -50,7 +52,6 @@ require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/ebitengine/purego v0.5.0 // indirect
 	github.com/fatih/color v1.15.0 // indirect
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
@@ -96,7 +97,6 @@ require (
 	go4.org/unsafe/assume-no-moving-gc v0.0.0-20231121144256-b99613f794b6 // indirect
 	golang.org/x/exp v0.0.0-20230321023759-10a507213a29 // indirect
 	golang.org/x/mod v0.17.0 // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/oauth2 v0.9.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
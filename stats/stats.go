@@ -38,6 +38,10 @@ func (s Stats) Gauge(name string, value float64, tags Tags, rate float64) {
 	s.client.Gauge(name, value, convertTags(mergeTags([]Tags{s.tags, tags})), rate)
 }
 
+func (s Stats) Histogram(name string, value float64, tags Tags, rate float64) {
+	s.client.Histogram(name, value, convertTags(mergeTags([]Tags{s.tags, tags})), rate)
+}
+
 func mergeTags(tags []Tags) Tags {
 	mergedTags := make(Tags, 0)
 	for _, tagGroup := range tags {
@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent is a reverse tunnel client, which runs alongside a customer's service. It connects to Passage's reverse
+// tunnel SSH server, forwards the tunnel to the service, and reconnects with backoff if the connection fails.
+type Agent struct {
+	// ServerAddr is the address of the reverse tunnel SSH server
+	ServerAddr string
+
+	// TunnelID is the reverse tunnel to forward. The server resolves it to the tunnel's port.
+	TunnelID uuid.UUID
+
+	// ServiceAddr is the address of the service that tunnel connections are forwarded to
+	ServiceAddr string
+
+	User            string
+	Signer          gossh.Signer
+	HostKeyCallback gossh.HostKeyCallback
+
+	DialTimeout       time.Duration
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	Logger *log.Logger
+
+	status AgentStatus
+	lock   sync.RWMutex
+}
+
+// AgentStatus describes the agent's connection to the reverse tunnel SSH server
+type AgentStatus struct {
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connectedAt"`
+
+	// Error is why the last connection failed
+	Error      string `json:"error,omitempty"`
+	Reconnects int    `json:"reconnects"`
+
+	// ServiceError is why the service couldn't be reached, when health was last checked
+	ServiceError string `json:"serviceError,omitempty"`
+}
+
+// Run connects to the server and forwards the tunnel until the context is cancelled, reconnecting whenever the
+// connection fails
+func (a *Agent) Run(ctx context.Context) error {
+	retry := newAgentBackoff()
+	retry.Reset()
+	for {
+		connected, err := a.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// A connection that was established counts as progress, so start backing off from the beginning again
+		if connected {
+			retry.Reset()
+		}
+
+		a.lock.Lock()
+		a.status.Connected = false
+		a.status.Error = err.Error()
+		a.status.Reconnects++
+		a.lock.Unlock()
+
+		wait := retry.NextBackOff()
+		a.Logger.Errorw("Disconnected", zap.Error(err), zap.Duration("retry_in", wait))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// connect opens a single connection to the server and forwards the tunnel until it fails. It reports whether the
+// forward was established.
+func (a *Agent) connect(ctx context.Context) (bool, error) {
+	logger := a.Logger.With(zap.String("server_addr", a.ServerAddr))
+	logger.Debug("Connecting")
+
+	dialer := net.Dialer{Timeout: a.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", a.ServerAddr)
+	if err != nil {
+		return false, errors.Wrap(err, "dial server")
+	}
+	defer conn.Close()
+
+	// Bound the handshake, so a server that never responds doesn't block reconnection
+	if err := conn.SetDeadline(time.Now().Add(a.DialTimeout)); err != nil {
+		return false, errors.Wrap(err, "set handshake deadline")
+	}
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, a.ServerAddr, &gossh.ClientConfig{
+		User:            a.User,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(a.Signer)},
+		HostKeyCallback: a.HostKeyCallback,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "establish SSH connection")
+	}
+	defer sshConn.Close()
+	go a.handleRequests(reqs, conn.RemoteAddr(), logger)
+
+	// Request the forward by tunnel ID, and let the server resolve the port
+	ok, reply, err := sshConn.SendRequest(sshTCPForwardOpenEvent, true, gossh.Marshal(remoteForwardOpenRequest{
+		BindAddr: a.TunnelID.String(),
+	}))
+	if err != nil {
+		return false, errors.Wrap(err, "request port forward")
+	}
+	if !ok {
+		return false, errors.Errorf("port forward rejected: %s", string(reply))
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return true, errors.Wrap(err, "clear handshake deadline")
+	}
+
+	a.lock.Lock()
+	a.status.Connected = true
+	a.status.ConnectedAt = time.Now()
+	a.status.Error = ""
+	a.lock.Unlock()
+	logger.Info("Tunnel forwarded")
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Detect a dead connection, so the agent reconnects rather than waiting on it forever
+	if a.KeepaliveInterval > 0 {
+		go func() {
+			if err := sshKeepalive(ctx, conn, sshConn, a.KeepaliveInterval, a.KeepaliveTimeout, nil); err != nil {
+				cancel(errors.Wrap(err, "SSH keepalive failed"))
+			}
+		}()
+	}
+	go func() {
+		cancel(errors.Wrap(sshConn.Wait(), "SSH connection closed"))
+	}()
+
+	// Forward each tunnel connection to the service
+	go func() {
+		for newChannel := range chans {
+			if newChannel.ChannelType() != forwardedTCPChannelType {
+				_ = newChannel.Reject(gossh.UnknownChannelType, "unsupported channel type")
+				continue
+			}
+			go a.handleChannel(newChannel, logger)
+		}
+	}()
+
+	<-ctx.Done()
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return true, cause
+	}
+	return true, errors.New("SSH connection closed")
+}
+
+// handleChannel proxies a tunnel connection to the service
+func (a *Agent) handleChannel(newChannel gossh.NewChannel, logger *log.Logger) {
+	service, err := net.DialTimeout("tcp", a.ServiceAddr, a.DialTimeout)
+	if err != nil {
+		logger.Errorw("Could not dial service", zap.String("service_addr", a.ServiceAddr), zap.Error(err))
+		_ = newChannel.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		_ = service.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	_ = runPipeline(channel, service)
+}
+
+// handleRequests handles global requests from the server. The server announces its host keys, so that a warning can
+// be logged for any key that isn't trusted yet, before the server rotates to it.
+func (a *Agent) handleRequests(reqs <-chan *gossh.Request, remote net.Addr, logger *log.Logger) {
+	for req := range reqs {
+		if req.Type == hostKeysRequestType {
+			a.checkAnnouncedHostKeys(req.Payload, remote, logger)
+		}
+		if req.WantReply {
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+func (a *Agent) checkAnnouncedHostKeys(payload []byte, remote net.Addr, logger *log.Logger) {
+	blobs, ok := parseHostKeyBlobs(payload)
+	if !ok {
+		logger.Warn("Could not parse host keys announced by server")
+		return
+	}
+
+	for _, blob := range blobs {
+		key, err := gossh.ParsePublicKey(blob)
+		if err != nil {
+			// Unsupported key types are skipped, as OpenSSH does
+			continue
+		}
+		if err := a.HostKeyCallback(a.ServerAddr, remote, key); err != nil {
+			logger.Warnw("Server announced a host key that isn't trusted",
+				zap.String("fingerprint", gossh.FingerprintSHA256(key)),
+				zap.String("host_key", strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))),
+			)
+		}
+	}
+}
+
+// Status returns the agent's connection status, and checks whether the service is reachable
+func (a *Agent) Status() AgentStatus {
+	a.lock.RLock()
+	status := a.status
+	a.lock.RUnlock()
+
+	if conn, err := net.DialTimeout("tcp", a.ServiceAddr, a.DialTimeout); err != nil {
+		status.ServiceError = err.Error()
+	} else {
+		_ = conn.Close()
+	}
+	return status
+}
+
+// ServeHTTP reports the agent's status. It responds with 503 Service Unavailable unless the tunnel is forwarded and the
+// service is reachable.
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := a.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Connected || status.ServiceError != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func newAgentBackoff() backoff.BackOff {
+	return &backoff.ExponentialBackOff{
+		InitialInterval:     1 * time.Second,
+		MaxInterval:         60 * time.Second,
+		RandomizationFactor: 0.5,
+		Multiplier:          2,
+
+		// If MaxElapsedTime is 0, the exponential backoff will never stop.
+		MaxElapsedTime: 0,
+
+		Clock: backoff.SystemClock,
+		Stop:  backoff.Stop,
+	}
+}
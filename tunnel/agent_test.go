@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testForwardEcho sends a line through a reverse tunnel forward, and returns the response
+func testForwardEcho(t *testing.T, forward ReverseForwardingConnection, line string) string {
+	upstream, err := forward.Dial()
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer upstream.Close()
+
+	if _, err := upstream.Write([]byte(line + "\n")); !assert.NoError(t, err) {
+		return ""
+	}
+	response, err := bufio.NewReader(upstream).ReadString('\n')
+	assert.NoError(t, err)
+	return response
+}
+
+func TestAgent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, addr := startTestReverseSSHServer(t)
+	servicePort := startTestEchoServer(t, "service: ")
+
+	// The agent doesn't know the tunnel's port, only its ID
+	agentKey := newTestSigner(t)
+	tunnelID := uuid.New()
+	connections := make(chan ReverseForwardingConnection)
+	server.RegisterTunnel(SSHServerRegisteredTunnel{
+		ID:             tunnelID,
+		RegisteredPort: getFreePort(),
+		AuthorizedKeys: []ssh.PublicKey{agentKey.PublicKey()},
+		Connections:    connections,
+	})
+	forwards := make(chan ReverseForwardingConnection, 1)
+	go func() {
+		for conn := range connections {
+			conn.admit(nil)
+			forwards <- conn
+		}
+	}()
+
+	agent := &Agent{
+		ServerAddr:      addr,
+		TunnelID:        tunnelID,
+		ServiceAddr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(servicePort)),
+		User:            "passage",
+		Signer:          agentKey,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		DialTimeout:     5 * time.Second,
+		Logger:          log.Get(),
+	}
+	agentErr := make(chan error, 1)
+	go func() {
+		agentErr <- agent.Run(ctx)
+	}()
+
+	// Tunnel connections reach the service
+	forward := receiveTestForward(t, forwards)
+	assert.Equal(t, "service: hello\n", testForwardEcho(t, forward, "hello"))
+
+	// The agent reports that it's healthy
+	recorder := httptest.NewRecorder()
+	agent.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, agent.Status().Connected)
+
+	// The agent reconnects when its connection is lost
+	_ = forward.Value(ssh.ContextKeyConn).(*gossh.ServerConn).Close()
+	forward = receiveTestForward(t, forwards)
+	assert.Equal(t, "service: again\n", testForwardEcho(t, forward, "again"))
+	assert.Equal(t, 1, agent.Status().Reconnects)
+
+	cancel()
+	assert.NoError(t, <-agentErr)
+}
+
+func TestAgent_ServiceUnreachable(t *testing.T) {
+	agent := &Agent{
+		ServiceAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(getFreePort())),
+		DialTimeout: time.Second,
+	}
+
+	recorder := httptest.NewRecorder()
+	agent.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	status := agent.Status()
+	assert.False(t, status.Connected)
+	assert.NotEmpty(t, status.ServiceError)
+}
@@ -8,7 +8,10 @@ import (
 	"github.com/hightouchio/passage/tunnel/discovery"
 	"github.com/hightouchio/passage/tunnel/keystore"
 	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"time"
 )
 
 // API provides a source of truth for Tunnel configuration. It serves remote clients via HTTP APIs, as well as Manager instances via an exported ListFunc
@@ -17,6 +20,9 @@ type API struct {
 	DiscoveryService discovery.Service
 	Keystore         keystore.Keystore
 	Stats            stats.Stats
+
+	// UserCA is the certificate authority that normal tunnels use to authenticate, if configured
+	UserCA *UserCertificateAuthority
 }
 
 // GetNormalTunnels is a ListFunc which returns the set of NormalTunnel[] that should be run.
@@ -35,6 +41,22 @@ func (s API) GetNormalTunnels(ctx context.Context) ([]NormalTunnel, error) {
 	return tunnels, nil
 }
 
+// GetDynamicTunnels is a ListFunc which returns the set of DynamicTunnel[] that should be run.
+func (s API) GetDynamicTunnels(ctx context.Context) ([]DynamicTunnel, error) {
+	dynamicTunnels, err := s.SQL.ListDynamicActiveTunnels(ctx)
+	if err != nil {
+		return []DynamicTunnel{}, err
+	}
+
+	// convert all the SQL records to our primary struct
+	tunnels := make([]DynamicTunnel, len(dynamicTunnels))
+	for i, record := range dynamicTunnels {
+		tunnels[i] = dynamicTunnelFromSQL(record)
+	}
+
+	return tunnels, nil
+}
+
 // GetReverseTunnels is a ListFunc which returns the set of ReverseTunnel[] that should be run.
 func (s API) GetReverseTunnels(ctx context.Context) ([]ReverseTunnel, error) {
 	reverseTunnels, err := s.SQL.ListReverseActiveTunnels(ctx)
@@ -60,6 +82,21 @@ type GetTunnelResponse struct {
 	Tunnel             `json:"tunnel"`
 	*ConnectionDetails `json:"connection"`
 	Healthchecks       []HealthcheckDetails `json:"healthchecks"`
+
+	// Services are the connection details for each of a normal tunnel's named services
+	Services []ServiceConnectionDetails `json:"services,omitempty"`
+
+	// Handshake describes the most recent SSH connection made for the tunnel
+	Handshake *SSHHandshake `json:"handshake,omitempty"`
+
+	// Keepalive is the most recent SSH keepalive to the tunnel's bastion
+	Keepalive *KeepaliveDetails `json:"keepalive,omitempty"`
+}
+
+type KeepaliveDetails struct {
+	// RTT is the keepalive's round trip time, in milliseconds
+	RTT  float64   `json:"rttMs"`
+	Time time.Time `json:"time"`
 }
 
 type ConnectionDetails struct {
@@ -67,6 +104,14 @@ type ConnectionDetails struct {
 	Port int    `json:"port"`
 }
 
+type ServiceConnectionDetails struct {
+	Name string `json:"name"`
+	ConnectionDetails
+
+	// Error is why the service's connection details couldn't be found, if they couldn't
+	Error string `json:"error,omitempty"`
+}
+
 type HealthcheckDetails struct {
 	ID      string `json:"id"`
 	Status  string `json:"status"`
@@ -106,6 +151,42 @@ func (s API) GetTunnel(ctx context.Context, req GetTunnelRequest) (*GetTunnelRes
 		}
 	}
 
+	// Populate connection details for named services
+	if normalTunnel, ok := tunnel.(NormalTunnel); ok {
+		for _, service := range normalTunnel.Services {
+			// A service that can't be found is reported, rather than left out, so that clients can tell it's missing
+			serviceDetails, err := s.DiscoveryService.GetTunnelService(req.ID, service.Name)
+			if err != nil {
+				response.Services = append(response.Services, ServiceConnectionDetails{Name: service.Name, Error: err.Error()})
+				continue
+			}
+			response.Services = append(response.Services, ServiceConnectionDetails{
+				Name: service.Name,
+				ConnectionDetails: ConnectionDetails{
+					Host: serviceDetails.Host,
+					Port: serviceDetails.Port,
+				},
+			})
+		}
+	}
+
+	// Populate the most recent SSH handshake, if the tunnel has connected
+	handshake, err := s.SQL.GetTunnelHandshake(ctx, req.ID)
+	if err == nil {
+		h := handshakeFromSQL(handshake)
+		response.Handshake = &h
+	} else if err != postgres.ErrTunnelNotFound {
+		return nil, errors.Wrap(err, "error fetching handshake")
+	}
+
+	// Populate the most recent keepalive round trip time, if the tunnel has sent one
+	keepalive, err := s.SQL.GetTunnelKeepalive(ctx, req.ID)
+	if err == nil {
+		response.Keepalive = &KeepaliveDetails{RTT: keepalive.RTTMillis, Time: keepalive.UpdatedAt}
+	} else if err != postgres.ErrTunnelNotFound {
+		return nil, errors.Wrap(err, "error fetching keepalive")
+	}
+
 	return &response, nil
 }
 
@@ -141,23 +222,287 @@ func (s API) UpdateTunnel(ctx context.Context, req UpdateTunnelRequest) (*Update
 
 	// Update tunnel
 	switch tunnelType {
-	case Normal:
-		var newTunnel postgres.NormalTunnel
-		newTunnel, err = s.SQL.UpdateNormalTunnel(ctx, req.ID, mapUpdateFields(req.UpdateFields, map[string]string{
+	case Normal, Dynamic:
+		fields := mapUpdateFields(req.UpdateFields, map[string]string{
 			"enabled":     "enabled",
 			"serviceHost": "service_host",
 			"servicePort": "service_port",
 			"sshHost":     "ssh_host",
 			"sshPort":     "ssh_port",
 			"sshUser":     "ssh_user",
-		}))
 
-		tunnel = normalTunnelFromSQL(newTunnel)
+			"alternateBastions": "alternate_bastions",
+			"bastionStrategy":   "bastion_strategy",
+
+			"serviceSocketPath": "service_socket_path",
+			"services":          "services",
+
+			"upstreamTargets": "upstream_targets",
+			"upstreamPolicy":  "upstream_policy",
+
+			"hostKeyVerification": "host_key_verification",
+			"jumpHosts":           "jump_hosts",
+
+			"certificatePrincipals": "certificate_principals",
+
+			"proxyUrl": "proxy_url",
+
+			"cryptoPolicy": "crypto_policy",
+
+			"allowedDestinations": "allowed_destinations",
+		})
+		current := normalTunnelOf(tunnel)
+
+		// Only dynamic tunnels have an allowlist, which is stored as JSON, so it must be validated and converted
+		if field, ok := fields["allowed_destinations"]; ok {
+			if tunnelType != Dynamic {
+				return nil, newRequestError("allowedDestinations can only be set on dynamic tunnels")
+			}
+			destinations, err := parseAllowedDestinationsField(field)
+			if err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["allowed_destinations"] = sqlFromAllowedDestinations(destinations)
+		}
+
+		// Alternate bastions are stored as JSON, so they must be validated and converted
+		if field, ok := fields["alternate_bastions"]; ok {
+			bastions, err := parseAlternateBastionsField(field)
+			if err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["alternate_bastions"] = sqlFromBastions(bastions)
+		}
+		if field, ok := fields["bastion_strategy"]; ok {
+			strategy, ok := field.(string)
+			if !ok {
+				return nil, newRequestError("bastionStrategy must be a string")
+			}
+			if err := validateBastionStrategy(strategy); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["bastion_strategy"] = firstNotEmptyString(strategy, BastionStrategyOrdered)
+		}
+
+		if field, ok := fields["host_key_verification"]; ok {
+			verification, ok := field.(string)
+			if !ok {
+				return nil, newRequestError("hostKeyVerification must be a string")
+			}
+			if err := validateHostKeyVerification(verification); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["host_key_verification"] = firstNotEmptyString(verification, HostKeyVerificationTOFU)
+		}
+
+		// Upstream targets are stored as JSON, so they must be validated and converted
+		upstreamTargets := current.UpstreamTargets
+		if field, ok := fields["upstream_targets"]; ok {
+			targets, err := parseUpstreamTargetsField(field)
+			if err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			upstreamTargets = targets
+			fields["upstream_targets"] = sqlFromUpstreamTargets(targets)
+		}
+
+		// The service target is validated as it will be after the update, as it is when the tunnel is created
+		_, hostUpdated := fields["service_host"]
+		_, portUpdated := fields["service_port"]
+		_, socketPathUpdated := fields["service_socket_path"]
+		_, targetsUpdated := fields["upstream_targets"]
+		if hostUpdated || portUpdated || socketPathUpdated || targetsUpdated {
+			serviceHost, servicePort, serviceSocketPath := current.ServiceHost, current.ServicePort, current.ServiceSocketPath
+			if field, ok := fields["service_host"]; ok {
+				if serviceHost, ok = field.(string); !ok {
+					return nil, newRequestError("serviceHost must be a string")
+				}
+			}
+			if field, ok := fields["service_port"]; ok {
+				port, err := parseIntField(field)
+				if err != nil {
+					return nil, newRequestError("servicePort must be an integer")
+				}
+				servicePort = port
+				fields["service_port"] = port
+			}
+			if field, ok := fields["service_socket_path"]; ok {
+				if serviceSocketPath, ok = field.(string); !ok {
+					return nil, newRequestError("serviceSocketPath must be a string")
+				}
+			}
+
+			if errs := validateServiceTarget("", serviceHost, servicePort, serviceSocketPath); len(errs) > 0 {
+				return nil, newRequestError(errs[0].Error())
+			}
+			if len(upstreamTargets) > 0 && serviceSocketPath != "" {
+				return nil, newRequestError("upstreamTargets cannot be combined with serviceSocketPath")
+			}
+		}
+		if field, ok := fields["upstream_policy"]; ok {
+			policy, ok := field.(string)
+			if !ok {
+				return nil, newRequestError("upstreamPolicy must be a string")
+			}
+			if err := validateUpstreamPolicy(policy); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["upstream_policy"] = firstNotEmptyString(policy, UpstreamPolicyFailover)
+		}
+
+		// Named services are stored as JSON, so they must be validated and converted
+		if field, ok := fields["services"]; ok {
+			services, err := parseNamedServicesField(field)
+			if err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["services"] = sqlFromNamedServices(services)
+		}
+
+		// Jump hosts are stored as JSON, so they must be validated and converted
+		if field, ok := fields["jump_hosts"]; ok {
+			jumpHosts, err := parseJumpHostsField(field)
+			if err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			tunnelKeys, err := s.SQL.GetNormalTunnelPrivateKeys(ctx, req.ID)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not look up keys")
+			}
+			if err := validateJumpHostKeys(jumpHosts, keyIDs(tunnelKeys)); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["jump_hosts"] = sqlFromJumpHosts(jumpHosts)
+		}
+
+		// Certificate principals are stored as an array
+		if field, ok := fields["certificate_principals"]; ok {
+			principals, err := parseStringsField(field)
+			if err != nil {
+				return nil, newRequestError("certificatePrincipals must be a list of strings")
+			}
+			fields["certificate_principals"] = append(pq.StringArray{}, principals...)
+		}
+
+		// The crypto policy is stored as JSON, so it must be validated and converted
+		if field, ok := fields["crypto_policy"]; ok {
+			policy, err := parseCryptoPolicyField(field)
+			if err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["crypto_policy"] = sqlFromCryptoPolicy(policy)
+		}
+
+		// Egress proxy passwords are stored in the keystore, like tunnel passwords. The API returns the proxy URL
+		//	redacted, so if it's sent back unchanged, the stored password is kept.
+		var newProxyPasswordKeyID, oldProxyPasswordKeyID *uuid.UUID
+		if field, ok := fields["proxy_url"]; ok {
+			rawURL, ok := field.(string)
+			if !ok {
+				return nil, newRequestError("proxyUrl must be a string")
+			}
+
+			if rawURL == current.ProxyURL {
+				delete(fields, "proxy_url")
+			} else {
+				proxyURL, proxyPassword, err := splitProxyPassword(rawURL)
+				if err != nil {
+					return nil, newRequestError(err.Error())
+				}
+				fields["proxy_url"] = proxyURL
+
+				oldProxyPasswordKeyID = current.ProxyPasswordKeyID
+				fields["proxy_password_key_id"] = uuid.NullUUID{}
+				if proxyPassword != "" {
+					proxyPasswordKeyID, err := s.setPassword(ctx, proxyPassword)
+					if err != nil {
+						return nil, err
+					}
+					newProxyPasswordKeyID = &proxyPasswordKeyID
+					fields["proxy_password_key_id"] = sqlFromUUIDPtr(newProxyPasswordKeyID)
+				}
+			}
+		}
+
+		// Passwords are stored in the keystore, and the tunnel refers to them by ID. An empty password removes it.
+		//	Whichever password the tunnel no longer refers to is deleted from the keystore.
+		var newPasswordKeyID, oldPasswordKeyID *uuid.UUID
+		if field, ok := req.UpdateFields["password"]; ok {
+			password, ok := field.(string)
+			if !ok {
+				return nil, newRequestError("password must be a string")
+			}
+			oldPasswordKeyID = getPasswordKeyID(tunnel)
+			if password == "" {
+				fields["password_key_id"] = uuid.NullUUID{}
+			} else {
+				passwordKeyID, err := s.setPassword(ctx, password)
+				if err != nil {
+					return nil, err
+				}
+				newPasswordKeyID = &passwordKeyID
+				fields["password_key_id"] = sqlFromUUIDPtr(newPasswordKeyID)
+			}
+		}
+
+		var newTunnel postgres.NormalTunnel
+		newTunnel, err = s.SQL.UpdateNormalTunnel(ctx, req.ID, fields)
+		if err != nil {
+			s.deletePassword(ctx, newPasswordKeyID)
+			s.deletePassword(ctx, newProxyPasswordKeyID)
+		} else {
+			s.deletePassword(ctx, oldPasswordKeyID)
+			s.deletePassword(ctx, oldProxyPasswordKeyID)
+		}
+		if tunnelType == Dynamic {
+			tunnel = dynamicTunnelFromSQL(newTunnel)
+		} else {
+			tunnel = normalTunnelFromSQL(newTunnel)
+		}
 	case Reverse:
-		var newTunnel postgres.ReverseTunnel
-		newTunnel, err = s.SQL.UpdateReverseTunnel(ctx, req.ID, mapUpdateFields(req.UpdateFields, map[string]string{
+		fields := mapUpdateFields(req.UpdateFields, map[string]string{
 			"enabled": "enabled",
-		}))
+
+			"clientPolicy":       "client_policy",
+			"maxClients":         "max_clients",
+			"allowedSourceCidrs": "allowed_source_cidrs",
+		})
+
+		if field, ok := fields["client_policy"]; ok {
+			policy, ok := field.(string)
+			if !ok {
+				return nil, newRequestError("clientPolicy must be a string")
+			}
+			if err := validateClientPolicy(policy); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["client_policy"] = firstNotEmptyString(policy, ClientPolicyRoundRobin)
+		}
+		if field, ok := fields["max_clients"]; ok {
+			maxClients, err := parseIntField(field)
+			if err != nil {
+				return nil, newRequestError("maxClients must be an integer")
+			}
+			if err := validateMaxClients(maxClients); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["max_clients"] = maxClients
+		}
+
+		// Allowed source CIDRs are stored as an array
+		if field, ok := fields["allowed_source_cidrs"]; ok {
+			cidrs, err := parseStringsField(field)
+			if err != nil {
+				return nil, newRequestError("allowedSourceCidrs must be a list of strings")
+			}
+			if err := validateAllowedSourceCIDRs(cidrs); err != nil {
+				return nil, newRequestError(err.Error())
+			}
+			fields["allowed_source_cidrs"] = append(pq.StringArray{}, cidrs...)
+		}
+
+		var newTunnel postgres.ReverseTunnel
+		newTunnel, err = s.SQL.UpdateReverseTunnel(ctx, req.ID, fields)
 		tunnel = reverseTunnelFromSQL(newTunnel)
 	default:
 		return nil, fmt.Errorf("invalid tunnel type %s", tunnelType)
@@ -216,6 +561,101 @@ func (s API) CheckTunnel(ctx context.Context, req CheckTunnelRequest) (*CheckTun
 	return &CheckTunnelResponse{Success: true}, nil
 }
 
+type KnownHostsRequest struct {
+	ID uuid.UUID
+}
+
+type SetKnownHostsRequest struct {
+	ID         uuid.UUID `json:"-"`
+	KnownHosts []string  `json:"knownHosts"`
+}
+
+type KnownHostsResponse struct {
+	KnownHosts []KnownHostDetails `json:"knownHosts"`
+}
+
+type KnownHostDetails struct {
+	Entry       string    `json:"entry"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// GetKnownHosts returns the known hosts that are trusted for a normal tunnel, including any host key recorded on first use
+func (s API) GetKnownHosts(ctx context.Context, req KnownHostsRequest) (*KnownHostsResponse, error) {
+	if _, err := s.SQL.GetNormalTunnel(ctx, req.ID); err != nil {
+		return nil, err
+	}
+
+	records, err := s.SQL.GetNormalTunnelKnownHosts(ctx, req.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get known hosts")
+	}
+
+	response := KnownHostsResponse{KnownHosts: make([]KnownHostDetails, len(records))}
+	for i, record := range records {
+		response.KnownHosts[i] = KnownHostDetails{
+			Entry:     record.Entry,
+			CreatedAt: record.CreatedAt,
+		}
+		if entry, err := parseKnownHost(record.Entry); err == nil {
+			response.KnownHosts[i].Fingerprint = ssh.FingerprintSHA256(entry.Key)
+		}
+	}
+
+	return &response, nil
+}
+
+// SetKnownHosts replaces the known hosts that are trusted for a normal tunnel
+func (s API) SetKnownHosts(ctx context.Context, req SetKnownHostsRequest) (*KnownHostsResponse, error) {
+	if err := validateKnownHosts(req.KnownHosts); err != nil {
+		return nil, err
+	}
+	if _, err := s.SQL.GetNormalTunnel(ctx, req.ID); err != nil {
+		return nil, err
+	}
+
+	if err := s.SQL.SetNormalTunnelKnownHosts(ctx, req.ID, req.KnownHosts); err != nil {
+		return nil, errors.Wrap(err, "could not set known hosts")
+	}
+
+	return s.GetKnownHosts(ctx, KnownHostsRequest{ID: req.ID})
+}
+
+// ResetKnownHosts removes all known hosts for a normal tunnel. If the tunnel trusts on first use, the next host key
+// presented by the bastion will be recorded.
+func (s API) ResetKnownHosts(ctx context.Context, req KnownHostsRequest) (*KnownHostsResponse, error) {
+	if _, err := s.SQL.GetNormalTunnel(ctx, req.ID); err != nil {
+		return nil, err
+	}
+
+	if err := s.SQL.DeleteNormalTunnelKnownHosts(ctx, req.ID); err != nil {
+		return nil, errors.Wrap(err, "could not delete known hosts")
+	}
+
+	return &KnownHostsResponse{KnownHosts: []KnownHostDetails{}}, nil
+}
+
+type GetUserCAResponse struct {
+	PublicKey string `json:"publicKey"`
+}
+
+// ErrUserCANotConfigured is returned when the user CA is requested, but Passage has not been configured with one
+var ErrUserCANotConfigured = errors.New("user CA is not configured")
+
+// GetUserCA returns the public key of the user CA, which bastions should trust with `TrustedUserCAKeys`
+func (s API) GetUserCA(ctx context.Context) (*GetUserCAResponse, error) {
+	if s.UserCA == nil {
+		return nil, ErrUserCANotConfigured
+	}
+
+	publicKey, err := s.UserCA.PublicKey(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get user CA public key")
+	}
+
+	return &GetUserCAResponse{PublicKey: string(publicKey)}, nil
+}
+
 type sqlClient interface {
 	CreateReverseTunnel(ctx context.Context, data postgres.ReverseTunnel, authorizedKeys []uuid.UUID) (postgres.ReverseTunnel, error)
 	GetReverseTunnel(ctx context.Context, id uuid.UUID) (postgres.ReverseTunnel, error)
@@ -226,8 +666,17 @@ type sqlClient interface {
 	GetNormalTunnel(ctx context.Context, id uuid.UUID) (postgres.NormalTunnel, error)
 	UpdateNormalTunnel(ctx context.Context, id uuid.UUID, data map[string]interface{}) (postgres.NormalTunnel, error)
 	ListNormalActiveTunnels(ctx context.Context) ([]postgres.NormalTunnel, error)
+	ListDynamicActiveTunnels(ctx context.Context) ([]postgres.NormalTunnel, error)
+
+	GetNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID) ([]postgres.KnownHost, error)
+	SetNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID, entries []string) error
+	DeleteNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID) error
+
+	GetTunnelHandshake(ctx context.Context, tunnelID uuid.UUID) (postgres.Handshake, error)
+	GetTunnelKeepalive(ctx context.Context, tunnelID uuid.UUID) (postgres.Keepalive, error)
 
 	DeleteTunnel(ctx context.Context, tunnelID uuid.UUID) error
 
 	AuthorizeKeyForTunnel(ctx context.Context, tunnelType string, tunnelID uuid.UUID, keyID uuid.UUID) error
+	GetNormalTunnelPrivateKeys(ctx context.Context, tunnelID uuid.UUID) ([]postgres.Key, error)
 }
@@ -0,0 +1,179 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"slices"
+	"strings"
+)
+
+// CryptoPolicy restricts the algorithms that an SSH connection may negotiate, so that connections to legacy bastions
+// can allow old algorithms while Passage's own SSH server bans them. An empty list allows golang.org/x/crypto/ssh's
+// defaults for that kind of algorithm.
+type CryptoPolicy struct {
+	KeyExchanges      []string `json:"keyExchanges,omitempty"`
+	Ciphers           []string `json:"ciphers,omitempty"`
+	MACs              []string `json:"macs,omitempty"`
+	HostKeyAlgorithms []string `json:"hostKeyAlgorithms,omitempty"`
+}
+
+// The algorithms supported by golang.org/x/crypto/ssh, including those it doesn't enable by default
+var (
+	supportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+	supportedCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+	supportedHostKeyAlgorithms = []string{
+		gossh.CertAlgoRSASHA256v01, gossh.CertAlgoRSASHA512v01, gossh.CertAlgoRSAv01, gossh.CertAlgoDSAv01,
+		gossh.CertAlgoECDSA256v01, gossh.CertAlgoECDSA384v01, gossh.CertAlgoECDSA521v01, gossh.CertAlgoED25519v01,
+		gossh.KeyAlgoECDSA256, gossh.KeyAlgoECDSA384, gossh.KeyAlgoECDSA521,
+		gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSA, gossh.KeyAlgoDSA,
+		gossh.KeyAlgoED25519,
+	}
+
+	// The group exchange key exchanges are only implemented for clients
+	serverUnsupportedKeyExchanges = []string{"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1"}
+)
+
+// ValidateCryptoPolicy validates that every algorithm in the policy is supported
+func ValidateCryptoPolicy(policy CryptoPolicy) error {
+	for _, check := range []struct {
+		field      string
+		algorithms []string
+		supported  []string
+	}{
+		{"keyExchanges", policy.KeyExchanges, supportedKeyExchanges},
+		{"ciphers", policy.Ciphers, supportedCiphers},
+		{"macs", policy.MACs, supportedMACs},
+		{"hostKeyAlgorithms", policy.HostKeyAlgorithms, supportedHostKeyAlgorithms},
+	} {
+		for _, algorithm := range check.algorithms {
+			if !slices.Contains(check.supported, algorithm) {
+				return fmt.Errorf("cryptoPolicy.%s: unsupported algorithm %q", check.field, algorithm)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateServerCryptoPolicy validates a policy for Passage's SSH server, which supports fewer algorithms than clients
+func ValidateServerCryptoPolicy(policy CryptoPolicy) error {
+	if err := ValidateCryptoPolicy(policy); err != nil {
+		return err
+	}
+	for _, algorithm := range policy.KeyExchanges {
+		if slices.Contains(serverUnsupportedKeyExchanges, algorithm) {
+			return fmt.Errorf("cryptoPolicy.keyExchanges: %q is not supported by the SSH server", algorithm)
+		}
+	}
+	return nil
+}
+
+// override replaces each kind of algorithm in the policy with those in the override, if the override sets any
+func (p CryptoPolicy) override(o CryptoPolicy) CryptoPolicy {
+	pick := func(base, override []string) []string {
+		if len(override) > 0 {
+			return override
+		}
+		return base
+	}
+	return CryptoPolicy{
+		KeyExchanges:      pick(p.KeyExchanges, o.KeyExchanges),
+		Ciphers:           pick(p.Ciphers, o.Ciphers),
+		MACs:              pick(p.MACs, o.MACs),
+		HostKeyAlgorithms: pick(p.HostKeyAlgorithms, o.HostKeyAlgorithms),
+	}
+}
+
+func (p CryptoPolicy) IsEmpty() bool {
+	return len(p.KeyExchanges) == 0 && len(p.Ciphers) == 0 && len(p.MACs) == 0 && len(p.HostKeyAlgorithms) == 0
+}
+
+func (p CryptoPolicy) Equal(p2 CryptoPolicy) bool {
+	return slices.Equal(p.KeyExchanges, p2.KeyExchanges) &&
+		slices.Equal(p.Ciphers, p2.Ciphers) &&
+		slices.Equal(p.MACs, p2.MACs) &&
+		slices.Equal(p.HostKeyAlgorithms, p2.HostKeyAlgorithms)
+}
+
+func (p CryptoPolicy) String() string {
+	return fmt.Sprintf("kex=%s ciphers=%s macs=%s hostkeys=%s",
+		strings.Join(p.KeyExchanges, ","),
+		strings.Join(p.Ciphers, ","),
+		strings.Join(p.MACs, ","),
+		strings.Join(p.HostKeyAlgorithms, ","),
+	)
+}
+
+// config returns the golang.org/x/crypto/ssh config for the key exchanges, ciphers, and MACs in the policy
+func (p CryptoPolicy) config() gossh.Config {
+	return gossh.Config{
+		KeyExchanges: p.KeyExchanges,
+		Ciphers:      p.Ciphers,
+		MACs:         p.MACs,
+	}
+}
+
+// hostSigners restricts a server's host keys to the policy's host key algorithms.
+//
+//	The server config has no list of host key algorithms; instead, the algorithms are those of its host keys.
+func (p CryptoPolicy) hostSigners(signers []gossh.Signer) ([]gossh.Signer, error) {
+	if len(p.HostKeyAlgorithms) == 0 {
+		return signers, nil
+	}
+
+	var allowed []gossh.Signer
+	for _, signer := range signers {
+		keyType := signer.PublicKey().Type()
+
+		// RSA keys can sign with several algorithms, so restrict the signer to the allowed ones
+		if keyType == gossh.KeyAlgoRSA {
+			var algorithms []string
+			for _, algorithm := range []string{gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSA} {
+				if slices.Contains(p.HostKeyAlgorithms, algorithm) {
+					algorithms = append(algorithms, algorithm)
+				}
+			}
+			algorithmSigner, ok := signer.(gossh.AlgorithmSigner)
+			if len(algorithms) == 0 || !ok {
+				continue
+			}
+			restricted, err := gossh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+			if err != nil {
+				return nil, errors.Wrap(err, "restrict RSA host key algorithms")
+			}
+			allowed = append(allowed, restricted)
+			continue
+		}
+
+		if slices.Contains(p.HostKeyAlgorithms, keyType) {
+			allowed = append(allowed, signer)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, errors.New("no host keys are allowed by the crypto policy")
+	}
+	return allowed, nil
+}
+
+func sqlFromCryptoPolicy(policy CryptoPolicy) postgres.CryptoPolicy {
+	return postgres.CryptoPolicy(policy)
+}
+
+func cryptoPolicyFromSQL(record postgres.CryptoPolicy) CryptoPolicy {
+	return CryptoPolicy(record)
+}
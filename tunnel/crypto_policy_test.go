@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"testing"
+)
+
+// withServerCryptoPolicy restricts a test SSH server's key exchanges, ciphers, and MACs
+func withServerCryptoPolicy(policy CryptoPolicy) ssh.Option {
+	return func(server *ssh.Server) error {
+		server.ServerConfigCallback = func(ctx ssh.Context) *gossh.ServerConfig {
+			return &gossh.ServerConfig{Config: policy.config()}
+		}
+		return nil
+	}
+}
+
+func TestNewSSHClient_CryptoPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A legacy bastion that only speaks CBC and SHA-1
+	host, port := startTestSSHServer(t, withServerCryptoPolicy(CryptoPolicy{
+		Ciphers: []string{"aes128-cbc"},
+		MACs:    []string{"hmac-sha1"},
+	}))
+
+	t.Run("default policy", func(t *testing.T) {
+		_, _, err := NewSSHClient(ctx, testClientOptions(t, host, port))
+		assert.Error(t, err)
+	})
+
+	t.Run("legacy policy", func(t *testing.T) {
+		var handshake SSHHandshake
+		options := testClientOptions(t, host, port)
+		options.CryptoPolicy = CryptoPolicy{
+			Ciphers: []string{"aes128-ctr", "aes128-cbc"},
+			MACs:    []string{"hmac-sha2-256", "hmac-sha1"},
+		}
+		options.OnHandshake = func(h SSHHandshake) {
+			handshake = h
+		}
+
+		client, _, err := NewSSHClient(ctx, options)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer client.Close()
+
+		assert.Equal(t, "aes128-cbc", handshake.CipherClientToServer)
+		assert.Equal(t, "hmac-sha1", handshake.MACServerToClient)
+	})
+}
+
+func TestCryptoPolicy_Override(t *testing.T) {
+	global := CryptoPolicy{
+		Ciphers: []string{"aes256-gcm@openssh.com"},
+		MACs:    []string{"hmac-sha2-512-etm@openssh.com"},
+	}
+	policy := global.override(CryptoPolicy{MACs: []string{"hmac-sha1"}})
+
+	assert.Equal(t, []string{"aes256-gcm@openssh.com"}, policy.Ciphers)
+	assert.Equal(t, []string{"hmac-sha1"}, policy.MACs)
+	assert.Empty(t, policy.KeyExchanges)
+}
+
+func TestValidateCryptoPolicy(t *testing.T) {
+	assert.NoError(t, ValidateCryptoPolicy(CryptoPolicy{}))
+	assert.NoError(t, ValidateCryptoPolicy(CryptoPolicy{
+		KeyExchanges:      []string{"diffie-hellman-group1-sha1"},
+		Ciphers:           []string{"3des-cbc"},
+		MACs:              []string{"hmac-sha1-96"},
+		HostKeyAlgorithms: []string{gossh.KeyAlgoRSA},
+	}))
+	assert.Error(t, ValidateCryptoPolicy(CryptoPolicy{Ciphers: []string{"blowfish-cbc"}}))
+	assert.Error(t, ValidateCryptoPolicy(CryptoPolicy{MACs: []string{"hmac-md5"}}))
+
+	// The SSH server doesn't implement group exchange
+	policy := CryptoPolicy{KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}}
+	assert.NoError(t, ValidateCryptoPolicy(policy))
+	assert.Error(t, ValidateServerCryptoPolicy(policy))
+}
+
+func TestCryptoPolicy_HostSigners(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner, err := gossh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Signer := newTestSigner(t)
+	signers := []gossh.Signer{rsaSigner, ed25519Signer}
+
+	// Banning SHA-1 restricts RSA host keys to SHA-2 signatures, and drops keys of other types
+	allowed, err := CryptoPolicy{HostKeyAlgorithms: []string{gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512}}.hostSigners(signers)
+	if !assert.NoError(t, err) || !assert.Len(t, allowed, 1) {
+		return
+	}
+	multiAlgorithmSigner, ok := allowed[0].(gossh.MultiAlgorithmSigner)
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512}, multiAlgorithmSigner.Algorithms())
+	}
+
+	// An empty policy allows every host key
+	allowed, err = CryptoPolicy{}.hostSigners(signers)
+	assert.NoError(t, err)
+	assert.Len(t, allowed, 2)
+
+	// A policy that allows none of the host keys is an error
+	_, err = CryptoPolicy{HostKeyAlgorithms: []string{gossh.KeyAlgoECDSA256}}.hostSigners(signers)
+	assert.Error(t, err)
+}
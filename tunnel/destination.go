@@ -0,0 +1,179 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// AllowedDestination is a host, and the ports on it, that a dynamic tunnel may connect to
+type AllowedDestination struct {
+	// Host is an IP address, a CIDR block such as 10.0.0.0/8, a hostname, or a wildcard hostname such as *.internal.
+	//	Hostnames are resolved by the bastion, so CIDR blocks only match destinations requested by IP address.
+	Host string `json:"host"`
+
+	// Ports are ports or port ranges such as 5432 or 8000-8999. If empty, every port is allowed.
+	Ports []string `json:"ports,omitempty"`
+}
+
+// destinationAllowlist decides whether a dynamic tunnel may connect to a destination
+type destinationAllowlist []destinationRule
+
+type destinationRule struct {
+	// name is the allowed destination that the rule was created from, such as *.internal:5432
+	name string
+
+	prefix   netip.Prefix
+	hostname string
+	wildcard bool
+	ports    []portRange
+}
+
+type portRange struct {
+	from, to int
+}
+
+func newDestinationAllowlist(destinations []AllowedDestination) (destinationAllowlist, error) {
+	allowlist := make(destinationAllowlist, len(destinations))
+	for i, destination := range destinations {
+		rule, err := newDestinationRule(destination)
+		if err != nil {
+			return nil, errors.Wrapf(err, "allowedDestinations[%d]", i)
+		}
+		allowlist[i] = rule
+	}
+	return allowlist, nil
+}
+
+func newDestinationRule(destination AllowedDestination) (destinationRule, error) {
+	rule := destinationRule{name: destination.Host}
+	if len(destination.Ports) > 0 {
+		rule.name = fmt.Sprintf("%s:%s", destination.Host, strings.Join(destination.Ports, ","))
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(destination.Host, "."))
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		rule.prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(host); err == nil {
+		rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else if strings.HasPrefix(host, "*.") && isHostname(host[2:]) {
+		rule.hostname = host[2:]
+		rule.wildcard = true
+	} else if isHostname(host) {
+		rule.hostname = host
+	} else {
+		return destinationRule{}, fmt.Errorf("host %q must be an IP address, CIDR block, or hostname", destination.Host)
+	}
+
+	for _, ports := range destination.Ports {
+		portRange, err := parsePortRange(ports)
+		if err != nil {
+			return destinationRule{}, err
+		}
+		rule.ports = append(rule.ports, portRange)
+	}
+
+	return rule, nil
+}
+
+// parsePortRange parses a single port such as 5432, or an inclusive range such as 8000-8999
+func parsePortRange(ports string) (portRange, error) {
+	from, to, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		to = from
+	}
+
+	fromPort, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil || fromPort < 1 || fromPort > 65535 {
+		return portRange{}, fmt.Errorf("invalid port %q", ports)
+	}
+	toPort, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || toPort < fromPort || toPort > 65535 {
+		return portRange{}, fmt.Errorf("invalid port range %q", ports)
+	}
+
+	return portRange{from: fromPort, to: toPort}, nil
+}
+
+func isHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// allows reports whether any rule allows connecting to the host and port
+func (a destinationAllowlist) allows(host string, port int) bool {
+	_, ok := a.match(host, port)
+	return ok
+}
+
+// match returns the first rule that allows connecting to the host and port
+func (a destinationAllowlist) match(host string, port int) (destinationRule, bool) {
+	for _, rule := range a {
+		if rule.allows(host, port) {
+			return rule, true
+		}
+	}
+	return destinationRule{}, false
+}
+
+func (r destinationRule) allows(host string, port int) bool {
+	if !r.allowsPort(port) {
+		return false
+	}
+
+	// IP address destinations only match IP rules, and hostname destinations only match hostname rules
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return r.prefix.IsValid() && r.prefix.Contains(addr.Unmap())
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case r.hostname == "":
+		return false
+	case r.wildcard:
+		return strings.HasSuffix(host, "."+r.hostname)
+	default:
+		return host == r.hostname
+	}
+}
+
+func (r destinationRule) allowsPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, ports := range r.ports {
+		if port >= ports.from && port <= ports.to {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAllowedDestinations validates that a dynamic tunnel has an allowlist, and that every entry can be parsed
+func validateAllowedDestinations(destinations []AllowedDestination) error {
+	if len(destinations) == 0 {
+		return errors.New("allowedDestinations is required for dynamic tunnels")
+	}
+	_, err := newDestinationAllowlist(destinations)
+	return err
+}
+
+// destinationString formats a SOCKS destination for logs and stat tags
+func destinationString(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
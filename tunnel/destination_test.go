@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDestinationAllowlist(t *testing.T) {
+	allowlist, err := newDestinationAllowlist([]AllowedDestination{
+		{Host: "10.0.0.0/16", Ports: []string{"5432", "8000-8999"}},
+		{Host: "192.168.1.10"},
+		{Host: "db.internal", Ports: []string{"5432"}},
+		{Host: "*.svc.internal", Ports: []string{"443"}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"10.0.4.2", 5432, true},
+		{"10.0.4.2", 8443, true},
+		{"10.0.4.2", 22, false},
+		{"10.1.0.1", 5432, false},
+		{"192.168.1.10", 22, true},
+		{"192.168.1.11", 22, false},
+		{"db.internal", 5432, true},
+		{"DB.internal.", 5432, true},
+		{"db.internal", 5433, false},
+		{"replica.db.internal", 5432, false},
+		{"api.svc.internal", 443, true},
+		{"svc.internal", 443, false},
+		{"api.svc.internal.evil.com", 443, false},
+
+		// Hostnames are resolved by the bastion, so they never match CIDR rules
+		{"10.0.4.2.nip.io", 5432, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, allowlist.allows(test.host, test.port), "%s:%d", test.host, test.port)
+	}
+
+	// Destinations are identified by the rule that they matched
+	rule, ok := allowlist.match("10.0.4.2", 8443)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.0/16:5432,8000-8999", rule.name)
+	rule, ok = allowlist.match("192.168.1.10", 22)
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.1.10", rule.name)
+}
+
+func TestValidateAllowedDestinations(t *testing.T) {
+	assert.NoError(t, validateAllowedDestinations([]AllowedDestination{{Host: "fd00::/8"}, {Host: "*.internal", Ports: []string{"1-1024"}}}))
+
+	assert.Error(t, validateAllowedDestinations(nil))
+	assert.Error(t, validateAllowedDestinations([]AllowedDestination{{Host: ""}}))
+	assert.Error(t, validateAllowedDestinations([]AllowedDestination{{Host: "db internal"}}))
+	assert.Error(t, validateAllowedDestinations([]AllowedDestination{{Host: "10.0.0.0/33"}}))
+	assert.Error(t, validateAllowedDestinations([]AllowedDestination{{Host: "db.internal", Ports: []string{"0"}}}))
+	assert.Error(t, validateAllowedDestinations([]AllowedDestination{{Host: "db.internal", Ports: []string{"9000-8000"}}}))
+	assert.Error(t, validateAllowedDestinations([]AllowedDestination{{Host: "db.internal", Ports: []string{"65536"}}}))
+}
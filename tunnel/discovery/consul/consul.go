@@ -95,16 +95,74 @@ func (d Discovery) GetTunnel(id uuid.UUID) (discovery.TunnelDetails, error) {
 		return discovery.TunnelDetails{}, fmt.Errorf("tunnel %s not found", id.String())
 	}
 
+	return selectTunnelDetails(id, services), nil
+}
+
+// RegisterTunnelService registers an additional named service for a tunnel, tagged with the tunnel ID
+func (d Discovery) RegisterTunnelService(id uuid.UUID, name string, port int) error {
+	d.Log.With(
+		zap.String("tunnel_id", id.String()),
+		zap.String("service", name),
+	).Debugf("Register tunnel %s service %s", id.String(), name)
+
+	serviceId := getTunnelNamedServiceId(id, name)
+	err := d.Consul.Agent().ServiceRegister(&consul.AgentServiceRegistration{
+		ID:   serviceId,
+		Name: serviceId,
+
+		Kind:    consul.ServiceKindTypical,
+		Address: d.HostAddress,
+		Port:    port,
+		Tags: []string{
+			fmt.Sprintf("tunnel_id:%s", id.String()),
+			fmt.Sprintf("service:%s", name),
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not register tunnel %s service %s", id.String(), name)
+	}
+
+	return nil
+}
+
+func (d Discovery) DeregisterTunnelService(id uuid.UUID, name string) error {
+	d.Log.With(
+		zap.String("tunnel_id", id.String()),
+		zap.String("service", name),
+	).Debugf("Deregister tunnel %s service %s", id.String(), name)
+
+	if err := d.Consul.Agent().ServiceDeregister(getTunnelNamedServiceId(id, name)); err != nil {
+		return errors.Wrapf(err, "could not deregister tunnel %s service %s", id.String(), name)
+	}
+	return nil
+}
+
+func (d Discovery) GetTunnelService(id uuid.UUID, name string) (discovery.TunnelDetails, error) {
+	services, _, err := d.Consul.Health().Service(getTunnelNamedServiceId(id, name), "", false, nil)
+	if err != nil {
+		return discovery.TunnelDetails{}, errors.Wrap(err, "could not get tunnel service details")
+	}
+
+	if len(services) == 0 {
+		return discovery.TunnelDetails{}, fmt.Errorf("tunnel %s service %s not found", id.String(), name)
+	}
+
+	return selectTunnelDetails(id, services), nil
+}
+
+// selectTunnelDetails picks the best instance of a tunnel service
+func selectTunnelDetails(id uuid.UUID, services []*consul.ServiceEntry) discovery.TunnelDetails {
+
 	// Search for a healthy tunnel service instance and return it
 	for _, service := range services {
 		if service.Checks.AggregatedStatus() != consul.HealthPassing {
 			continue
 		}
-		return formatTunnelDetails(id, service), nil
+		return formatTunnelDetails(id, service)
 	}
 
 	// If there are no healthy tunnel service instances, return the first
-	return formatTunnelDetails(id, services[0]), nil
+	return formatTunnelDetails(id, services[0])
 }
 
 func formatTunnelDetails(tunnelId uuid.UUID, service *consul.ServiceEntry) discovery.TunnelDetails {
@@ -194,6 +252,10 @@ func getTunnelServiceId(id uuid.UUID) string {
 	return fmt.Sprintf("tunnel-%s", id.String())
 }
 
+func getTunnelNamedServiceId(id uuid.UUID, name string) string {
+	return fmt.Sprintf("%s-service-%s", getTunnelServiceId(id), name)
+}
+
 func getTunnelHealthcheckId(id uuid.UUID, checkId string) string {
 	return fmt.Sprintf("%s-%s", getTunnelServiceId(id), checkId)
 }
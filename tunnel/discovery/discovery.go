@@ -14,6 +14,11 @@ type Service interface {
 	DeregisterTunnel(id uuid.UUID) error
 	GetTunnel(id uuid.UUID) (TunnelDetails, error)
 
+	// Tunnels may serve additional named services, each on its own port
+	RegisterTunnelService(id uuid.UUID, name string, port int) error
+	DeregisterTunnelService(id uuid.UUID, name string) error
+	GetTunnelService(id uuid.UUID, name string) (TunnelDetails, error)
+
 	RegisterHealthcheck(tunnelId uuid.UUID, options HealthcheckOptions) error
 	DeregisterHealthcheck(tunnelId uuid.UUID, id string) error
 	UpdateHealthcheck(tunnelId uuid.UUID, id string, status HealthcheckStatus, message string) error
@@ -38,3 +38,15 @@ func (d Discovery) DeregisterTunnel(id uuid.UUID) error {
 func (d Discovery) GetTunnel(id uuid.UUID) (discovery.TunnelDetails, error) {
 	return discovery.TunnelDetails{}, nil
 }
+
+func (d Discovery) RegisterTunnelService(id uuid.UUID, name string, port int) error {
+	return nil
+}
+
+func (d Discovery) DeregisterTunnelService(id uuid.UUID, name string) error {
+	return nil
+}
+
+func (d Discovery) GetTunnelService(id uuid.UUID, name string) (discovery.TunnelDetails, error) {
+	return discovery.TunnelDetails{}, nil
+}
@@ -1,6 +1,9 @@
 package tunnel
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type requestErrors struct {
 	errors []error
@@ -25,3 +28,16 @@ func (e *requestErrors) Error() string {
 
 	return e.errors[0].Error()
 }
+
+// newRequestError creates an error for an invalid request, which the API reports as a bad request
+func newRequestError(m string, args ...interface{}) error {
+	re := newRequestErrors()
+	re.addError(m, args...)
+	return re
+}
+
+// isRequestError reports whether an error is caused by an invalid request
+func isRequestError(err error) bool {
+	var re *requestErrors
+	return errors.As(err, &re)
+}
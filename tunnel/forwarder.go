@@ -217,27 +217,28 @@ func NewCountedReadWriteCloser(rwc io.ReadWriteCloser) *CountedReadWriteCloser {
 type CountedReadWriteCloser struct {
 	io.ReadWriteCloser
 
-	bytesWritten uint64
-	bytesRead    uint64
+	// The counts are read by the stats producer while the pipeline is reading and writing
+	bytesWritten atomic.Uint64
+	bytesRead    atomic.Uint64
 }
 
 func (c *CountedReadWriteCloser) Read(p []byte) (n int, err error) {
 	bytesRead, err := c.ReadWriteCloser.Read(p)
-	c.bytesRead += uint64(bytesRead)
+	c.bytesRead.Add(uint64(bytesRead))
 	return bytesRead, err
 }
 
 func (c *CountedReadWriteCloser) Write(p []byte) (n int, err error) {
-	c.bytesWritten += uint64(len(p))
+	c.bytesWritten.Add(uint64(len(p)))
 	return c.ReadWriteCloser.Write(p)
 }
 
 func (c *CountedReadWriteCloser) GetBytesWritten() uint64 {
-	return c.bytesWritten
+	return c.bytesWritten.Load()
 }
 
 func (c *CountedReadWriteCloser) GetBytesRead() uint64 {
-	return c.bytesRead
+	return c.bytesRead.Load()
 }
 
 type forwarderStats interface {
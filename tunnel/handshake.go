@@ -0,0 +1,291 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/tunnel/postgres"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SSHHandshake describes how an SSH connection was negotiated, so that connection failures can be diagnosed without
+// access to the host that made them
+type SSHHandshake struct {
+	// Host is the address of the remote SSH peer
+	Host string `json:"host"`
+
+	ClientVersion string `json:"clientVersion,omitempty"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+
+	KeyExchange          string `json:"keyExchange,omitempty"`
+	HostKeyAlgorithm     string `json:"hostKeyAlgorithm,omitempty"`
+	CipherClientToServer string `json:"cipherClientToServer,omitempty"`
+	CipherServerToClient string `json:"cipherServerToClient,omitempty"`
+	MACClientToServer    string `json:"macClientToServer,omitempty"`
+	MACServerToClient    string `json:"macServerToClient,omitempty"`
+
+	// HostKeyFingerprint is the SHA256 fingerprint of the host key that the server presented
+	HostKeyFingerprint string `json:"hostKeyFingerprint,omitempty"`
+
+	// ClientKeyFingerprint is the SHA256 fingerprint of the key that the client authenticated with, for reverse tunnels
+	ClientKeyFingerprint string `json:"clientKeyFingerprint,omitempty"`
+
+	// AuthMethod is the authentication method that succeeded, or that was last attempted if the handshake failed
+	AuthMethod string `json:"authMethod,omitempty"`
+
+	// Error is why the handshake failed, if it did
+	Error string `json:"error,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// macImplicit is reported as the MAC for AEAD ciphers, which authenticate without a separate MAC
+const macImplicit = "implicit"
+
+// aeadCiphers are the ciphers supported by golang.org/x/crypto/ssh that don't negotiate a MAC
+var aeadCiphers = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"}
+
+// maxKexInitSize bounds how much of the connection is buffered while looking for the key exchange
+const maxKexInitSize = 64 * 1024
+
+// sshMsgKexInit is the message number of SSH_MSG_KEXINIT, from RFC 4253
+const sshMsgKexInit = 20
+
+// handshakeRecorder wraps a net.Conn and records the version and SSH_MSG_KEXINIT sent in each direction.
+//
+//	golang.org/x/crypto/ssh doesn't expose the algorithms it negotiates, but the first key exchange is sent in the clear,
+//	so the negotiation can be repeated from what each side offered.
+type handshakeRecorder struct {
+	net.Conn
+
+	read, written kexInitParser
+	lock          sync.Mutex
+
+	// readDone and writtenDone are set once each direction's parser is done, so that the rest of the connection's
+	//	reads and writes bypass the recorder
+	readDone, writtenDone atomic.Bool
+}
+
+func newHandshakeRecorder(conn net.Conn) *handshakeRecorder {
+	return &handshakeRecorder{Conn: conn}
+}
+
+func (c *handshakeRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.readDone.Load() {
+		c.lock.Lock()
+		c.read.feed(b[:n])
+		c.readDone.Store(c.read.done)
+		c.lock.Unlock()
+	}
+	return n, err
+}
+
+func (c *handshakeRecorder) Write(b []byte) (int, error) {
+	if !c.writtenDone.Load() {
+		c.lock.Lock()
+		c.written.feed(b)
+		c.writtenDone.Store(c.written.done)
+		c.lock.Unlock()
+	}
+	return c.Conn.Write(b)
+}
+
+// describe fills in the versions and negotiated algorithms. isClient is whether this end of the connection is the client.
+func (c *handshakeRecorder) describe(handshake *SSHHandshake, isClient bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client, server := &c.written, &c.read
+	if !isClient {
+		client, server = server, client
+	}
+	handshake.ClientVersion = client.version
+	handshake.ServerVersion = server.version
+
+	clientInit, ok := parseKexInit(client.payload)
+	if !ok {
+		return
+	}
+	serverInit, ok := parseKexInit(server.payload)
+	if !ok {
+		return
+	}
+
+	handshake.KeyExchange = negotiateAlgorithm(clientInit.kex, serverInit.kex)
+	handshake.HostKeyAlgorithm = negotiateAlgorithm(clientInit.hostKey, serverInit.hostKey)
+	handshake.CipherClientToServer = negotiateAlgorithm(clientInit.cipherClientToServer, serverInit.cipherClientToServer)
+	handshake.CipherServerToClient = negotiateAlgorithm(clientInit.cipherServerToClient, serverInit.cipherServerToClient)
+	handshake.MACClientToServer = negotiateMAC(handshake.CipherClientToServer, clientInit.macClientToServer, serverInit.macClientToServer)
+	handshake.MACServerToClient = negotiateMAC(handshake.CipherServerToClient, clientInit.macServerToClient, serverInit.macServerToClient)
+}
+
+// kexInitParser reads the version line, then the first binary packet, from one direction of a connection
+type kexInitParser struct {
+	buf     []byte
+	version string
+	payload []byte
+	done    bool
+}
+
+func (p *kexInitParser) feed(b []byte) {
+	if p.done || len(b) == 0 {
+		return
+	}
+	p.buf = append(p.buf, b...)
+	if len(p.buf) > maxKexInitSize {
+		p.stop()
+		return
+	}
+
+	// The server may send other lines of text before its version
+	for p.version == "" {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimRight(string(p.buf[:i]), "\r")
+		p.buf = p.buf[i+1:]
+		if strings.HasPrefix(line, "SSH-") {
+			p.version = line
+		}
+	}
+
+	// Binary packet: uint32 packet_length, byte padding_length, payload, padding. The first packet is unencrypted.
+	if len(p.buf) < 5 {
+		return
+	}
+	length := int(binary.BigEndian.Uint32(p.buf))
+	if length > maxKexInitSize {
+		p.stop()
+		return
+	}
+	if len(p.buf) < 4+length {
+		return
+	}
+	padding := int(p.buf[4])
+	if padding+1 >= length {
+		p.stop()
+		return
+	}
+	if payload := p.buf[5 : 4+length-padding]; payload[0] == sshMsgKexInit {
+		p.payload = bytes.Clone(payload)
+	}
+	p.stop()
+}
+
+func (p *kexInitParser) stop() {
+	p.done = true
+	p.buf = nil
+}
+
+// kexInit is the algorithm name-lists from an SSH_MSG_KEXINIT
+type kexInit struct {
+	kex, hostKey                               []string
+	cipherClientToServer, cipherServerToClient []string
+	macClientToServer, macServerToClient       []string
+}
+
+func parseKexInit(payload []byte) (kexInit, bool) {
+	// byte SSH_MSG_KEXINIT, byte[16] cookie, then name-lists
+	if len(payload) < 17 {
+		return kexInit{}, false
+	}
+	rest := payload[17:]
+
+	lists := make([][]string, 6)
+	for i := range lists {
+		if len(rest) < 4 {
+			return kexInit{}, false
+		}
+		length := int(binary.BigEndian.Uint32(rest))
+		if len(rest) < 4+length {
+			return kexInit{}, false
+		}
+		if length > 0 {
+			lists[i] = strings.Split(string(rest[4:4+length]), ",")
+		}
+		rest = rest[4+length:]
+	}
+
+	return kexInit{
+		kex:                  lists[0],
+		hostKey:              lists[1],
+		cipherClientToServer: lists[2],
+		cipherServerToClient: lists[3],
+		macClientToServer:    lists[4],
+		macServerToClient:    lists[5],
+	}, true
+}
+
+// negotiateAlgorithm chooses the first of the client's algorithms that the server supports, as in RFC 4253
+func negotiateAlgorithm(client, server []string) string {
+	for _, algorithm := range client {
+		for _, supported := range server {
+			if algorithm == supported {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+func negotiateMAC(cipher string, client, server []string) string {
+	for _, aead := range aeadCiphers {
+		if cipher == aead {
+			return macImplicit
+		}
+	}
+	return negotiateAlgorithm(client, server)
+}
+
+// recordHostKey wraps a HostKeyCallback to record the presented host key, whether or not it is trusted
+func recordHostKey(handshake *SSHHandshake, callback gossh.HostKeyCallback) gossh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		handshake.HostKeyFingerprint = gossh.FingerprintSHA256(key)
+		return callback(hostname, remote, key)
+	}
+}
+
+func sqlFromHandshake(tunnelID uuid.UUID, handshake SSHHandshake) postgres.Handshake {
+	return postgres.Handshake{
+		TunnelID:             tunnelID,
+		Host:                 handshake.Host,
+		ClientVersion:        handshake.ClientVersion,
+		ServerVersion:        handshake.ServerVersion,
+		KeyExchange:          handshake.KeyExchange,
+		HostKeyAlgorithm:     handshake.HostKeyAlgorithm,
+		CipherClientToServer: handshake.CipherClientToServer,
+		CipherServerToClient: handshake.CipherServerToClient,
+		MACClientToServer:    handshake.MACClientToServer,
+		MACServerToClient:    handshake.MACServerToClient,
+		HostKeyFingerprint:   handshake.HostKeyFingerprint,
+		ClientKeyFingerprint: handshake.ClientKeyFingerprint,
+		AuthMethod:           handshake.AuthMethod,
+		Error:                handshake.Error,
+	}
+}
+
+func handshakeFromSQL(record postgres.Handshake) SSHHandshake {
+	return SSHHandshake{
+		Host:                 record.Host,
+		ClientVersion:        record.ClientVersion,
+		ServerVersion:        record.ServerVersion,
+		KeyExchange:          record.KeyExchange,
+		HostKeyAlgorithm:     record.HostKeyAlgorithm,
+		CipherClientToServer: record.CipherClientToServer,
+		CipherServerToClient: record.CipherServerToClient,
+		MACClientToServer:    record.MACClientToServer,
+		MACServerToClient:    record.MACServerToClient,
+		HostKeyFingerprint:   record.HostKeyFingerprint,
+		ClientKeyFingerprint: record.ClientKeyFingerprint,
+		AuthMethod:           record.AuthMethod,
+		Error:                record.Error,
+		Time:                 record.UpdatedAt,
+	}
+}
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestNewSSHClient_Handshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host, port := startTestSSHServer(t)
+
+	var lock sync.Mutex
+	var handshakes []SSHHandshake
+	options := testClientOptions(t, host, port)
+	options.OnHandshake = func(handshake SSHHandshake) {
+		lock.Lock()
+		defer lock.Unlock()
+		handshakes = append(handshakes, handshake)
+	}
+
+	client, _, err := NewSSHClient(ctx, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !assert.Len(t, handshakes, 1) {
+		return
+	}
+	handshake := handshakes[0]
+	assert.Equal(t, net.JoinHostPort(host, strconv.Itoa(port)), handshake.Host)
+	assert.Equal(t, string(client.ClientVersion()), handshake.ClientVersion)
+	assert.Equal(t, string(client.ServerVersion()), handshake.ServerVersion)
+	assert.NotEmpty(t, handshake.KeyExchange)
+	assert.Equal(t, gossh.KeyAlgoED25519, handshake.HostKeyAlgorithm)
+	assert.NotEmpty(t, handshake.CipherClientToServer)
+	assert.NotEmpty(t, handshake.CipherServerToClient)
+	assert.NotEmpty(t, handshake.MACClientToServer)
+	assert.NotEmpty(t, handshake.HostKeyFingerprint)
+	assert.Equal(t, "publickey", handshake.AuthMethod)
+	assert.Empty(t, handshake.Error)
+}
+
+func TestNewSSHClient_HandshakeFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host, port := startTestSSHServer(t)
+
+	var lock sync.Mutex
+	var handshakes []SSHHandshake
+	options := testClientOptions(t, host, port)
+	options.HostKeyCallback = func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		return errors.New("untrusted host key")
+	}
+	options.OnHandshake = func(handshake SSHHandshake) {
+		lock.Lock()
+		defer lock.Unlock()
+		handshakes = append(handshakes, handshake)
+	}
+
+	_, _, err := NewSSHClient(ctx, options)
+	assert.Error(t, err)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !assert.Len(t, handshakes, 1) {
+		return
+	}
+
+	// The algorithms and host key are known even though the host key was rejected
+	handshake := handshakes[0]
+	assert.NotEmpty(t, handshake.KeyExchange)
+	assert.NotEmpty(t, handshake.HostKeyFingerprint)
+	assert.Contains(t, handshake.Error, "untrusted host key")
+}
+
+func TestNegotiateMAC(t *testing.T) {
+	assert.Equal(t, macImplicit, negotiateMAC("chacha20-poly1305@openssh.com", []string{"hmac-sha2-256"}, []string{"hmac-sha2-256"}))
+	assert.Equal(t, "hmac-sha2-512", negotiateMAC("aes128-ctr", []string{"hmac-sha2-512", "hmac-sha2-256"}, []string{"hmac-sha2-256", "hmac-sha2-512"}))
+	assert.Equal(t, "", negotiateMAC("aes128-ctr", []string{"hmac-sha1"}, []string{"hmac-sha2-256"}))
+}
+
+func TestHandshakeRecorder_Bypass(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	recorder := newHandshakeRecorder(server)
+
+	// A version line, then a KEXINIT packet with a cookie and empty name-lists
+	payload := append([]byte{sshMsgKexInit}, make([]byte, 16+6*4)...)
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+4))
+	packet = append(append(append(packet, 4), payload...), make([]byte, 4)...)
+	go func() {
+		_, _ = client.Write([]byte("SSH-2.0-test\r\n"))
+		_, _ = client.Write(packet)
+		_, _ = client.Write([]byte("after the key exchange"))
+	}()
+
+	buf := make([]byte, 1024)
+	for !recorder.readDone.Load() {
+		_, err := recorder.Read(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	assert.Equal(t, "SSH-2.0-test", recorder.read.version)
+	assert.NotNil(t, recorder.read.payload)
+
+	// Once the key exchange has been parsed, nothing more is buffered
+	n, err := recorder.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "after the key exchange", string(buf[:n]))
+	assert.Nil(t, recorder.read.buf)
+}
@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"path"
+	"strings"
+)
+
+// Host key verification modes for normal tunnels
+const (
+	// HostKeyVerificationTOFU trusts the first host key presented by a bastion and records it as a known host
+	HostKeyVerificationTOFU = "tofu"
+
+	// HostKeyVerificationStrict only trusts host keys that have been explicitly configured as known hosts
+	HostKeyVerificationStrict = "strict"
+)
+
+const (
+	knownHostMarkerCertAuthority = "cert-authority"
+	knownHostMarkerRevoked       = "revoked"
+)
+
+// HostKeyMismatchError is returned when a bastion presents a host key that does not match any of its known hosts
+type HostKeyMismatchError struct {
+	Host        string
+	Fingerprint string
+}
+
+func (e HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: bastion presented %s", e.Host, e.Fingerprint)
+}
+
+// knownHost is a parsed known_hosts entry
+type knownHost struct {
+	Marker string
+	Hosts  []string
+	Key    gossh.PublicKey
+}
+
+// parseKnownHost parses a single line in OpenSSH known_hosts format
+func parseKnownHost(entry string) (knownHost, error) {
+	marker, hosts, key, _, _, err := gossh.ParseKnownHosts([]byte(entry))
+	if err != nil {
+		return knownHost{}, errors.Wrap(err, "parse known host")
+	}
+
+	return knownHost{Marker: marker, Hosts: hosts, Key: key}, nil
+}
+
+// validateHostKeyVerification validates a host key verification mode. An empty mode selects the default.
+func validateHostKeyVerification(verification string) error {
+	switch verification {
+	case "", HostKeyVerificationTOFU, HostKeyVerificationStrict:
+		return nil
+	default:
+		return fmt.Errorf("invalid hostKeyVerification %q", verification)
+	}
+}
+
+// validateKnownHosts validates that every entry is a single, parseable known_hosts line
+func validateKnownHosts(entries []string) error {
+	for _, entry := range entries {
+		if strings.ContainsAny(entry, "\r\n") {
+			return newRequestError("known host %q must be a single line", entry)
+		}
+		knownHost, err := parseKnownHost(entry)
+		if err != nil {
+			return newRequestError("invalid known host %q", entry)
+		}
+		for _, pattern := range knownHost.Hosts {
+			if !strings.HasPrefix(pattern, knownHostHashPrefix) {
+				continue
+			}
+			if _, _, err := parseHashedKnownHost(pattern); err != nil {
+				return newRequestError("invalid known host %q: %s", entry, err)
+			}
+		}
+	}
+	return nil
+}
+
+// formatKnownHost formats a host and key as a known_hosts line
+func formatKnownHost(host string, key gossh.PublicKey) string {
+	return fmt.Sprintf("%s %s", host, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))))
+}
+
+// matches reports whether this entry applies to the given normalized host. As in OpenSSH, the entry doesn't apply if
+// the host matches a negated `!pattern`, even if it matches another pattern.
+func (k knownHost) matches(host string) bool {
+	matched := false
+	for _, pattern := range k.Hosts {
+		negated := strings.HasPrefix(pattern, "!")
+		if !matchKnownHostPattern(strings.TrimPrefix(pattern, "!"), host) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchKnownHostPattern matches a host against a wildcard pattern, or a hashed `|1|salt|hash` host
+func matchKnownHostPattern(pattern, host string) bool {
+	if strings.HasPrefix(pattern, knownHostHashPrefix) {
+		salt, hash, err := parseHashedKnownHost(pattern)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+
+	ok, _ := path.Match(knownHostPatternEscaper.Replace(pattern), host)
+	return ok
+}
+
+// knownHostHashPrefix begins the hosts of entries written with `ssh-keygen -H` or `ssh-keyscan -H`
+const knownHostHashPrefix = "|1|"
+
+// parseHashedKnownHost decodes the salt and HMAC-SHA1 of a hashed host
+func parseHashedKnownHost(pattern string) ([]byte, []byte, error) {
+	salt64, hash64, ok := strings.Cut(strings.TrimPrefix(pattern, knownHostHashPrefix), "|")
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid hashed host %q", pattern)
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid hashed host %q", pattern)
+	}
+	hash, err := base64.StdEncoding.DecodeString(hash64)
+	if err != nil || len(hash) != sha1.Size {
+		return nil, nil, fmt.Errorf("invalid hashed host %q", pattern)
+	}
+	return salt, hash, nil
+}
+
+// knownHostPatternEscaper escapes the brackets in `[host]:port` patterns, since known_hosts patterns only support the
+// `*` and `?` wildcards
+var knownHostPatternEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+
+// normalizeKnownHost formats a host:port address the way OpenSSH writes it to known_hosts
+func normalizeKnownHost(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// newHostKeyCallback creates a gossh.HostKeyCallback which verifies host keys against known_hosts entries.
+// If there are no known host keys for the bastion and the verification mode is TOFU, the presented key is passed to
+// recordKnownHost so it will be trusted on subsequent connections.
+func newHostKeyCallback(knownHosts []knownHost, verification string, recordKnownHost func(entry string) error) gossh.HostKeyCallback {
+	checker := &gossh.CertChecker{
+		// Host certificates are trusted if they are signed by a @cert-authority entry that matches the host
+		IsHostAuthority: func(auth gossh.PublicKey, address string) bool {
+			host := normalizeKnownHost(address)
+			for _, entry := range knownHosts {
+				if entry.Marker == knownHostMarkerCertAuthority && entry.matches(host) && keysEqual(entry.Key, auth) {
+					return true
+				}
+			}
+			return false
+		},
+
+		IsRevoked: func(cert *gossh.Certificate) bool {
+			return isRevokedHostKey(knownHosts, cert.SignatureKey) || isRevokedHostKey(knownHosts, cert.Key)
+		},
+
+		// Plain host keys are compared against the pinned keys for the host
+		HostKeyFallback: func(address string, remote net.Addr, key gossh.PublicKey) error {
+			host := normalizeKnownHost(address)
+			if isRevokedHostKey(knownHosts, key) {
+				return fmt.Errorf("host key for %s has been revoked", host)
+			}
+
+			var pinned int
+			for _, entry := range knownHosts {
+				if entry.Marker != "" || !entry.matches(host) {
+					continue
+				}
+				if keysEqual(entry.Key, key) {
+					return nil
+				}
+				pinned++
+			}
+
+			// The host has known keys, but none of them match
+			if pinned > 0 {
+				return HostKeyMismatchError{Host: host, Fingerprint: gossh.FingerprintSHA256(key)}
+			}
+
+			if verification != HostKeyVerificationTOFU {
+				return fmt.Errorf("no known host key for %s", host)
+			}
+
+			// Trust on first use
+			if err := recordKnownHost(formatKnownHost(host, key)); err != nil {
+				return errors.Wrap(err, "record known host")
+			}
+			return nil
+		},
+	}
+
+	return checker.CheckHostKey
+}
+
+func isRevokedHostKey(knownHosts []knownHost, key gossh.PublicKey) bool {
+	for _, entry := range knownHosts {
+		if entry.Marker == knownHostMarkerRevoked && keysEqual(entry.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func keysEqual(a, b gossh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
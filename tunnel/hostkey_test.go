@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+func newTestHostKey(t *testing.T) gossh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func parseTestKnownHosts(t *testing.T, entries ...string) []knownHost {
+	knownHosts := make([]knownHost, len(entries))
+	for i, entry := range entries {
+		var err error
+		if knownHosts[i], err = parseKnownHost(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return knownHosts
+}
+
+func TestHostKeyCallback_TrustOnFirstUse(t *testing.T) {
+	hostKey := newTestHostKey(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+
+	var recorded []string
+	callback := newHostKeyCallback(nil, HostKeyVerificationTOFU, func(entry string) error {
+		recorded = append(recorded, entry)
+		return nil
+	})
+
+	assert.NoError(t, callback("bastion.example.com:2222", remote, hostKey))
+	assert.Len(t, recorded, 1)
+
+	// The recorded entry should be trusted on subsequent connections
+	callback = newHostKeyCallback(parseTestKnownHosts(t, recorded...), HostKeyVerificationTOFU, func(entry string) error {
+		t.Fatal("should not record a known host key")
+		return nil
+	})
+	assert.NoError(t, callback("bastion.example.com:2222", remote, hostKey))
+}
+
+func TestHostKeyCallback_Mismatch(t *testing.T) {
+	pinnedKey := newTestHostKey(t).PublicKey()
+	presentedKey := newTestHostKey(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	knownHosts := parseTestKnownHosts(t, formatKnownHost("bastion.example.com", pinnedKey))
+	callback := newHostKeyCallback(knownHosts, HostKeyVerificationTOFU, func(entry string) error {
+		t.Fatal("should not record a host key for a host with a pinned key")
+		return nil
+	})
+
+	err := callback("bastion.example.com:22", remote, presentedKey)
+	assert.ErrorAs(t, err, &HostKeyMismatchError{})
+
+	// A pinned key for a different host should not be considered a mismatch
+	var recorded int
+	callback = newHostKeyCallback(knownHosts, HostKeyVerificationTOFU, func(entry string) error {
+		recorded++
+		return nil
+	})
+	assert.NoError(t, callback("other.example.com:22", remote, presentedKey))
+	assert.Equal(t, 1, recorded)
+}
+
+func TestHostKeyCallback_Strict(t *testing.T) {
+	hostKey := newTestHostKey(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	callback := newHostKeyCallback(nil, HostKeyVerificationStrict, func(entry string) error {
+		t.Fatal("should not record host keys in strict mode")
+		return nil
+	})
+	assert.Error(t, callback("bastion.example.com:22", remote, hostKey))
+}
+
+func TestHostKeyCallback_CertAuthority(t *testing.T) {
+	ca := newTestHostKey(t)
+	hostKey := newTestHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	cert := &gossh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        gossh.HostCert,
+		ValidPrincipals: []string{"bastion.example.com"},
+		ValidBefore:     gossh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	knownHosts := parseTestKnownHosts(t, "@cert-authority *.example.com "+string(gossh.MarshalAuthorizedKey(ca.PublicKey())))
+	callback := newHostKeyCallback(knownHosts, HostKeyVerificationStrict, func(entry string) error {
+		t.Fatal("should not record host keys in strict mode")
+		return nil
+	})
+
+	assert.NoError(t, callback("bastion.example.com:22", remote, cert))
+
+	// The certificate is not valid for other hosts
+	assert.Error(t, callback("other.example.com:22", remote, cert))
+}
+
+func TestKnownHost_Matches(t *testing.T) {
+	key := string(gossh.MarshalAuthorizedKey(newTestHostKey(t).PublicKey()))
+
+	// Negated patterns exclude hosts that other patterns match
+	entry := parseTestKnownHosts(t, "*.example.com,!untrusted.example.com "+key)[0]
+	assert.True(t, entry.matches("bastion.example.com"))
+	assert.False(t, entry.matches("untrusted.example.com"))
+	assert.False(t, entry.matches("bastion.example.org"))
+
+	// Hashed hosts, as written by `ssh-keyscan -H`, with the salt and HMAC-SHA1 of [bastion.example.com]:2222
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("[bastion.example.com]:2222"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	entry = parseTestKnownHosts(t, hashed+" "+key)[0]
+	assert.True(t, entry.matches("[bastion.example.com]:2222"))
+	assert.False(t, entry.matches("bastion.example.com"))
+}
+
+func TestValidateKnownHosts(t *testing.T) {
+	key := string(gossh.MarshalAuthorizedKey(newTestHostKey(t).PublicKey()))
+	key = key[:len(key)-1]
+
+	assert.NoError(t, validateKnownHosts([]string{"bastion.example.com,!other.example.com " + key}))
+
+	for _, entries := range [][]string{
+		{"not a known host"},
+		{"bastion.example.com " + key + "\nother.example.com " + key},
+		{"|1|not-base64|AAAA " + key},
+		{"|1|c2FsdA== " + key},
+	} {
+		err := validateKnownHosts(entries)
+		assert.Error(t, err, entries)
+		assert.True(t, isRequestError(err), entries)
+	}
+}
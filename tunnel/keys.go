@@ -1,11 +1,16 @@
 package tunnel
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -18,29 +23,86 @@ func (k KeyPair) Base64PrivateKey() string {
 	return base64.StdEncoding.EncodeToString(k.PrivateKey)
 }
 
-const privateKeyBits = 4096
+// KeyType is the algorithm used to generate a key pair
+type KeyType string
 
-func GenerateKeyPair() (KeyPair, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, privateKeyBits)
-	if err != nil {
-		return KeyPair{}, err
+const (
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeEd25519 KeyType = "ed25519"
+	KeyTypeECDSA   KeyType = "ecdsa"
+)
+
+// validateKeyType validates that the key type is supported. An empty key type uses the default.
+func validateKeyType(keyType KeyType) error {
+	switch keyType {
+	case "", KeyTypeRSA, KeyTypeEd25519, KeyTypeECDSA:
+		return nil
+	default:
+		return fmt.Errorf("keyType must be one of %q, %q, or %q", KeyTypeRSA, KeyTypeEd25519, KeyTypeECDSA)
 	}
+}
 
-	if err = privateKey.Validate(); err != nil {
-		return KeyPair{}, err
+const privateKeyBits = 4096
+
+// GenerateKeyPair generates a key pair of the given type. RSA is used if no type is specified.
+func GenerateKeyPair(keyType KeyType) (KeyPair, error) {
+	var publicKey crypto.PublicKey
+	var privateKeyBlock *pem.Block
+
+	switch keyType {
+	case "", KeyTypeRSA:
+		privateKey, err := rsa.GenerateKey(rand.Reader, privateKeyBits)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		if err = privateKey.Validate(); err != nil {
+			return KeyPair{}, err
+		}
+
+		publicKey = &privateKey.PublicKey
+		privateKeyBlock = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		}
+
+	case KeyTypeEd25519:
+		pub, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+
+		publicKey = pub
+		if privateKeyBlock, err = ssh.MarshalPrivateKey(privateKey, ""); err != nil {
+			return KeyPair{}, err
+		}
+
+	case KeyTypeECDSA:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return KeyPair{}, err
+		}
+
+		publicKey = &privateKey.PublicKey
+		privateKeyBlock = &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: der,
+		}
+
+	default:
+		return KeyPair{}, validateKeyType(keyType)
 	}
 
-	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
 	if err != nil {
 		return KeyPair{}, err
 	}
 
 	return KeyPair{
-		PublicKey: ssh.MarshalAuthorizedKey(publicKey),
-		PrivateKey: pem.EncodeToMemory(&pem.Block{
-			Type:    "RSA PRIVATE KEY",
-			Headers: nil,
-			Bytes:   x509.MarshalPKCS1PrivateKey(privateKey),
-		}),
+		PublicKey:  ssh.MarshalAuthorizedKey(sshPublicKey),
+		PrivateKey: pem.EncodeToMemory(privateKeyBlock),
 	}, nil
 }
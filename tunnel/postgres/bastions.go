@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// Bastion is the address of an alternate bastion for a normal tunnel
+type Bastion struct {
+	SSHHost string `json:"sshHost"`
+	SSHPort int    `json:"sshPort"`
+}
+
+// Bastions is an ordered list of Bastion, stored as a JSONB column
+type Bastions []Bastion
+
+func (b Bastions) Value() (driver.Value, error) {
+	if b == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(b)
+}
+
+func (b *Bastions) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*b = Bastions{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into Bastions", src)
+	}
+	return json.Unmarshal(data, b)
+}
@@ -0,0 +1,35 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// CryptoPolicy is the SSH algorithms that a normal tunnel allows, stored as a JSONB column
+type CryptoPolicy struct {
+	KeyExchanges      []string `json:"keyExchanges,omitempty"`
+	Ciphers           []string `json:"ciphers,omitempty"`
+	MACs              []string `json:"macs,omitempty"`
+	HostKeyAlgorithms []string `json:"hostKeyAlgorithms,omitempty"`
+}
+
+func (p CryptoPolicy) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *CryptoPolicy) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*p = CryptoPolicy{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into CryptoPolicy", src)
+	}
+	return json.Unmarshal(data, p)
+}
@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// Destination is a host and set of ports that a dynamic tunnel may connect to
+type Destination struct {
+	Host  string   `json:"host"`
+	Ports []string `json:"ports,omitempty"`
+}
+
+// Destinations is a list of Destination, stored as a JSONB column
+type Destinations []Destination
+
+func (d Destinations) Value() (driver.Value, error) {
+	if d == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(d)
+}
+
+func (d *Destinations) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*d = Destinations{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into Destinations", src)
+	}
+	return json.Unmarshal(data, d)
+}
@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// Handshake records the most recent SSH handshake for a tunnel
+type Handshake struct {
+	TunnelID  uuid.UUID `db:"tunnel_id"`
+	UpdatedAt time.Time `db:"updated_at"`
+
+	Host                 string `db:"host"`
+	ClientVersion        string `db:"client_version"`
+	ServerVersion        string `db:"server_version"`
+	KeyExchange          string `db:"kex"`
+	HostKeyAlgorithm     string `db:"host_key_algorithm"`
+	CipherClientToServer string `db:"cipher_client_to_server"`
+	CipherServerToClient string `db:"cipher_server_to_client"`
+	MACClientToServer    string `db:"mac_client_to_server"`
+	MACServerToClient    string `db:"mac_server_to_client"`
+	HostKeyFingerprint   string `db:"host_key_fingerprint"`
+	ClientKeyFingerprint string `db:"client_key_fingerprint"`
+	AuthMethod           string `db:"auth_method"`
+	Error                string `db:"error"`
+}
+
+const setTunnelHandshakeSql = `
+INSERT INTO passage.tunnel_handshakes (
+	tunnel_id, updated_at, host, client_version, server_version, kex, host_key_algorithm,
+	cipher_client_to_server, cipher_server_to_client, mac_client_to_server, mac_server_to_client,
+	host_key_fingerprint, client_key_fingerprint, auth_method, error
+) VALUES (
+	:tunnel_id, CURRENT_TIMESTAMP, :host, :client_version, :server_version, :kex, :host_key_algorithm,
+	:cipher_client_to_server, :cipher_server_to_client, :mac_client_to_server, :mac_server_to_client,
+	:host_key_fingerprint, :client_key_fingerprint, :auth_method, :error
+) ON CONFLICT (tunnel_id) DO UPDATE SET
+	updated_at = EXCLUDED.updated_at, host = EXCLUDED.host,
+	client_version = EXCLUDED.client_version, server_version = EXCLUDED.server_version,
+	kex = EXCLUDED.kex, host_key_algorithm = EXCLUDED.host_key_algorithm,
+	cipher_client_to_server = EXCLUDED.cipher_client_to_server, cipher_server_to_client = EXCLUDED.cipher_server_to_client,
+	mac_client_to_server = EXCLUDED.mac_client_to_server, mac_server_to_client = EXCLUDED.mac_server_to_client,
+	host_key_fingerprint = EXCLUDED.host_key_fingerprint, client_key_fingerprint = EXCLUDED.client_key_fingerprint,
+	auth_method = EXCLUDED.auth_method, error = EXCLUDED.error;
+`
+
+// SetTunnelHandshake records the most recent SSH handshake for a tunnel, replacing the previous one
+func (c Client) SetTunnelHandshake(ctx context.Context, handshake Handshake) error {
+	_, err := c.db.NamedExecContext(ctx, setTunnelHandshakeSql, handshake)
+	return err
+}
+
+// GetTunnelHandshake returns the most recent SSH handshake for a tunnel, or ErrTunnelNotFound if there hasn't been one
+func (c Client) GetTunnelHandshake(ctx context.Context, tunnelID uuid.UUID) (Handshake, error) {
+	var handshake Handshake
+	switch err := c.db.GetContext(ctx, &handshake, `SELECT * FROM passage.tunnel_handshakes WHERE tunnel_id=$1;`, tunnelID); err {
+	case nil:
+		return handshake, nil
+	case sql.ErrNoRows:
+		return Handshake{}, ErrTunnelNotFound
+	default:
+		return Handshake{}, err
+	}
+}
+
+func deleteTunnelHandshake(ctx context.Context, db sqlx.ExecerContext, tunnelID uuid.UUID) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM passage.tunnel_handshakes WHERE tunnel_id=$1;`, tunnelID)
+	return err
+}
@@ -0,0 +1,42 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// JumpHost is an SSH server that a normal tunnel connects through before reaching its bastion
+type JumpHost struct {
+	SSHUser string      `json:"sshUser,omitempty"`
+	SSHHost string      `json:"sshHost"`
+	SSHPort int         `json:"sshPort"`
+	Keys    []uuid.UUID `json:"keys,omitempty"`
+}
+
+// JumpHosts is an ordered list of JumpHost, stored as a JSONB column
+type JumpHosts []JumpHost
+
+func (j JumpHosts) Value() (driver.Value, error) {
+	if j == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(j)
+}
+
+func (j *JumpHosts) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*j = JumpHosts{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into JumpHosts", src)
+	}
+	return json.Unmarshal(data, j)
+}
@@ -0,0 +1,45 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// Keepalive records the round trip time of the most recent SSH keepalive for a tunnel
+type Keepalive struct {
+	TunnelID  uuid.UUID `db:"tunnel_id"`
+	UpdatedAt time.Time `db:"updated_at"`
+	RTTMillis float64   `db:"rtt_ms"`
+}
+
+const setTunnelKeepaliveSql = `
+INSERT INTO passage.tunnel_keepalives (tunnel_id, updated_at, rtt_ms) VALUES ($1, CURRENT_TIMESTAMP, $2)
+ON CONFLICT (tunnel_id) DO UPDATE SET updated_at = EXCLUDED.updated_at, rtt_ms = EXCLUDED.rtt_ms;
+`
+
+// SetTunnelKeepalive records the round trip time of the most recent SSH keepalive for a tunnel
+func (c Client) SetTunnelKeepalive(ctx context.Context, tunnelID uuid.UUID, rtt time.Duration) error {
+	_, err := c.db.ExecContext(ctx, setTunnelKeepaliveSql, tunnelID, float64(rtt)/float64(time.Millisecond))
+	return err
+}
+
+// GetTunnelKeepalive returns the most recent SSH keepalive for a tunnel, or ErrTunnelNotFound if there hasn't been one
+func (c Client) GetTunnelKeepalive(ctx context.Context, tunnelID uuid.UUID) (Keepalive, error) {
+	var keepalive Keepalive
+	switch err := c.db.GetContext(ctx, &keepalive, `SELECT * FROM passage.tunnel_keepalives WHERE tunnel_id=$1;`, tunnelID); err {
+	case nil:
+		return keepalive, nil
+	case sql.ErrNoRows:
+		return Keepalive{}, ErrTunnelNotFound
+	default:
+		return Keepalive{}, err
+	}
+}
+
+func deleteTunnelKeepalive(ctx context.Context, db sqlx.ExecerContext, tunnelID uuid.UUID) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM passage.tunnel_keepalives WHERE tunnel_id=$1;`, tunnelID)
+	return err
+}
@@ -0,0 +1,64 @@
+package postgres
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// KnownHost is a known_hosts formatted entry which is trusted for a normal tunnel's bastion
+type KnownHost struct {
+	TunnelID  uuid.UUID `db:"tunnel_id"`
+	CreatedAt time.Time `db:"created_at"`
+	Entry     string    `db:"entry"`
+}
+
+func (c Client) GetNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID) ([]KnownHost, error) {
+	knownHosts := make([]KnownHost, 0)
+	if err := c.db.SelectContext(ctx, &knownHosts, `SELECT * FROM passage.known_hosts WHERE tunnel_id=$1 ORDER BY created_at;`, tunnelID); err != nil {
+		return []KnownHost{}, err
+	}
+	return knownHosts, nil
+}
+
+const addKnownHostSql = `
+INSERT INTO passage.known_hosts (tunnel_id, entry) VALUES ($1, $2) ON CONFLICT DO NOTHING;
+`
+
+func (c Client) AddNormalTunnelKnownHost(ctx context.Context, tunnelID uuid.UUID, entry string) error {
+	return addKnownHost(ctx, c.db, tunnelID, entry)
+}
+
+// SetNormalTunnelKnownHosts replaces all known_hosts entries for the tunnel
+func (c Client) SetNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID, entries []string) error {
+	return withTx(ctx, c.db, func(tx *sqlx.Tx) error {
+		if err := deleteKnownHosts(ctx, tx, tunnelID); err != nil {
+			return errors.Wrap(err, "could not delete known hosts")
+		}
+
+		for _, entry := range entries {
+			if err := addKnownHost(ctx, tx, tunnelID, entry); err != nil {
+				return errors.Wrap(err, "could not add known host")
+			}
+		}
+
+		return nil
+	})
+}
+
+// DeleteNormalTunnelKnownHosts removes all known_hosts entries for the tunnel
+func (c Client) DeleteNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID) error {
+	return deleteKnownHosts(ctx, c.db, tunnelID)
+}
+
+func addKnownHost(ctx context.Context, db sqlx.ExecerContext, tunnelID uuid.UUID, entry string) error {
+	_, err := db.ExecContext(ctx, addKnownHostSql, tunnelID, entry)
+	return err
+}
+
+func deleteKnownHosts(ctx context.Context, db sqlx.ExecerContext, tunnelID uuid.UUID) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM passage.known_hosts WHERE tunnel_id=$1;`, tunnelID)
+	return err
+}
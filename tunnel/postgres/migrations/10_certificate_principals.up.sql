@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS certificate_principals VARCHAR[] NOT NULL DEFAULT '{}';
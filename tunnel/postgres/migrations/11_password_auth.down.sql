@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels DROP COLUMN password_key_id;
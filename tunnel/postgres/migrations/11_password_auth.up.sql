@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS password_key_id UUID;
@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels DROP COLUMN proxy_password_key_id;
+ALTER TABLE passage.tunnels DROP COLUMN proxy_url;
@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS proxy_url VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS proxy_password_key_id UUID;
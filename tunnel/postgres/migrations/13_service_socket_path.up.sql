@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS service_socket_path VARCHAR NOT NULL DEFAULT '';
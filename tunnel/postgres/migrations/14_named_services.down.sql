@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels DROP COLUMN services;
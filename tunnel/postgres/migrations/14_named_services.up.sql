@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS services JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels DROP COLUMN upstream_policy;
+ALTER TABLE passage.tunnels DROP COLUMN upstream_targets;
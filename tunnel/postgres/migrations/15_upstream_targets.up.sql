@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS upstream_targets JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS upstream_policy VARCHAR NOT NULL DEFAULT 'failover';
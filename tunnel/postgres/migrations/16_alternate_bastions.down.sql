@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels DROP COLUMN bastion_strategy;
+ALTER TABLE passage.tunnels DROP COLUMN alternate_bastions;
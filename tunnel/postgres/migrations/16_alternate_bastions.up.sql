@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS alternate_bastions JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS bastion_strategy VARCHAR NOT NULL DEFAULT 'ordered';
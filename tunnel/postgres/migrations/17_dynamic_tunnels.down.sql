@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels DROP COLUMN allowed_destinations;
+ALTER TABLE passage.tunnels DROP COLUMN dynamic;
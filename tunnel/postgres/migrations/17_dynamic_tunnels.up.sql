@@ -0,0 +1,2 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS dynamic BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS allowed_destinations JSONB NOT NULL DEFAULT '[]';
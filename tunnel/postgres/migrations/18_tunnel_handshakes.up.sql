@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS passage.tunnel_handshakes(
+    updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    tunnel_id               UUID PRIMARY KEY,
+    host                    VARCHAR NOT NULL DEFAULT '',
+    client_version          VARCHAR NOT NULL DEFAULT '',
+    server_version          VARCHAR NOT NULL DEFAULT '',
+    kex                     VARCHAR NOT NULL DEFAULT '',
+    host_key_algorithm      VARCHAR NOT NULL DEFAULT '',
+    cipher_client_to_server VARCHAR NOT NULL DEFAULT '',
+    cipher_server_to_client VARCHAR NOT NULL DEFAULT '',
+    mac_client_to_server    VARCHAR NOT NULL DEFAULT '',
+    mac_server_to_client    VARCHAR NOT NULL DEFAULT '',
+    host_key_fingerprint    VARCHAR NOT NULL DEFAULT '',
+    client_key_fingerprint  VARCHAR NOT NULL DEFAULT '',
+    auth_method             VARCHAR NOT NULL DEFAULT '',
+    error                   VARCHAR NOT NULL DEFAULT ''
+);
@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS crypto_policy JSONB NOT NULL DEFAULT '{}';
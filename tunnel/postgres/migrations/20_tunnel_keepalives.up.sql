@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS passage.tunnel_keepalives(
+    updated_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    tunnel_id UUID PRIMARY KEY,
+    rtt_ms    DOUBLE PRECISION NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE passage.reverse_tunnels DROP COLUMN client_policy;
+ALTER TABLE passage.reverse_tunnels DROP COLUMN max_clients;
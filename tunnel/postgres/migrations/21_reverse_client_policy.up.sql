@@ -0,0 +1,2 @@
+ALTER TABLE passage.reverse_tunnels ADD COLUMN IF NOT EXISTS client_policy VARCHAR NOT NULL DEFAULT 'round-robin';
+ALTER TABLE passage.reverse_tunnels ADD COLUMN IF NOT EXISTS max_clients INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE passage.reverse_tunnels DROP COLUMN allowed_source_cidrs;
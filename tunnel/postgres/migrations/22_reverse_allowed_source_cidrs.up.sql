@@ -0,0 +1 @@
+ALTER TABLE passage.reverse_tunnels ADD COLUMN IF NOT EXISTS allowed_source_cidrs VARCHAR[] NOT NULL DEFAULT '{}';
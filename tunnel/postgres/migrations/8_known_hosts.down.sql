@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS passage.known_hosts;
+ALTER TABLE passage.tunnels DROP COLUMN host_key_verification;
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS host_key_verification VARCHAR NOT NULL DEFAULT 'tofu';
+
+CREATE TABLE IF NOT EXISTS passage.known_hosts(
+    created_at TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+
+    tunnel_id   UUID NOT NULL,
+    entry       VARCHAR NOT NULL,
+
+    PRIMARY KEY(tunnel_id, entry)
+);
+
+COMMIT;
@@ -0,0 +1 @@
+ALTER TABLE passage.tunnels ADD COLUMN IF NOT EXISTS jump_hosts JSONB NOT NULL DEFAULT '[]';
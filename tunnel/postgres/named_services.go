@@ -0,0 +1,41 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// NamedService is an additional upstream service that a normal tunnel forwards to, with its own listener
+type NamedService struct {
+	Name              string `json:"name"`
+	ServiceHost       string `json:"serviceHost,omitempty"`
+	ServicePort       int    `json:"servicePort,omitempty"`
+	ServiceSocketPath string `json:"serviceSocketPath,omitempty"`
+}
+
+// NamedServices is a list of NamedService, stored as a JSONB column
+type NamedServices []NamedService
+
+func (s NamedServices) Value() (driver.Value, error) {
+	if s == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *NamedServices) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*s = NamedServices{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into NamedServices", src)
+	}
+	return json.Unmarshal(data, s)
+}
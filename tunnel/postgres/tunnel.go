@@ -12,6 +12,15 @@ func (c Client) DeleteTunnel(ctx context.Context, id uuid.UUID) error {
 	if _, err := c.db.ExecContext(ctx, `DELETE FROM passage.reverse_tunnels WHERE id=$1;`, id); err != nil {
 		return err
 	}
+	if err := deleteKnownHosts(ctx, c.db, id); err != nil {
+		return err
+	}
+	if err := deleteTunnelHandshake(ctx, c.db, id); err != nil {
+		return err
+	}
+	if err := deleteTunnelKeepalive(ctx, c.db, id); err != nil {
+		return err
+	}
 	return nil
 }
 
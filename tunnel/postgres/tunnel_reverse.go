@@ -6,18 +6,22 @@ import (
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"time"
 )
 
 type ReverseTunnel struct {
-	ID                 uuid.UUID `db:"id"`
-	CreatedAt          time.Time `db:"created_at"`
-	Enabled            bool      `db:"enabled"`
-	SSHDPort           int       `db:"sshd_port"`
-	AuthorizedKeysHash string    `db:"authorized_keys_hash"`
-	TunnelPort         int       `db:"tunnel_port"`
-	HealthcheckEnabled bool      `db:"healthcheck_enabled"`
+	ID                 uuid.UUID      `db:"id"`
+	CreatedAt          time.Time      `db:"created_at"`
+	Enabled            bool           `db:"enabled"`
+	SSHDPort           int            `db:"sshd_port"`
+	AuthorizedKeyIDs   pq.StringArray `db:"authorized_key_ids"`
+	TunnelPort         int            `db:"tunnel_port"`
+	HealthcheckEnabled bool           `db:"healthcheck_enabled"`
+	ClientPolicy       string         `db:"client_policy"`
+	MaxClients         int            `db:"max_clients"`
+	AllowedSourceCIDRs pq.StringArray `db:"allowed_source_cidrs"`
 
 	// Deprecated
 	HttpProxy  bool           `db:"http_proxy"`
@@ -26,7 +30,11 @@ type ReverseTunnel struct {
 }
 
 func (c Client) CreateReverseTunnel(ctx context.Context, input ReverseTunnel, authorizedKeys []uuid.UUID) (ReverseTunnel, error) {
-	query, args, err := psql.Insert("passage.reverse_tunnels").Values(sq.Expr("DEFAULT")).Suffix("RETURNING *").ToSql()
+	query, args, err := psql.Insert("passage.reverse_tunnels").SetMap(map[string]interface{}{
+		"client_policy":        input.ClientPolicy,
+		"max_clients":          input.MaxClients,
+		"allowed_source_cidrs": input.AllowedSourceCIDRs,
+	}).Suffix("RETURNING *").ToSql()
 	if err != nil {
 		return ReverseTunnel{}, errors.Wrap(err, "could not generate sql")
 	}
@@ -82,7 +90,7 @@ func (c Client) GetReverseTunnel(ctx context.Context, id uuid.UUID) (ReverseTunn
 
 func (c Client) ListReverseActiveTunnels(ctx context.Context) ([]ReverseTunnel, error) {
 	rows, err := c.db.QueryxContext(ctx, `
-		SELECT rt.*, encode(sha256(array_to_string(array_agg(ka.key_id), ',')::bytea), 'hex') AS authorized_keys_hash
+		SELECT rt.*, array_remove(array_agg(ka.key_id::text ORDER BY ka.key_id), NULL) AS authorized_key_ids
 		FROM passage.reverse_tunnels rt
 				  LEFT JOIN passage.key_authorizations ka ON ka.tunnel_id = rt.id
 		WHERE rt.enabled = true
@@ -108,7 +116,7 @@ func (c Client) ListReverseActiveTunnels(ctx context.Context) ([]ReverseTunnel,
 	return tunnels, nil
 }
 
-var reverseTunnelAllowedFields = []string{"enabled"}
+var reverseTunnelAllowedFields = []string{"enabled", "client_policy", "max_clients", "allowed_source_cidrs"}
 
 // withTx is a helper function to wrap a function in a transaction, and commit or rollback depending on if the fn
 //
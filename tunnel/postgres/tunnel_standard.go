@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"time"
 
 	"github.com/pkg/errors"
@@ -21,6 +22,26 @@ type NormalTunnel struct {
 	ServiceHost        string         `db:"service_host"`
 	ServicePort        int            `db:"service_port"`
 	HealthcheckEnabled bool           `db:"healthcheck_enabled"`
+	ServiceSocketPath  string         `db:"service_socket_path"`
+	Services           NamedServices  `db:"services"`
+
+	UpstreamTargets UpstreamTargets `db:"upstream_targets"`
+	UpstreamPolicy  string          `db:"upstream_policy"`
+
+	AlternateBastions Bastions `db:"alternate_bastions"`
+	BastionStrategy   string   `db:"bastion_strategy"`
+
+	// Dynamic tunnels serve SOCKS5 rather than forwarding to a single service
+	Dynamic             bool         `db:"dynamic"`
+	AllowedDestinations Destinations `db:"allowed_destinations"`
+
+	HostKeyVerification   string         `db:"host_key_verification"`
+	JumpHosts             JumpHosts      `db:"jump_hosts"`
+	CryptoPolicy          CryptoPolicy   `db:"crypto_policy"`
+	CertificatePrincipals pq.StringArray `db:"certificate_principals"`
+	PasswordKeyID         uuid.NullUUID  `db:"password_key_id"`
+	ProxyURL              string         `db:"proxy_url"`
+	ProxyPasswordKeyID    uuid.NullUUID  `db:"proxy_password_key_id"`
 
 	// Deprecated
 	TunnelPort int            `db:"tunnel_port"`
@@ -35,6 +56,26 @@ func (c Client) CreateNormalTunnel(ctx context.Context, input NormalTunnel) (Nor
 		"ssh_port":     input.SSHPort,
 		"service_host": input.ServiceHost,
 		"service_port": input.ServicePort,
+
+		"service_socket_path": input.ServiceSocketPath,
+		"services":            input.Services,
+
+		"upstream_targets": input.UpstreamTargets,
+		"upstream_policy":  input.UpstreamPolicy,
+
+		"alternate_bastions": input.AlternateBastions,
+		"bastion_strategy":   input.BastionStrategy,
+
+		"dynamic":              input.Dynamic,
+		"allowed_destinations": input.AllowedDestinations,
+
+		"host_key_verification":  input.HostKeyVerification,
+		"jump_hosts":             input.JumpHosts,
+		"crypto_policy":          input.CryptoPolicy,
+		"certificate_principals": input.CertificatePrincipals,
+		"password_key_id":        input.PasswordKeyID,
+		"proxy_url":              input.ProxyURL,
+		"proxy_password_key_id":  input.ProxyPasswordKeyID,
 	}).Suffix("RETURNING *").ToSql()
 	if err != nil {
 		return NormalTunnel{}, errors.Wrap(err, "could not generate SQL")
@@ -74,7 +115,16 @@ func (c Client) GetNormalTunnel(ctx context.Context, id uuid.UUID) (NormalTunnel
 }
 
 func (c Client) ListNormalActiveTunnels(ctx context.Context) ([]NormalTunnel, error) {
-	rows, err := c.db.QueryxContext(ctx, `SELECT * FROM passage.tunnels WHERE enabled=true;`)
+	return c.listTunnels(ctx, `SELECT * FROM passage.tunnels WHERE enabled=true AND dynamic=false;`)
+}
+
+// ListDynamicActiveTunnels lists the enabled tunnels that serve SOCKS5
+func (c Client) ListDynamicActiveTunnels(ctx context.Context) ([]NormalTunnel, error) {
+	return c.listTunnels(ctx, `SELECT * FROM passage.tunnels WHERE enabled=true AND dynamic=true;`)
+}
+
+func (c Client) listTunnels(ctx context.Context, query string) ([]NormalTunnel, error) {
+	rows, err := c.db.QueryxContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -95,4 +145,4 @@ func (c Client) ListNormalActiveTunnels(ctx context.Context) ([]NormalTunnel, er
 	return tunnels, nil
 }
 
-var normalTunnelAllowedFields = []string{"enabled", "service_host", "service_port", "ssh_host", "ssh_port", "ssh_user"}
+var normalTunnelAllowedFields = []string{"enabled", "service_host", "service_port", "service_socket_path", "services", "upstream_targets", "upstream_policy", "ssh_host", "ssh_port", "ssh_user", "alternate_bastions", "bastion_strategy", "host_key_verification", "jump_hosts", "certificate_principals", "password_key_id", "proxy_url", "proxy_password_key_id", "allowed_destinations", "crypto_policy"}
@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// UpstreamTarget is an upstream host and port that a normal tunnel can forward to
+type UpstreamTarget struct {
+	ServiceHost string `json:"serviceHost"`
+	ServicePort int    `json:"servicePort"`
+}
+
+// UpstreamTargets is an ordered list of UpstreamTarget, stored as a JSONB column
+type UpstreamTargets []UpstreamTarget
+
+func (u UpstreamTargets) Value() (driver.Value, error) {
+	if u == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(u)
+}
+
+func (u *UpstreamTargets) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*u = UpstreamTargets{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return errors.Errorf("cannot scan %T into UpstreamTargets", src)
+	}
+	return json.Unmarshal(data, u)
+}
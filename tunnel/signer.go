@@ -12,12 +12,21 @@ func getSignersForPrivateKey(privateKeyBytes []byte) ([]ssh.Signer, error) {
 	if err != nil {
 		return []ssh.Signer{}, errors.Wrap(err, "could not parse private key")
 	}
+	return getSignersForKey(signer), nil
+}
+
+// getSignersForKey returns a list of ssh.Signers for each signature algorithm that the key supports
+func getSignersForKey(signer ssh.Signer) []ssh.Signer {
+	// Only RSA keys need to be wrapped to negotiate SHA-2 signature algorithms
+	if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return []ssh.Signer{signer}
+	}
 
 	return []ssh.Signer{
 		signer, // Original signer
 		wrapSigner{signer, ssh.SigAlgoRSASHA2256}, // Signer with SHA2-256 algorithm
 		wrapSigner{signer, ssh.SigAlgoRSASHA2512}, // Signer with SHA2-512 algorithm
-	}, nil
+	}
 }
 
 // WrapSigner wraps a signer and overrides its public key type with the provided algorithm
@@ -10,43 +10,66 @@ import (
 
 // Test our key pair generation and signers
 func TestSSHKeySigning(t *testing.T) {
-	// Generate key pair
-	keyPair, err := GenerateKeyPair()
-
-	// Get public key
-	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(keyPair.PublicKey)
-	if err != nil {
-		t.Error(errors.Wrap(err, "parse public key"))
-		return
+	tests := []struct {
+		keyType            KeyType
+		expectedAlgorithms []string
+	}{
+		{"", []string{"ssh-rsa", "rsa-sha2-256", "rsa-sha2-512"}},
+		{KeyTypeRSA, []string{"ssh-rsa", "rsa-sha2-256", "rsa-sha2-512"}},
+		{KeyTypeEd25519, []string{"ssh-ed25519"}},
+		{KeyTypeECDSA, []string{"ecdsa-sha2-nistp256"}},
 	}
 
-	// Get Auth Signers
-	signers, err := getSignersForPrivateKey(keyPair.PrivateKey)
-	if err != nil {
-		t.Error(errors.Wrap(err, "get auth signers"))
-		return
-	}
+	for _, test := range tests {
+		t.Run(string(test.keyType), func(t *testing.T) {
+			// Generate key pair
+			keyPair, err := GenerateKeyPair(test.keyType)
+			if err != nil {
+				t.Error(errors.Wrap(err, "generate key pair"))
+				return
+			}
+
+			// Get public key
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey(keyPair.PublicKey)
+			if err != nil {
+				t.Error(errors.Wrap(err, "parse public key"))
+				return
+			}
+
+			// Get Auth Signers
+			signers, err := getSignersForPrivateKey(keyPair.PrivateKey)
+			if err != nil {
+				t.Error(errors.Wrap(err, "get auth signers"))
+				return
+			}
 
-	var observedSignatureAlgorithms []string
+			var observedSignatureAlgorithms []string
 
-	// Test each signer
-	for _, signer := range signers {
-		signatureAlgorithm := signer.PublicKey().Type()
-		observedSignatureAlgorithms = append(observedSignatureAlgorithms, signatureAlgorithm)
+			// Test each signer
+			for _, signer := range signers {
+				signatureAlgorithm := signer.PublicKey().Type()
+				observedSignatureAlgorithms = append(observedSignatureAlgorithms, signatureAlgorithm)
 
-		t.Logf("Verify signature %s", signatureAlgorithm)
-		signature, err := signers[0].Sign(rand.Reader, []byte("hello world"))
-		if err != nil {
-			t.Error(errors.Wrapf(err, "Sign message for key %s", signatureAlgorithm))
-			return
-		}
+				t.Logf("Verify signature %s", signatureAlgorithm)
+				signature, err := signer.Sign(rand.Reader, []byte("hello world"))
+				if err != nil {
+					t.Error(errors.Wrapf(err, "Sign message for key %s", signatureAlgorithm))
+					return
+				}
 
-		if err := publicKey.Verify([]byte("hello world"), signature); err != nil {
-			t.Error(errors.Wrapf(err, "Verify message for key %s", signatureAlgorithm))
-			return
-		}
+				if err := publicKey.Verify([]byte("hello world"), signature); err != nil {
+					t.Error(errors.Wrapf(err, "Verify message for key %s", signatureAlgorithm))
+					return
+				}
+			}
+
+			// Assert that our supported signature algorithms were present
+			assert.EqualValues(t, test.expectedAlgorithms, observedSignatureAlgorithms)
+		})
 	}
+}
 
-	// Assert that our supported signature algorithms were present
-	assert.EqualValues(t, observedSignatureAlgorithms, []string{"ssh-rsa", "rsa-sha2-256", "rsa-sha2-512"})
+func TestGenerateKeyPair_InvalidKeyType(t *testing.T) {
+	_, err := GenerateKeyPair("dsa")
+	assert.Error(t, err)
 }
@@ -0,0 +1,289 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/stats"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS5 protocol constants, from RFC 1928
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCommandConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// socksHandshakeTimeout bounds how long a client may take to request a destination
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKSServer accepts SOCKS5 CONNECT requests, and dials each allowed destination with Dial
+type SOCKSServer struct {
+	Listener *net.TCPListener
+
+	// Dial opens a connection to the requested destination, typically through an SSH client
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Allowlist restricts the destinations that clients may connect to
+	Allowlist destinationAllowlist
+
+	// KeepaliveInterval is the interval between OS level TCP keepalive handshakes
+	KeepaliveInterval time.Duration
+
+	logger *log.Logger
+	Stats  stats.Stats
+}
+
+func (s *SOCKSServer) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Keep track of the number of active connections and report metrics
+	var connectionCount atomic.Int32
+	go intervalMetricReporter(ctx, func() {
+		s.Stats.Gauge(StatTunnelClientActiveConnectionCount, float64(connectionCount.Load()), stats.Tags{}, 1)
+	})
+
+	// The listener outlives the server when the tunnel restarts, so unblock Accept with a deadline rather than closing it
+	if err := s.Listener.SetDeadline(time.Time{}); err != nil {
+		return errors.Wrap(err, "reset deadline")
+	}
+	go func() {
+		<-ctx.Done()
+		_ = s.Listener.SetDeadline(time.Now())
+	}()
+
+	for {
+		conn, err := s.Listener.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			return errors.Wrap(err, "accept tcp")
+		}
+
+		go func() {
+			defer conn.Close()
+
+			connectionCount.Add(1)
+			defer connectionCount.Add(-1)
+
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+// handleConn negotiates a SOCKS5 session, then forwards bytes between the client and the requested destination
+func (s *SOCKSServer) handleConn(ctx context.Context, conn *net.TCPConn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logger := s.logger.With(zap.String("session_id", uuid.New().String()))
+
+	// Bound the handshake, so that idle clients can't hold connections open
+	if err := conn.SetDeadline(time.Now().Add(socksHandshakeTimeout)); err != nil {
+		logger.Errorw("Set deadline", zap.Error(err))
+		return
+	}
+
+	host, port, err := s.handshake(conn)
+	if err != nil {
+		logger.Debugw("SOCKS handshake", zap.Error(err))
+		return
+	}
+	destination := destinationString(host, port)
+	logger = logger.With(zap.String("destination", destination))
+
+	// Stats are tagged with the allowed destination that the request matched, rather than the requested host and port,
+	//	so that clients can't create a tag value for every destination they request
+	rule, ok := s.Allowlist.match(host, port)
+	if !ok {
+		logger.Infow("Destination not allowed")
+		s.Stats.Incr(StatTunnelDynamicConnectionRequests, stats.Tags{"result": "denied"}, 1)
+		_ = writeSOCKSReply(conn, socksReplyNotAllowed)
+		return
+	}
+	destinationStats := s.Stats.WithTags(stats.Tags{"destination": rule.name})
+
+	upstream, err := s.Dial("tcp", destination)
+	if err != nil {
+		logger.Errorw("Could not dial destination", zap.Error(err))
+		destinationStats.Incr(StatTunnelDynamicConnectionRequests, stats.Tags{"result": "unreachable"}, 1)
+		_ = writeSOCKSReply(conn, socksReplyForDialError(err))
+		return
+	}
+	defer upstream.Close()
+	destinationStats.Incr(StatTunnelDynamicConnectionRequests, stats.Tags{"result": "allowed"}, 1)
+
+	if err := writeSOCKSReply(conn, socksReplySucceeded); err != nil {
+		logger.Debugw("Write SOCKS reply", zap.Error(err))
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		logger.Errorw("Reset deadline", zap.Error(err))
+		return
+	}
+
+	// Configure keepalive
+	if err := conn.SetKeepAlive(true); err != nil {
+		logger.Errorw("Set keepalive", zap.Error(err))
+		return
+	}
+	if err := conn.SetKeepAlivePeriod(s.KeepaliveInterval); err != nil {
+		logger.Errorw("Set keepalive period", zap.Error(err))
+		return
+	}
+
+	// Wrap the client and upstream in a CountedReadWriteCloser to count bytes sent and received
+	clientRwc := NewCountedReadWriteCloser(conn)
+	upstreamRwc := NewCountedReadWriteCloser(upstream)
+
+	// Report byte counts for each destination
+	deltas := make(chan forwarderStatsPayload)
+	go func() {
+		defer close(deltas)
+		ticker := time.NewTicker(metricReportInterval)
+		defer ticker.Stop()
+		connectionStatProducer(ctx, clientRwc, upstreamRwc, deltas, ticker.C)
+	}()
+	go func() {
+		for delta := range deltas {
+			reportForwarderStats(destinationStats, delta)
+		}
+	}()
+
+	// Run bidirectional pipeline
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := runPipeline(clientRwc, upstreamRwc); err != nil {
+			logger.Debugw("Pipeline", zap.Error(err))
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-done: // Finished pipeline
+	}
+}
+
+// handshake negotiates the authentication method, and reads the client's CONNECT request
+func (s *SOCKSServer) handshake(conn io.ReadWriter) (string, int, error) {
+	// Method negotiation: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, errors.Wrap(err, "read version")
+	}
+	if header[0] != socksVersion5 {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, errors.Wrap(err, "read methods")
+	}
+
+	// The listener is only reachable from inside the network, like a normal tunnel's, so no auth is required
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return "", 0, errors.Wrap(err, "write method")
+	}
+	if method == socksMethodNoAcceptable {
+		return "", 0, errors.New("client does not support unauthenticated SOCKS")
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", 0, errors.Wrap(err, "read request")
+	}
+	if request[0] != socksVersion5 {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		addr := make([]byte, net.IPv4len)
+		if request[3] == socksAddressIPv6 {
+			addr = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", 0, errors.Wrap(err, "read address")
+		}
+		host = net.IP(addr).String()
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", 0, errors.Wrap(err, "read domain length")
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", 0, errors.Wrap(err, "read domain")
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKSReply(conn, socksReplyAddressNotSupported)
+		return "", 0, fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, errors.Wrap(err, "read port")
+	}
+
+	// Only CONNECT is supported. BIND and UDP ASSOCIATE can't be carried over an SSH connection.
+	if request[1] != socksCommandConnect {
+		_ = writeSOCKSReply(conn, socksReplyCommandNotSupported)
+		return "", 0, fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// writeSOCKSReply writes a reply to a SOCKS request. The bound address is not meaningful over SSH, so it is left empty.
+func writeSOCKSReply(w io.Writer, reply byte) error {
+	_, err := w.Write([]byte{socksVersion5, reply, 0x00, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyForDialError chooses the SOCKS reply for a destination that couldn't be dialed
+func socksReplyForDialError(err error) byte {
+	var openChannelErr *ssh.OpenChannelError
+	if errors.As(err, &openChannelErr) {
+		switch openChannelErr.Reason {
+		case ssh.Prohibited:
+			return socksReplyNotAllowed
+		case ssh.ConnectionFailed:
+			return socksReplyHostUnreachable
+		}
+	}
+	return socksReplyGeneralFailure
+}
@@ -2,11 +2,13 @@ package tunnel
 
 import (
 	"context"
+	"fmt"
 	"github.com/hightouchio/passage/log"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	gossh "golang.org/x/crypto/ssh"
 	"net"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -17,83 +19,327 @@ type SSHClientOptions struct {
 	User          string
 	GetKeySigners func(context.Context) ([]gossh.Signer, error)
 
+	// GetPassword returns a password for password and keyboard-interactive authentication. If nil, only public keys are used.
+	GetPassword func(context.Context) (string, error)
+
+	// HostKeyCallback verifies the host key presented by each remote SSH server
+	HostKeyCallback gossh.HostKeyCallback
+
+	// JumpHosts are SSH servers that the connection is proxied through, in order, before connecting to Host
+	JumpHosts []SSHJumpHostOptions
+
+	// AlternateBastions are tried if the bastion at Host and Port is unreachable, according to the BastionStrategy
+	AlternateBastions []SSHBastion
+	BastionStrategy   string
+
+	// OnHandshake is called with the details of each SSH handshake, including those that fail. If nil, they aren't reported.
+	OnHandshake func(SSHHandshake)
+
+	// OnKeepalive is called with the round trip time of each successful keepalive. If nil, they aren't reported.
+	OnKeepalive func(rtt time.Duration)
+
+	// ProxyURL is an HTTP CONNECT or SOCKS5 egress proxy to dial the first hop through. If nil, the first hop is dialed directly.
+	ProxyURL *url.URL
+
+	// CryptoPolicy restricts the algorithms negotiated with every hop
+	CryptoPolicy CryptoPolicy
+
 	DialTimeout       time.Duration
 	KeepaliveInterval time.Duration
+
+	// KeepaliveDegradedThreshold is the keepalive round trip time above which tunnels report themselves as degraded.
+	//	If zero, tunnels are never degraded.
+	KeepaliveDegradedThreshold time.Duration
+}
+
+// SSHJumpHostOptions are the connection options for a single jump host
+type SSHJumpHostOptions struct {
+	Host          string
+	Port          int
+	User          string
+	GetKeySigners func(context.Context) ([]gossh.Signer, error)
+	GetPassword   func(context.Context) (string, error)
+}
+
+// SSHHopError is returned when a connection through a chain of jump hosts fails at a particular hop
+type SSHHopError struct {
+	Hop   int
+	Hops  int
+	Host  string
+	Cause error
 }
 
+func (e SSHHopError) Error() string {
+	return fmt.Sprintf("SSH hop %d/%d (%s): %s", e.Hop, e.Hops, e.Host, e.Cause.Error())
+}
+
+func (e SSHHopError) Unwrap() error {
+	return e.Cause
+}
+
+// NewSSHClient connects to the bastion, or one of its alternates, through any jump hosts
 func NewSSHClient(ctx context.Context, options SSHClientOptions) (*gossh.Client, <-chan error, error) {
+	conn, err := newSSHClientToAnyBastion(ctx, options)
+	return conn.client, conn.keepalive, err
+}
+
+// newSSHClientToBastion connects to the bastion at options.Host and options.Port, through any jump hosts
+func newSSHClientToBastion(ctx context.Context, options SSHClientOptions) (*gossh.Client, <-chan error, error) {
 	logger := log.FromContext(ctx).Named("SSH")
-	logger.With(
-		zap.String("user", options.User),
-		zap.Dict("sshd",
-			zap.String("host", options.Host),
-			zap.Int("port", options.Port),
-		),
-	).Infof("Connect to ssh://%s@%s:%d", options.User, options.Host, options.Port)
+
+	// The bastion is the final hop, after any jump hosts
+	hops := make([]SSHJumpHostOptions, 0, len(options.JumpHosts)+1)
+	hops = append(hops, options.JumpHosts...)
+	hops = append(hops, SSHJumpHostOptions{
+		Host:          options.Host,
+		Port:          options.Port,
+		User:          options.User,
+		GetKeySigners: options.GetKeySigners,
+		GetPassword:   options.GetPassword,
+	})
+
+	// Dial the first hop over TCP
+	conn, err := dialSSHServer(ctx, hops[0].Host, hops[0].Port, options.ProxyURL, options.DialTimeout, options.KeepaliveInterval)
+	if err != nil {
+		return nil, nil, wrapHopError(err, hops, 0)
+	}
+
+	// Establish an SSH connection with each hop, tunneling each connection through the previous one
+	clients := make([]*gossh.Client, 0, len(hops))
+	closeClients := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			_ = clients[i].Close()
+		}
+		_ = conn.Close()
+	}
+
+	for i, hop := range hops {
+		hostport := net.JoinHostPort(hop.Host, strconv.Itoa(hop.Port))
+
+		var hopConn net.Conn = conn
+		if i > 0 {
+			logger.With(zap.String("addr", hostport)).Debugf("Dial %s through jump host", hostport)
+			if hopConn, err = clients[i-1].Dial("tcp", hostport); err != nil {
+				closeClients()
+				return nil, nil, wrapHopError(errors.Wrap(err, "failed to connect to remote server"), hops, i)
+			}
+		}
+
+		client, err := newSSHClientConn(ctx, hopConn, hostport, hop, options.HostKeyCallback, options.CryptoPolicy, options.OnHandshake)
+		if err != nil {
+			_ = hopConn.Close()
+			closeClients()
+			return nil, nil, wrapHopError(err, hops, i)
+		}
+		clients = append(clients, client)
+	}
+	sshClient := clients[len(clients)-1]
+
+	// Tear down the jump host connections once the bastion connection closes
+	if len(clients) > 1 {
+		go func() {
+			_ = sshClient.Wait()
+			closeClients()
+		}()
+	}
+
+	// Start sending keepalive packets to the upstream SSH server
+	//	Deadlines are applied to the underlying TCP connection, since that is shared by every hop
+	keepaliveErrors := make(chan error)
+	go func() {
+		if err := sshKeepalive(ctx, conn, sshClient, options.KeepaliveInterval, options.DialTimeout, options.OnKeepalive); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Errorw("Keepalive failed", zap.Error(err))
+				keepaliveErrors <- err
+			}
+		}
+	}()
+	return sshClient, keepaliveErrors, nil
+}
+
+// dialSSHServer opens a TCP connection to an SSH server, optionally through an egress proxy, and configures TCP
+// keepalive on it
+func dialSSHServer(ctx context.Context, host string, port int, proxyURL *url.URL, dialTimeout, keepaliveInterval time.Duration) (net.Conn, error) {
+	logger := log.FromContext(ctx).Named("SSH")
+
+	// Dial through the egress proxy, which resolves the address on our behalf
+	if proxyURL != nil {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		logger.With(
+			zap.String("addr", addr),
+			zap.String("proxy", proxyURL.Redacted()),
+		).Debugf("Dial %s through proxy", addr)
+
+		conn, err := dialProxy(ctx, proxyURL, addr, dialTimeout, keepaliveInterval)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to remote server through proxy")
+		}
+		return conn, nil
+	}
 
 	// Validate the address
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(options.Host, strconv.Itoa(options.Port)))
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "resolve address")
+		return nil, errors.Wrap(err, "resolve address")
 	}
 
 	// Dial remote SSH server
 	logger.With(zap.String("addr", addr.String())).Debugf("Dial %s", addr.String())
 	conn, err := net.DialTCP("tcp", nil, addr)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to connect to remote server")
+		return nil, errors.Wrap(err, "failed to connect to remote server")
 	}
 
 	// Configure TCP keepalive for SSH connection
-	logger.Debugw("Set TCP keepalive", zap.Duration("interval", options.KeepaliveInterval))
+	logger.Debugw("Set TCP keepalive", zap.Duration("interval", keepaliveInterval))
 	if err := conn.SetKeepAlive(true); err != nil {
-		return nil, nil, errors.Wrap(err, "failed to enable keepalive")
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to enable keepalive")
 	}
-	if err := conn.SetKeepAlivePeriod(options.KeepaliveInterval); err != nil {
-		return nil, nil, errors.Wrap(err, "failed to set keepalive period")
+	if err := conn.SetKeepAlivePeriod(keepaliveInterval); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to set keepalive period")
 	}
 
-	// Get a list of key signers to use for authentication
-	logger.Debugw("Get key signers")
-	keySigners, err := options.GetKeySigners(ctx)
+	return conn, nil
+}
+
+// newSSHClientConn performs the SSH handshake and authentication over an established connection, and reports how
+// the handshake was negotiated to onHandshake
+func newSSHClientConn(
+	ctx context.Context,
+	conn net.Conn,
+	hostport string,
+	hop SSHJumpHostOptions,
+	hostKeyCallback gossh.HostKeyCallback,
+	cryptoPolicy CryptoPolicy,
+	onHandshake func(SSHHandshake),
+) (*gossh.Client, error) {
+	logger := log.FromContext(ctx).Named("SSH")
+	logger.With(
+		zap.String("user", hop.User),
+		zap.Dict("sshd", zap.String("addr", hostport)),
+	).Infof("Connect to ssh://%s@%s", hop.User, hostport)
+
+	handshake := SSHHandshake{Host: hostport}
+	authMethods, err := getSSHAuthMethods(ctx, hop, func(method string) {
+		handshake.AuthMethod = method
+	})
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "generate auth signers")
+		return nil, err
 	}
 
 	// Open client connection
 	logger.With(
-		zap.String("ssh_user", options.User),
-		zap.Int("ssh_auth_method_count", len(keySigners)),
-	).Debugf("Authenticating as user %s", options.User)
+		zap.String("ssh_user", hop.User),
+		zap.Int("ssh_auth_method_count", len(authMethods)),
+	).Debugf("Authenticating as user %s", hop.User)
+
+	// The unresolved host is passed along so that host keys and host certificates are verified against the
+	//	configured hostname rather than the IP address it resolved to.
+	recorder := newHandshakeRecorder(conn)
 	c, chans, reqs, err := gossh.NewClientConn(
-		conn, addr.String(),
+		recorder, hostport,
 		&gossh.ClientConfig{
-			User:            options.User,
-			Auth:            []gossh.AuthMethod{gossh.PublicKeys(keySigners...)},
-			HostKeyCallback: gossh.InsecureIgnoreHostKey(), // TODO: Fix
+			Config:            cryptoPolicy.config(),
+			User:              hop.User,
+			Auth:              authMethods,
+			HostKeyCallback:   recordHostKey(&handshake, hostKeyCallback),
+			HostKeyAlgorithms: cryptoPolicy.HostKeyAlgorithms,
 		},
 	)
+
+	// Report the handshake, whether or not it succeeded
+	recorder.describe(&handshake, true)
+	handshake.Time = time.Now()
+	if err != nil {
+		handshake.Error = err.Error()
+	}
+	if onHandshake != nil {
+		onHandshake(handshake)
+	}
+
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "establish SSH connection")
+		return nil, errors.Wrap(err, "establish SSH connection")
 	}
 	logger.Info("Client connection established")
-	sshClient := gossh.NewClient(c, chans, reqs)
 
-	// Start sending keepalive packets to the upstream SSH server
-	keepaliveErrors := make(chan error)
-	go func() {
-		if err := sshKeepalive(ctx, conn, sshClient, options.KeepaliveInterval, options.DialTimeout); err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				logger.Errorw("Keepalive failed", zap.Error(err))
-				keepaliveErrors <- err
+	return gossh.NewClient(c, chans, reqs), nil
+}
+
+// getSSHAuthMethods returns the auth methods for a hop, in order of preference. onAttempt is called with the name of
+// each method as it is attempted.
+//
+//	Public keys are always tried first. If a password is configured, password and keyboard-interactive auth are
+//	offered as a fallback, for bastions that don't support public keys.
+func getSSHAuthMethods(ctx context.Context, hop SSHJumpHostOptions, onAttempt func(method string)) ([]gossh.AuthMethod, error) {
+	logger := log.FromContext(ctx).Named("SSH")
+
+	// Get a list of key signers to use for authentication
+	logger.Debugw("Get key signers")
+	keySigners, err := hop.GetKeySigners(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate auth signers")
+	}
+
+	authMethods := []gossh.AuthMethod{gossh.PublicKeysCallback(func() ([]gossh.Signer, error) {
+		onAttempt("publickey")
+		return keySigners, nil
+	})}
+
+	if hop.GetPassword != nil {
+		password, err := hop.GetPassword(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "get password")
+		}
+		answerChallenge := keyboardInteractivePassword(password)
+		authMethods = append(authMethods,
+			gossh.PasswordCallback(func() (string, error) {
+				onAttempt("password")
+				return password, nil
+			}),
+			gossh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				onAttempt("keyboard-interactive")
+				return answerChallenge(user, instruction, questions, echos)
+			}),
+		)
+	}
+
+	return authMethods, nil
+}
+
+// keyboardInteractivePassword answers keyboard-interactive challenges with a password.
+//
+//	Bastions commonly implement password auth as a single keyboard-interactive prompt. Prompts which echo their
+//	input are not secrets, so we can't answer them.
+func keyboardInteractivePassword(password string) gossh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if echos[i] {
+				return nil, fmt.Errorf("unsupported keyboard-interactive prompt %q", questions[i])
 			}
+			answers[i] = password
 		}
-	}()
-	return sshClient, keepaliveErrors, nil
+		return answers, nil
+	}
+}
+
+// wrapHopError attributes a connection error to a specific hop, if the connection goes through jump hosts
+func wrapHopError(err error, hops []SSHJumpHostOptions, i int) error {
+	if len(hops) == 1 {
+		return err
+	}
+	return SSHHopError{
+		Hop:   i + 1,
+		Hops:  len(hops),
+		Host:  net.JoinHostPort(hops[i].Host, strconv.Itoa(hops[i].Port)),
+		Cause: err,
+	}
 }
 
 // sshKeepalive regularly sends a keepalive request and returns an error if there is a failure
-func sshKeepalive(ctx context.Context, conn net.Conn, client *gossh.Client, interval, timeout time.Duration) error {
+func sshKeepalive(ctx context.Context, conn net.Conn, client gossh.Conn, interval, timeout time.Duration, onKeepalive func(rtt time.Duration)) error {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -104,9 +350,13 @@ func sshKeepalive(ctx context.Context, conn net.Conn, client *gossh.Client, inte
 
 		case <-ticker.C:
 			// Only break out of the keepaliver if we get an error
-			if err := sshKeepalivePing(ctx, conn, client, timeout); err != nil {
+			rtt, err := sshKeepalivePing(ctx, conn, client, timeout)
+			if err != nil {
 				return err
 			}
+			if ctx.Err() == nil && onKeepalive != nil {
+				onKeepalive(rtt)
+			}
 
 			// Reset deadline to the predicted next tick, plus a one-second grace period.
 			if err := conn.SetDeadline(time.Now().Add(interval + (1 * time.Second))); err != nil {
@@ -116,14 +366,16 @@ func sshKeepalive(ctx context.Context, conn net.Conn, client *gossh.Client, inte
 	}
 }
 
-// sshKeepalivePing sends a keepalive message and waits for a response, using the gossh client libraries
-func sshKeepalivePing(ctx context.Context, conn net.Conn, client *gossh.Client, timeout time.Duration) error {
+// sshKeepalivePing sends a keepalive message and waits for a response, using the gossh client libraries.
+// It returns the round trip time of the keepalive.
+func sshKeepalivePing(ctx context.Context, conn net.Conn, client gossh.Conn, timeout time.Duration) (time.Duration, error) {
 	// Set deadline for request.
 	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
-		return errors.Wrap(err, "set conn deadline")
+		return 0, errors.Wrap(err, "set conn deadline")
 	}
 
-	result := make(chan error)
+	start := time.Now()
+	result := make(chan error, 1)
 	go func() {
 		// Keepalive over the SSH connection
 		_, _, err := client.SendRequest("keepalive@passage", true, nil)
@@ -132,8 +384,8 @@ func sshKeepalivePing(ctx context.Context, conn net.Conn, client *gossh.Client,
 
 	select {
 	case <-ctx.Done():
-		return nil
+		return 0, nil
 	case err := <-result:
-		return err
+		return time.Since(start), err
 	}
 }
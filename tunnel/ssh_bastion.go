@@ -0,0 +1,197 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"github.com/hightouchio/passage/log"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bastion selection strategies, for tunnels with more than one bastion
+const (
+	// BastionStrategyOrdered tries each bastion in turn, until one connects
+	BastionStrategyOrdered = "ordered"
+
+	// BastionStrategyParallel races connections to every bastion, happy-eyeballs style, and keeps the first to connect
+	BastionStrategyParallel = "parallel"
+)
+
+// bastionDialStagger is how long a parallel connection attempt waits for the previous bastion before starting
+const bastionDialStagger = 250 * time.Millisecond
+
+// SSHBastion is the address of a bastion
+type SSHBastion struct {
+	Host string `json:"sshHost"`
+	Port int    `json:"sshPort"`
+}
+
+func (b SSHBastion) String() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+func validateBastionStrategy(strategy string) error {
+	switch strategy {
+	case "", BastionStrategyOrdered, BastionStrategyParallel:
+		return nil
+	default:
+		return fmt.Errorf("bastionStrategy must be one of %q or %q", BastionStrategyOrdered, BastionStrategyParallel)
+	}
+}
+
+// SSHBastionError is returned when no bastion could be connected to. It wraps the error for each bastion.
+type SSHBastionError struct {
+	Bastions []SSHBastion
+	Causes   []error
+}
+
+func (e SSHBastionError) Error() string {
+	messages := make([]string, len(e.Bastions))
+	for i, bastion := range e.Bastions {
+		messages[i] = fmt.Sprintf("bastion %s: %s", bastion, e.Causes[i].Error())
+	}
+	return fmt.Sprintf("could not connect to any bastion: %s", strings.Join(messages, "; "))
+}
+
+func (e SSHBastionError) Unwrap() []error {
+	return e.Causes
+}
+
+// bastionConnection is a connection to one of a tunnel's bastions
+type bastionConnection struct {
+	client    *gossh.Client
+	keepalive <-chan error
+	bastion   SSHBastion
+
+	// hostKeys are the host keys that each hop presented, and that were accepted, while connecting
+	hostKeys []presentedHostKey
+}
+
+// newSSHClientToAnyBastion connects to the primary bastion or one of its alternates
+func newSSHClientToAnyBastion(ctx context.Context, options SSHClientOptions) (bastionConnection, error) {
+	bastions := append([]SSHBastion{{Host: options.Host, Port: options.Port}}, options.AlternateBastions...)
+
+	// Without alternates, there's nothing to choose between
+	if len(bastions) == 1 {
+		return connectSSHBastion(ctx, options, bastions[0])
+	}
+
+	if options.BastionStrategy == BastionStrategyParallel {
+		return raceSSHBastions(ctx, options, bastions)
+	}
+	return trySSHBastions(ctx, options, bastions)
+}
+
+// bastionAttempt is the result of connecting to a single bastion
+type bastionAttempt struct {
+	index int
+	conn  bastionConnection
+	err   error
+
+	// keep stops the attempt's connection from being cancelled when the race ends. It returns false if the
+	//	connection has already been cancelled.
+	keep func() bool
+}
+
+// connectSSHBastion connects to a single bastion. The connection's context is cancelled once it closes, so that a
+// connection which is abandoned doesn't leave its keepalive running.
+func connectSSHBastion(ctx context.Context, options SSHClientOptions, bastion SSHBastion) (bastionConnection, error) {
+	options.Host, options.Port = bastion.Host, bastion.Port
+
+	// Record the host keys presented during this attempt. Its hops are connected to one after another, so this
+	//	isn't shared with any other attempt.
+	var hostKeys []presentedHostKey
+	verifyHostKey := options.HostKeyCallback
+	options.HostKeyCallback = func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if err := verifyHostKey(hostname, remote, key); err != nil {
+			return err
+		}
+		hostKeys = append(hostKeys, presentedHostKey{hostname, remote, key})
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	client, keepalive, err := newSSHClientToBastion(ctx, options)
+	if err != nil {
+		cancel()
+		return bastionConnection{}, err
+	}
+	go func() {
+		_ = client.Wait()
+		cancel()
+	}()
+	return bastionConnection{client: client, keepalive: keepalive, bastion: bastion, hostKeys: hostKeys}, nil
+}
+
+// trySSHBastions tries each bastion in order, and returns the first that connects
+func trySSHBastions(ctx context.Context, options SSHClientOptions, bastions []SSHBastion) (bastionConnection, error) {
+	logger := log.FromContext(ctx).Named("SSH")
+
+	causes := make([]error, len(bastions))
+	for i, bastion := range bastions {
+		conn, err := connectSSHBastion(ctx, options, bastion)
+		if err == nil {
+			return conn, nil
+		}
+		logger.With(zap.String("bastion", bastion.String()), zap.Error(err)).Warnf("Could not connect to bastion %s", bastion)
+		causes[i] = err
+	}
+	return bastionConnection{}, SSHBastionError{Bastions: bastions, Causes: causes}
+}
+
+// raceSSHBastions connects to every bastion, staggering the attempts, and returns the first that connects.
+// Attempts that are still connecting when one wins are cancelled, and connections that lose the race are closed.
+func raceSSHBastions(ctx context.Context, options SSHClientOptions, bastions []SSHBastion) (bastionConnection, error) {
+	raceCtx, cancelRace := context.WithCancel(ctx)
+	defer cancelRace()
+
+	attempts := make(chan bastionAttempt, len(bastions))
+	for i, bastion := range bastions {
+		go func(i int, bastion SSHBastion) {
+			select {
+			case <-raceCtx.Done():
+				attempts <- bastionAttempt{index: i, err: raceCtx.Err()}
+				return
+			case <-time.After(time.Duration(i) * bastionDialStagger):
+			}
+
+			// The attempt is cancelled along with the race, unless it wins, since the winning connection must outlive
+			//	the race
+			attemptCtx, cancelAttempt := context.WithCancel(ctx)
+			stop := context.AfterFunc(raceCtx, cancelAttempt)
+
+			conn, err := connectSSHBastion(attemptCtx, options, bastion)
+			attempts <- bastionAttempt{index: i, conn: conn, err: err, keep: stop}
+		}(i, bastion)
+	}
+
+	causes := make([]error, len(bastions))
+	for received := 0; received < len(bastions); received++ {
+		attempt := <-attempts
+		if attempt.err == nil && !attempt.keep() {
+			_ = attempt.conn.client.Close()
+			attempt.err = raceCtx.Err()
+		}
+		if attempt.err != nil {
+			causes[attempt.index] = attempt.err
+			continue
+		}
+
+		// We have a winner. Cancel the other attempts, and close every other connection as it comes in.
+		cancelRace()
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if loser := <-attempts; loser.conn.client != nil {
+					_ = loser.conn.client.Close()
+				}
+			}
+		}(len(bastions) - received - 1)
+
+		return attempt.conn, nil
+	}
+	return bastionConnection{}, SSHBastionError{Bastions: bastions, Causes: causes}
+}
@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewSSHClient_BastionFailover(t *testing.T) {
+	for _, strategy := range []string{BastionStrategyOrdered, BastionStrategyParallel} {
+		t.Run(strategy, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			host, port := startTestSSHServer(t)
+
+			// The primary bastion is not listening
+			options := testClientOptions(t, "127.0.0.1", getFreePort())
+			options.AlternateBastions = []SSHBastion{{Host: host, Port: port}}
+			options.BastionStrategy = strategy
+
+			conn, err := newSSHClientToAnyBastion(ctx, options)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.client.Close()
+			assert.Equal(t, SSHBastion{Host: host, Port: port}, conn.bastion)
+		})
+	}
+}
+
+func TestNewSSHClient_BastionRaceHostKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both bastions accept connections, so they both present host keys
+	primaryHost, primaryPort := startTestSSHServer(t)
+	alternateHost, alternatePort := startTestSSHServer(t)
+	options := testClientOptions(t, primaryHost, primaryPort)
+	options.AlternateBastions = []SSHBastion{{Host: alternateHost, Port: alternatePort}}
+	options.BastionStrategy = BastionStrategyParallel
+
+	conn, err := newSSHClientToAnyBastion(ctx, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.client.Close()
+
+	// Only the winner's host key is kept
+	if assert.Len(t, conn.hostKeys, 1) {
+		assert.Equal(t, conn.bastion.String(), conn.hostKeys[0].hostname)
+	}
+
+	// The winning connection outlives the race
+	session, err := conn.client.NewSession()
+	if assert.NoError(t, err) {
+		session.Close()
+	}
+}
+
+func TestNewSSHClient_AllBastionsFail(t *testing.T) {
+	for _, strategy := range []string{BastionStrategyOrdered, BastionStrategyParallel} {
+		t.Run(strategy, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			options := testClientOptions(t, "127.0.0.1", getFreePort())
+			options.AlternateBastions = []SSHBastion{{Host: "127.0.0.1", Port: getFreePort()}}
+			options.BastionStrategy = strategy
+
+			_, _, err := NewSSHClient(ctx, options)
+
+			// Every bastion's failure should be reported
+			var bastionErr SSHBastionError
+			if assert.ErrorAs(t, err, &bastionErr) {
+				assert.Len(t, bastionErr.Causes, 2)
+				for _, cause := range bastionErr.Causes {
+					assert.Error(t, cause)
+				}
+			}
+		})
+	}
+}
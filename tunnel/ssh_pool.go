@@ -0,0 +1,262 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"time"
+)
+
+// SSHClientPool shares SSH client connections between normal tunnels that connect to the same bastion with the same
+// credentials. Connections are reference counted, and are closed once the last tunnel releases them.
+type SSHClientPool struct {
+	clients map[string]*pooledSSHClient
+	lock    sync.Mutex
+}
+
+func NewSSHClientPool() *SSHClientPool {
+	return &SSHClientPool{clients: make(map[string]*pooledSSHClient)}
+}
+
+// pooledSSHClient is a single shared SSH connection
+type pooledSSHClient struct {
+	key       string
+	client    *gossh.Client
+	bastion   SSHBastion
+	handshake SSHHandshake
+	hostKeys  []presentedHostKey
+	refs      int
+
+	// ready is closed once the connection attempt has completed, successfully or not
+	ready chan struct{}
+
+	// done is closed once the connection has ended, and err records why
+	done      chan struct{}
+	err       error
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	// rtt is the round trip time of the last keepalive. rttUpdated is closed, and replaced, each time it is measured.
+	rtt        time.Duration
+	rttUpdated chan struct{}
+	rttLock    sync.Mutex
+}
+
+// presentedHostKey is a host key that was presented by an SSH server while the connection was established
+type presentedHostKey struct {
+	hostname string
+	remote   net.Addr
+	key      gossh.PublicKey
+}
+
+// SSHClientLease is a reference to a shared SSH client. It must be released once the tunnel is done with it.
+type SSHClientLease struct {
+	*gossh.Client
+
+	pool        *SSHClientPool
+	entry       *pooledSSHClient
+	releaseOnce sync.Once
+}
+
+// Done is closed when the shared connection ends, for any tenant
+func (l *SSHClientLease) Done() <-chan struct{} {
+	return l.entry.done
+}
+
+// Err returns the reason the shared connection ended. It is only valid once Done is closed.
+func (l *SSHClientLease) Err() error {
+	return l.entry.err
+}
+
+// Bastion returns the bastion that the shared connection is connected to
+func (l *SSHClientLease) Bastion() SSHBastion {
+	return l.entry.bastion
+}
+
+// Handshake returns how the shared connection to the bastion was negotiated
+func (l *SSHClientLease) Handshake() SSHHandshake {
+	return l.entry.handshake
+}
+
+// RTT returns the round trip time of the shared connection's last keepalive, or zero if none has completed yet, and a
+// channel that is closed when the next keepalive completes
+func (l *SSHClientLease) RTT() (time.Duration, <-chan struct{}) {
+	l.entry.rttLock.Lock()
+	defer l.entry.rttLock.Unlock()
+	return l.entry.rtt, l.entry.rttUpdated
+}
+
+// Release returns the client to the pool
+func (l *SSHClientLease) Release() {
+	l.releaseOnce.Do(func() {
+		l.pool.release(l.entry)
+	})
+}
+
+var errSSHClientReleased = errors.New("SSH connection released")
+
+// Get borrows a connection for the given key from the pool, establishing it with options if necessary.
+//
+//	Tunnels that share a connection still verify the host keys that were presented when it was established with their
+//	own HostKeyCallback, so one tunnel's known hosts can never vouch for another's.
+func (p *SSHClientPool) Get(ctx context.Context, key string, options SSHClientOptions) (*SSHClientLease, error) {
+	p.lock.Lock()
+	entry, ok := p.clients[key]
+	if !ok {
+		entry = &pooledSSHClient{
+			key:        key,
+			ready:      make(chan struct{}),
+			done:       make(chan struct{}),
+			rttUpdated: make(chan struct{}),
+		}
+		p.clients[key] = entry
+	}
+	entry.refs++
+	p.lock.Unlock()
+
+	// We are the first tenant, so we are responsible for establishing the connection
+	if !ok {
+		if err := p.connect(ctx, entry, options); err != nil {
+			p.release(entry)
+			return nil, err
+		}
+		return &SSHClientLease{Client: entry.client, pool: p, entry: entry}, nil
+	}
+
+	// Wait for the connection to be established by another tenant
+	select {
+	case <-ctx.Done():
+		p.release(entry)
+		return nil, ctx.Err()
+	case <-entry.ready:
+	}
+	if entry.client == nil {
+		p.release(entry)
+		return nil, entry.err
+	}
+
+	for _, hostKey := range entry.hostKeys {
+		if err := options.HostKeyCallback(hostKey.hostname, hostKey.remote, hostKey.key); err != nil {
+			p.release(entry)
+			return nil, errors.Wrap(err, "verify shared connection host key")
+		}
+	}
+
+	return &SSHClientLease{Client: entry.client, pool: p, entry: entry}, nil
+}
+
+// connect establishes the shared connection, and watches it for failures
+func (p *SSHClientPool) connect(ctx context.Context, entry *pooledSSHClient, options SSHClientOptions) error {
+	defer close(entry.ready)
+
+	// Record the handshake with each host, so that every tenant can report the bastion's.
+	//	Bastions may be connected to in parallel, so this is locked.
+	var recordLock sync.Mutex
+	handshakes := make(map[string]SSHHandshake)
+	onHandshake := options.OnHandshake
+	options.OnHandshake = func(handshake SSHHandshake) {
+		recordLock.Lock()
+		handshakes[handshake.Host] = handshake
+		recordLock.Unlock()
+		if onHandshake != nil {
+			onHandshake(handshake)
+		}
+	}
+
+	// Fan out keepalive round trip times to every tenant
+	options.OnKeepalive = func(rtt time.Duration) {
+		entry.rttLock.Lock()
+		defer entry.rttLock.Unlock()
+		entry.rtt = rtt
+		close(entry.rttUpdated)
+		entry.rttUpdated = make(chan struct{})
+	}
+
+	// The connection outlives the tunnel that established it, so it must not be cancelled along with it
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	conn, err := newSSHClientToAnyBastion(ctx, options)
+	if err != nil {
+		cancel()
+		entry.err = err
+
+		// Make sure the next tenant attempts a new connection
+		p.lock.Lock()
+		if p.clients[entry.key] == entry {
+			delete(p.clients, entry.key)
+		}
+		p.lock.Unlock()
+		return err
+	}
+	entry.client = conn.client
+	entry.bastion = conn.bastion
+	recordLock.Lock()
+	entry.handshake = handshakes[conn.bastion.String()]
+	recordLock.Unlock()
+
+	// Only the host keys presented on the winning connection are verified by other tenants
+	entry.hostKeys = conn.hostKeys
+	entry.cancel = cancel
+
+	// Fan out connection failures to every tenant
+	go func() {
+		closed := make(chan error, 1)
+		go func() {
+			closed <- conn.client.Wait()
+		}()
+
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+
+		case keepaliveErr, ok := <-conn.keepalive:
+			if !ok {
+				return
+			}
+			err = errors.Wrap(keepaliveErr, "SSH keepalive failed")
+
+		case waitErr := <-closed:
+			err = errors.New("SSH connection closed")
+			if waitErr != nil {
+				err = errors.Wrap(waitErr, "SSH connection closed")
+			}
+		}
+
+		p.close(entry, err)
+	}()
+
+	return nil
+}
+
+// release drops a reference to the connection, and closes it if it was the last one
+func (p *SSHClientPool) release(entry *pooledSSHClient) {
+	p.lock.Lock()
+	entry.refs--
+	last := entry.refs == 0
+	if last && p.clients[entry.key] == entry {
+		delete(p.clients, entry.key)
+	}
+	p.lock.Unlock()
+
+	if last && entry.client != nil {
+		p.close(entry, errSSHClientReleased)
+	}
+}
+
+// close shuts down the connection and notifies all tenants
+func (p *SSHClientPool) close(entry *pooledSSHClient, err error) {
+	entry.closeOnce.Do(func() {
+		p.lock.Lock()
+		if p.clients[entry.key] == entry {
+			delete(p.clients, entry.key)
+		}
+		p.lock.Unlock()
+
+		entry.err = err
+		close(entry.done)
+		entry.cancel()
+		_ = entry.client.Close()
+	})
+}
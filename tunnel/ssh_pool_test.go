@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/stats"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSSHClientPool_Share(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var connections atomic.Int32
+	host, port := startTestSSHServer(t, func(server *ssh.Server) error {
+		server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+			connections.Add(1)
+			return conn
+		}
+		return nil
+	})
+	options := testClientOptions(t, host, port)
+
+	pool := NewSSHClientPool()
+	first, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	second, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Both tunnels should share the same connection
+	assert.Same(t, first.Client, second.Client)
+	assert.EqualValues(t, 1, connections.Load())
+
+	// The connection should stay open until the last tunnel releases it
+	first.Release()
+	select {
+	case <-second.Done():
+		t.Fatal("connection closed while still in use")
+	default:
+	}
+
+	second.Release()
+	select {
+	case <-second.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed after release")
+	}
+
+	// A new connection is established once the old one is closed
+	third, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer third.Release()
+	assert.NotSame(t, first.Client, third.Client)
+}
+
+func TestSSHClientPool_FanOutFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host, port := startTestSSHServer(t)
+	options := testClientOptions(t, host, port)
+
+	pool := NewSSHClientPool()
+	first, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer first.Release()
+	second, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer second.Release()
+
+	// Simulate the connection dropping
+	_ = first.Client.Conn.Close()
+
+	for _, lease := range []*SSHClientLease{first, second} {
+		select {
+		case <-lease.Done():
+			assert.ErrorContains(t, lease.Err(), "SSH connection closed")
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection failure was not reported to every tunnel")
+		}
+	}
+}
+
+func TestSSHClientPool_KeepaliveRTT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	host, port := startTestSSHServer(t)
+	options := testClientOptions(t, host, port)
+	options.KeepaliveInterval = 10 * time.Millisecond
+
+	pool := NewSSHClientPool()
+	first, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer first.Release()
+	second, err := pool.Get(ctx, "bastion", options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer second.Release()
+
+	// Every tenant is notified of each keepalive
+	for _, lease := range []*SSHClientLease{first, second} {
+		_, updated := lease.RTT()
+		select {
+		case <-updated:
+		case <-time.After(5 * time.Second):
+			t.Fatal("keepalive round trip time was not reported")
+		}
+		rtt, _ := lease.RTT()
+		assert.Greater(t, rtt, time.Duration(0))
+	}
+
+	// The tunnel is degraded once its keepalives are slower than the threshold
+	tunnel := NormalTunnel{clientOptions: SSHClientOptions{KeepaliveDegradedThreshold: time.Nanosecond}}
+	assert.Equal(t, StatusDegraded, tunnel.onlineStatus(first).Status)
+	tunnel.clientOptions.KeepaliveDegradedThreshold = time.Hour
+	assert.Equal(t, StatusReady, tunnel.onlineStatus(first).Status)
+	tunnel.clientOptions.KeepaliveDegradedThreshold = 0
+	assert.Equal(t, StatusReady, tunnel.onlineStatus(first).Status)
+}
+
+// testKeepaliveSQL records the keepalive round trip times that are saved
+type testKeepaliveSQL struct {
+	testNormalTunnelSQL
+	rtts chan time.Duration
+}
+
+func (s testKeepaliveSQL) SetTunnelKeepalive(ctx context.Context, tunnelID uuid.UUID, rtt time.Duration) error {
+	s.rtts <- rtt
+	return nil
+}
+
+func TestNormalTunnel_ReportKeepalives(t *testing.T) {
+	ctx, cancel := context.WithCancel(stats.InjectContext(context.Background(), stats.New(&statsd.NoOpClient{})))
+	defer cancel()
+
+	entry := &pooledSSHClient{rttUpdated: make(chan struct{})}
+	keepalive := func(rtt time.Duration) {
+		entry.rttLock.Lock()
+		defer entry.rttLock.Unlock()
+		entry.rtt = rtt
+		close(entry.rttUpdated)
+		entry.rttUpdated = make(chan struct{})
+	}
+
+	sql := testKeepaliveSQL{rtts: make(chan time.Duration, 10)}
+	tunnel := NormalTunnel{
+		clientOptions: SSHClientOptions{KeepaliveDegradedThreshold: 100 * time.Millisecond},
+		services:      NormalTunnelServices{SQL: sql},
+	}
+	statusUpdates := make(chan StatusUpdate)
+	go tunnel.reportKeepalives(ctx, &SSHClientLease{entry: entry}, statusUpdates)
+
+	// The first round trip time is saved. Keepalives are repeated until then, since the reporter may not be waiting
+	//	for the first one yet.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+waitSaved:
+	for {
+		keepalive(10 * time.Millisecond)
+		select {
+		case rtt := <-sql.rtts:
+			assert.Equal(t, 10*time.Millisecond, rtt)
+			break waitSaved
+		case <-ticker.C:
+		case <-timeout:
+			t.Fatal("keepalive was not saved")
+		}
+	}
+
+	// Later ones are only saved when the tunnel's status changes
+	for i := 0; i < 5; i++ {
+		keepalive(20 * time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+	}
+	keepalive(200 * time.Millisecond)
+	select {
+	case update := <-statusUpdates:
+		assert.Equal(t, StatusDegraded, update.Status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("degraded status was not reported")
+	}
+	assert.Equal(t, 200*time.Millisecond, <-sql.rtts)
+	assert.Empty(t, sql.rtts)
+}
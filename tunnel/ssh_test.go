@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startTestSSHServer starts an SSH server which accepts any public key and allows local port forwarding, to TCP
+// addresses and Unix sockets
+func startTestSSHServer(t *testing.T, options ...ssh.Option) (string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &ssh.Server{
+		Handler: func(session ssh.Session) {
+			<-session.Context().Done()
+		},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": ssh.DirectTCPIPHandler,
+
+			"direct-streamlocal@openssh.com": directStreamLocalHandler,
+		},
+		LocalPortForwardingCallback: func(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
+			return true
+		},
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return true
+		},
+	}
+	server.AddHostKey(newTestSigner(t))
+	for _, option := range options {
+		if err := server.SetOption(option); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return "127.0.0.1", portFromNetAddr(listener.Addr())
+}
+
+// directStreamLocalHandler forwards direct-streamlocal@openssh.com channels to Unix sockets
+func directStreamLocalHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var request struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &request); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	socketConn, err := net.Dial("unix", request.SocketPath)
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChan.Accept()
+	if err != nil {
+		socketConn.Close()
+		return
+	}
+	go gossh.DiscardRequests(requests)
+
+	go func() {
+		defer channel.Close()
+		defer socketConn.Close()
+		io.Copy(channel, socketConn)
+	}()
+	go func() {
+		defer channel.Close()
+		defer socketConn.Close()
+		io.Copy(socketConn, channel)
+	}()
+}
+
+func testClientOptions(t *testing.T, host string, port int) SSHClientOptions {
+	clientKey := newTestSigner(t)
+	return SSHClientOptions{
+		Host: host,
+		Port: port,
+		User: "passage",
+		GetKeySigners: func(ctx context.Context) ([]gossh.Signer, error) {
+			return []gossh.Signer{clientKey}, nil
+		},
+		HostKeyCallback:   gossh.InsecureIgnoreHostKey(),
+		DialTimeout:       5 * time.Second,
+		KeepaliveInterval: time.Minute,
+	}
+}
+
+func TestNewSSHClient_JumpHosts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jumpHost, jumpPort := startTestSSHServer(t)
+	bastionHost, bastionPort := startTestSSHServer(t)
+
+	var hostsSeen []string
+	options := testClientOptions(t, bastionHost, bastionPort)
+	options.HostKeyCallback = func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		hostsSeen = append(hostsSeen, hostname)
+		return nil
+	}
+	options.JumpHosts = []SSHJumpHostOptions{{
+		Host:          jumpHost,
+		Port:          jumpPort,
+		User:          "jump",
+		GetKeySigners: options.GetKeySigners,
+	}}
+
+	client, _, err := NewSSHClient(ctx, options)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	// Each hop should be verified, in order
+	assert.Equal(t, []string{
+		net.JoinHostPort(jumpHost, strconv.Itoa(jumpPort)),
+		net.JoinHostPort(bastionHost, strconv.Itoa(bastionPort)),
+	}, hostsSeen)
+}
+
+func TestNewSSHClient_JumpHostFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jumpHost, jumpPort := startTestSSHServer(t)
+
+	// The bastion is not listening
+	options := testClientOptions(t, "127.0.0.1", getFreePort())
+	options.JumpHosts = []SSHJumpHostOptions{{
+		Host:          jumpHost,
+		Port:          jumpPort,
+		User:          "jump",
+		GetKeySigners: options.GetKeySigners,
+	}}
+
+	_, _, err := NewSSHClient(ctx, options)
+
+	var hopErr SSHHopError
+	if assert.ErrorAs(t, err, &hopErr) {
+		assert.Equal(t, 2, hopErr.Hop)
+		assert.Equal(t, 2, hopErr.Hops)
+	}
+}
+
+func TestNewSSHClient_PasswordAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The server only supports password auth
+	host, port := startTestSSHServer(t, func(server *ssh.Server) error {
+		server.PublicKeyHandler = nil
+		server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+			return password == "hunter2"
+		}
+		return nil
+	})
+
+	options := testClientOptions(t, host, port)
+	_, _, err := NewSSHClient(ctx, options)
+	assert.Error(t, err, "should not authenticate without a password")
+
+	options.GetPassword = func(ctx context.Context) (string, error) {
+		return "hunter2", nil
+	}
+	client, _, err := NewSSHClient(ctx, options)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+}
+
+func TestNewSSHClient_KeyboardInteractiveAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The server only supports keyboard-interactive auth, with a single password prompt
+	host, port := startTestSSHServer(t, func(server *ssh.Server) error {
+		server.PublicKeyHandler = nil
+		server.KeyboardInteractiveHandler = func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			answers, err := challenger("", "", []string{"Password: "}, []bool{false})
+			return err == nil && len(answers) == 1 && answers[0] == "hunter2"
+		}
+		return nil
+	})
+
+	options := testClientOptions(t, host, port)
+	options.GetPassword = func(ctx context.Context) (string, error) {
+		return "hunter2", nil
+	}
+	client, _, err := NewSSHClient(ctx, options)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+}
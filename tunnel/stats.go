@@ -15,10 +15,25 @@ const (
 	StatTunnelUpstreamBytesSent     = "passage.tunnel.upstream.bytes_sent"
 	StatTunnelUpstreamBytesReceived = "passage.tunnel.upstream.bytes_rcvd"
 
+	// StatTunnelKeepaliveRTT is a histogram of the round trip time of SSH keepalives to the bastion, in milliseconds
+	StatTunnelKeepaliveRTT = "passage.tunnel.keepalive.rtt"
+
+	// StatTunnelDynamicConnectionRequests counts SOCKS requests to each destination of a dynamic tunnel, tagged with
+	//	whether the destination was allowed
+	StatTunnelDynamicConnectionRequests = "passage.tunnel.dynamic.connection_requests"
+
 	StatTunnelReverseForwardClientConnectionCount = "passage.tunnel.reverse.forward_client_connection_count"
 
 	StatSshdConnectionsRequests          = "passage.sshd.connection_requests"
 	StatSshReversePortForwardingRequests = "passage.sshd.forwarding_connection_requests"
+
+	// StatSshdConnectionRejections counts connections that were refused or closed before authenticating, tagged with
+	//	the reason. StatSshdConnectionsRequests counts each authentication attempt instead.
+	StatSshdConnectionRejections = "passage.sshd.connection_rejections"
+
+	// StatSshdSourceRejections counts the tunnels that clients were refused because their source address isn't
+	//	allowed, tagged with whether they were refused at authentication or port forwarding
+	StatSshdSourceRejections = "passage.sshd.source_rejections"
 )
 
 // Standardized metric reporting interval
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"context"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/hightouchio/passage/log"
 	"github.com/hightouchio/passage/tunnel/discovery"
@@ -16,6 +17,9 @@ const (
 	StatusBooting Status = "booting"
 	StatusReady   Status = "ready"
 	StatusError   Status = "error"
+
+	// StatusDegraded is a tunnel that is online, but slow
+	StatusDegraded Status = "degraded"
 )
 
 type StatusUpdate struct {
@@ -73,7 +77,7 @@ func statusHealthcheck(ctx context.Context, tunnel Tunnel, log *log.Logger, serv
 				// Map tunnel status to healthcheck status
 				var status discovery.HealthcheckStatus
 				switch update.Status {
-				case StatusBooting:
+				case StatusBooting, StatusDegraded:
 					status = discovery.HealthcheckWarning
 				case StatusReady:
 					status = discovery.HealthcheckPassing
@@ -102,12 +106,37 @@ func upstreamHealthcheck(
 	serviceDiscovery discovery.Service,
 	fn GetUpstreamFn,
 ) {
-	options := discovery.HealthcheckOptions{
+	runUpstreamHealthcheck(ctx, tunnel, log, serviceDiscovery, discovery.HealthcheckOptions{
 		ID:   upstreamHealthcheckID,
 		Name: upstreamHealthcheckName,
 		TTL:  upstreamHealthcheckTTL,
-	}
+	}, fn)
+}
+
+// namedServiceUpstreamHealthcheck reports the health of one of a tunnel's named upstream services to service discovery
+func namedServiceUpstreamHealthcheck(
+	ctx context.Context,
+	tunnel Tunnel,
+	name string,
+	log *log.Logger,
+	serviceDiscovery discovery.Service,
+	fn GetUpstreamFn,
+) {
+	runUpstreamHealthcheck(ctx, tunnel, log, serviceDiscovery, discovery.HealthcheckOptions{
+		ID:   fmt.Sprintf("%s-%s", upstreamHealthcheckID, name),
+		Name: fmt.Sprintf("%s (%s)", upstreamHealthcheckName, name),
+		TTL:  upstreamHealthcheckTTL,
+	}, fn)
+}
 
+func runUpstreamHealthcheck(
+	ctx context.Context,
+	tunnel Tunnel,
+	log *log.Logger,
+	serviceDiscovery discovery.Service,
+	options discovery.HealthcheckOptions,
+	fn GetUpstreamFn,
+) {
 	ticker := time.NewTicker(upstreamHealthcheckInterval)
 	defer ticker.Stop()
 
@@ -2,10 +2,18 @@ package tunnel
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
 	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 	"net"
+	"path"
+	"regexp"
+	"slices"
 )
 
 type Tunnel interface {
@@ -24,6 +32,7 @@ type TunnelType string
 const (
 	Normal  = "normal"
 	Reverse = "reverse"
+	Dynamic = "dynamic"
 )
 
 type CreateNormalTunnelRequest struct {
@@ -31,25 +40,353 @@ type CreateNormalTunnelRequest struct {
 
 	CreateKeyPair bool        `json:"createKeyPair"`
 	Keys          []uuid.UUID `json:"keys"`
+
+	// KeyType is the algorithm of the generated key pair, if CreateKeyPair is set
+	KeyType KeyType `json:"keyType"`
+
+	// Password is stored in the keystore and used for password and keyboard-interactive auth, for bastions
+	//	that don't support public keys
+	Password string `json:"password"`
+
+	// KnownHosts are known_hosts formatted entries to trust for the bastion
+	KnownHosts []string `json:"knownHosts"`
 }
 
 func (r CreateNormalTunnelRequest) Validate() error {
 	re := newRequestErrors()
-	if r.SSHHost == "" {
-		re.addError("sshHost is required")
+	for _, err := range validateServiceTarget("", r.ServiceHost, r.ServicePort, r.ServiceSocketPath) {
+		re.addError(err.Error())
+	}
+	if err := validateNamedServices(r.Services); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateUpstreamTargets(r.UpstreamTargets); err != nil {
+		re.addError(err.Error())
 	}
-	if r.ServiceHost == "" {
-		re.addError("serviceHost is required")
+	if len(r.UpstreamTargets) > 0 && r.ServiceSocketPath != "" {
+		re.addError("upstreamTargets cannot be combined with serviceSocketPath")
 	}
-	if r.ServicePort == 0 {
-		re.addError("servicePort is required")
+	if err := validateUpstreamPolicy(r.UpstreamPolicy); err != nil {
+		re.addError(err.Error())
 	}
+	r.validateConnection(re)
 	if re.IsEmpty() {
 		return nil
 	}
 	return re
 }
 
+// validateConnection validates how the tunnel connects and authenticates to its bastion
+func (r CreateNormalTunnelRequest) validateConnection(re *requestErrors) {
+	if r.SSHHost == "" {
+		re.addError("sshHost is required")
+	}
+	if err := validateKeyType(r.KeyType); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateAlternateBastions(r.AlternateBastions); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateBastionStrategy(r.BastionStrategy); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateJumpHosts(r.JumpHosts); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateJumpHostKeys(r.JumpHosts, r.Keys); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateHostKeyVerification(r.HostKeyVerification); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateProxyURL(r.ProxyURL); err != nil {
+		re.addError(err.Error())
+	}
+	if err := ValidateCryptoPolicy(r.CryptoPolicy); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateKnownHosts(r.KnownHosts); err != nil {
+		re.addError(err.Error())
+	}
+}
+
+// validateServiceTarget validates that a service is either a host and port, or a Unix socket
+func validateServiceTarget(prefix, serviceHost string, servicePort int, serviceSocketPath string) []error {
+	var errs []error
+	if serviceSocketPath != "" {
+		// Tunnels to a Unix socket don't have a host and port
+		if serviceHost != "" || servicePort != 0 {
+			errs = append(errs, fmt.Errorf("%sserviceSocketPath cannot be combined with serviceHost or servicePort", prefix))
+		}
+		if !path.IsAbs(serviceSocketPath) {
+			errs = append(errs, fmt.Errorf("%sserviceSocketPath must be an absolute path", prefix))
+		}
+	} else {
+		if serviceHost == "" {
+			errs = append(errs, fmt.Errorf("%sserviceHost is required", prefix))
+		}
+		if servicePort == 0 {
+			errs = append(errs, fmt.Errorf("%sservicePort is required", prefix))
+		}
+	}
+	return errs
+}
+
+// namedServicePattern restricts service names to characters that are safe in service discovery IDs
+var namedServicePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// validateNamedServices validates that every named service has a unique name and a target
+func validateNamedServices(services []NamedService) error {
+	names := make(map[string]bool, len(services))
+	for i, service := range services {
+		if !namedServicePattern.MatchString(service.Name) {
+			return fmt.Errorf("services[%d].name must contain only lowercase letters, numbers, dashes, and underscores", i)
+		}
+		if names[service.Name] {
+			return fmt.Errorf("services[%d].name %q is not unique", i, service.Name)
+		}
+		names[service.Name] = true
+
+		if errs := validateServiceTarget(fmt.Sprintf("services[%d].", i), service.ServiceHost, service.ServicePort, service.ServiceSocketPath); len(errs) > 0 {
+			return errs[0]
+		}
+	}
+	return nil
+}
+
+// parseUpstreamTargetsField converts a raw JSON update field into a validated list of upstream targets
+func parseUpstreamTargetsField(field interface{}) ([]UpstreamTarget, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []UpstreamTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, errors.Wrap(err, "invalid upstreamTargets")
+	}
+	if err := validateUpstreamTargets(targets); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// parseNamedServicesField converts a raw JSON update field into a validated list of named services
+func parseNamedServicesField(field interface{}) ([]NamedService, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []NamedService
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, errors.Wrap(err, "invalid services")
+	}
+	if err := validateNamedServices(services); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+// parseAllowedDestinationsField converts a raw JSON update field into a validated dynamic tunnel allowlist
+func parseAllowedDestinationsField(field interface{}) ([]AllowedDestination, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var destinations []AllowedDestination
+	if err := json.Unmarshal(data, &destinations); err != nil {
+		return nil, errors.Wrap(err, "invalid allowedDestinations")
+	}
+	if err := validateAllowedDestinations(destinations); err != nil {
+		return nil, err
+	}
+
+	return destinations, nil
+}
+
+// validateAlternateBastions validates that every alternate bastion has a host to connect to
+func validateAlternateBastions(bastions []SSHBastion) error {
+	for i, bastion := range bastions {
+		if bastion.Host == "" {
+			return fmt.Errorf("alternateBastions[%d].sshHost is required", i)
+		}
+	}
+	return nil
+}
+
+// setBastionDefaults sets the default SSH port on alternate bastions
+func setBastionDefaults(bastions []SSHBastion) {
+	for i := range bastions {
+		if bastions[i].Port == 0 {
+			bastions[i].Port = defaultSSHPort
+		}
+	}
+}
+
+// parseAlternateBastionsField converts a raw JSON update field into a validated list of alternate bastions
+func parseAlternateBastionsField(field interface{}) ([]SSHBastion, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var bastions []SSHBastion
+	if err := json.Unmarshal(data, &bastions); err != nil {
+		return nil, errors.Wrap(err, "invalid alternateBastions")
+	}
+	if err := validateAlternateBastions(bastions); err != nil {
+		return nil, err
+	}
+	setBastionDefaults(bastions)
+
+	return bastions, nil
+}
+
+// validateJumpHosts validates that every jump host has a host to connect to
+func validateJumpHosts(jumpHosts []JumpHost) error {
+	for i, jumpHost := range jumpHosts {
+		if jumpHost.SSHHost == "" {
+			return fmt.Errorf("jumpHosts[%d].sshHost is required", i)
+		}
+	}
+	return nil
+}
+
+// validateJumpHostKeys validates that jump hosts only authenticate with the tunnel's own keys, so that a tunnel can't
+// present another tunnel's private key to a jump host
+func validateJumpHostKeys(jumpHosts []JumpHost, tunnelKeys []uuid.UUID) error {
+	for i, jumpHost := range jumpHosts {
+		for _, keyID := range jumpHost.Keys {
+			if !slices.Contains(tunnelKeys, keyID) {
+				return fmt.Errorf("jumpHosts[%d].keys: key %s is not one of the tunnel's keys", i, keyID)
+			}
+		}
+	}
+	return nil
+}
+
+// setJumpHostDefaults sets the default SSH port on jump hosts
+func setJumpHostDefaults(jumpHosts []JumpHost) {
+	for i := range jumpHosts {
+		if jumpHosts[i].SSHPort == 0 {
+			jumpHosts[i].SSHPort = defaultSSHPort
+		}
+	}
+}
+
+// parseJumpHostsField converts a raw JSON update field into a validated list of jump hosts
+func parseJumpHostsField(field interface{}) ([]JumpHost, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var jumpHosts []JumpHost
+	if err := json.Unmarshal(data, &jumpHosts); err != nil {
+		return nil, errors.Wrap(err, "invalid jumpHosts")
+	}
+	if err := validateJumpHosts(jumpHosts); err != nil {
+		return nil, err
+	}
+	setJumpHostDefaults(jumpHosts)
+
+	return jumpHosts, nil
+}
+
+// parseCryptoPolicyField converts a raw JSON update field into a CryptoPolicy, and validates it
+func parseCryptoPolicyField(field interface{}) (CryptoPolicy, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return CryptoPolicy{}, err
+	}
+
+	var policy CryptoPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return CryptoPolicy{}, errors.Wrap(err, "invalid cryptoPolicy")
+	}
+	if err := ValidateCryptoPolicy(policy); err != nil {
+		return CryptoPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+// parseStringsField converts a raw JSON update field into a list of strings
+func parseStringsField(field interface{}) ([]string, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return nil, err
+	}
+
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return nil, err
+	}
+	return strs, nil
+}
+
+// parseIntField converts a raw JSON update field into an integer
+func parseIntField(field interface{}) (int, error) {
+	data, err := json.Marshal(field)
+	if err != nil {
+		return 0, err
+	}
+
+	var i int
+	if err := json.Unmarshal(data, &i); err != nil {
+		return 0, err
+	}
+	return i, nil
+}
+
+// deletePassword removes a tunnel password from the keystore, if there is one. Failures are only logged, since the
+// tunnel no longer refers to the password.
+func (s API) deletePassword(ctx context.Context, passwordKeyID *uuid.UUID) {
+	if passwordKeyID == nil {
+		return
+	}
+	if err := s.Keystore.Delete(ctx, *passwordKeyID); err != nil {
+		log.FromContext(ctx).Warnw("Delete password", zap.String("password_key_id", passwordKeyID.String()), zap.Error(err))
+	}
+}
+
+// getPasswordKeyID returns the ID of a tunnel's password in the keystore, if it has one
+func getPasswordKeyID(tunnel Tunnel) *uuid.UUID {
+	switch t := tunnel.(type) {
+	case NormalTunnel:
+		return t.PasswordKeyID
+	case DynamicTunnel:
+		return t.PasswordKeyID
+	default:
+		return nil
+	}
+}
+
+// normalTunnelOf returns the SSH configuration of a normal or dynamic tunnel
+func normalTunnelOf(tunnel Tunnel) NormalTunnel {
+	switch t := tunnel.(type) {
+	case NormalTunnel:
+		return t
+	case DynamicTunnel:
+		return t.NormalTunnel
+	default:
+		return NormalTunnel{}
+	}
+}
+
+// setPassword stores a tunnel password in the keystore and returns its ID
+func (s API) setPassword(ctx context.Context, password string) (uuid.UUID, error) {
+	keyID := uuid.New()
+	if err := s.Keystore.Set(ctx, keyID, []byte(password)); err != nil {
+		return uuid.UUID{}, errors.Wrap(err, "could not set password")
+	}
+	return keyID, nil
+}
+
 type CreateNormalTunnelResponse struct {
 	Tunnel `json:"tunnel"`
 
@@ -63,54 +400,160 @@ func (s API) CreateNormalTunnel(ctx context.Context, request CreateNormalTunnelR
 		return nil, err
 	}
 
+	record, publicKey, err := s.createNormalTunnel(ctx, request, func(record *postgres.NormalTunnel) {})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateNormalTunnelResponse{Tunnel: normalTunnelFromSQL(record), PublicKey: publicKey}, nil
+}
+
+// createNormalTunnel inserts a tunnel that connects to a bastion, with its keys and known hosts, and returns the
+// public key of any generated key pair. setFields customizes the record before insertion.
+func (s API) createNormalTunnel(ctx context.Context, request CreateNormalTunnelRequest, setFields func(*postgres.NormalTunnel)) (_ postgres.NormalTunnel, _ *string, err error) {
 	// set default SSH port
 	if request.SSHPort == 0 {
 		request.SSHPort = defaultSSHPort
 	}
+	setJumpHostDefaults(request.JumpHosts)
+	setBastionDefaults(request.AlternateBastions)
+	if request.BastionStrategy == "" {
+		request.BastionStrategy = BastionStrategyOrdered
+	}
+
+	// fail over between upstream targets unless otherwise specified
+	if request.UpstreamPolicy == "" {
+		request.UpstreamPolicy = UpstreamPolicyFailover
+	}
+
+	// trust the bastion's host key on first use unless otherwise specified
+	if request.HostKeyVerification == "" {
+		request.HostKeyVerification = HostKeyVerificationTOFU
+	}
+
+	// store the password in the keystore, rather than the tunnel record
+	if request.Password != "" {
+		passwordKeyID, err := s.setPassword(ctx, request.Password)
+		if err != nil {
+			return postgres.NormalTunnel{}, nil, err
+		}
+		request.PasswordKeyID = &passwordKeyID
+	}
+
+	// Delete the stored passwords if the tunnel can't be created, so that they aren't left in the keystore
+	defer func() {
+		if err != nil {
+			s.deletePassword(ctx, request.PasswordKeyID)
+			s.deletePassword(ctx, request.ProxyPasswordKeyID)
+		}
+	}()
+
+	// likewise, store the egress proxy's password in the keystore, rather than in the proxy URL
+	proxyURL, proxyPassword, err := splitProxyPassword(request.ProxyURL)
+	if err != nil {
+		return postgres.NormalTunnel{}, nil, err
+	}
+	request.ProxyURL = proxyURL
+	if proxyPassword != "" {
+		proxyPasswordKeyID, err := s.setPassword(ctx, proxyPassword)
+		if err != nil {
+			return postgres.NormalTunnel{}, nil, err
+		}
+		request.ProxyPasswordKeyID = &proxyPasswordKeyID
+	}
 
 	// insert into DB
-	record, err := s.SQL.CreateNormalTunnel(ctx, sqlFromNormalTunnel(request.NormalTunnel))
+	data := sqlFromNormalTunnel(request.NormalTunnel)
+	setFields(&data)
+	record, err := s.SQL.CreateNormalTunnel(ctx, data)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not insert")
+		return postgres.NormalTunnel{}, nil, errors.Wrap(err, "could not insert")
 	}
 
 	// add keys
 	for _, keyID := range request.Keys {
 		if err := s.SQL.AuthorizeKeyForTunnel(ctx, Normal, record.ID, keyID); err != nil {
-			return nil, errors.Wrapf(err, "could not add key %d", keyID)
+			return postgres.NormalTunnel{}, nil, errors.Wrapf(err, "could not add key %d", keyID)
 		}
 	}
 
-	tunnel := normalTunnelFromSQL(record)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not get connection details")
+	// add known hosts
+	if len(request.KnownHosts) > 0 {
+		if err := s.SQL.SetNormalTunnelKnownHosts(ctx, record.ID, request.KnownHosts); err != nil {
+			return postgres.NormalTunnel{}, nil, errors.Wrap(err, "could not add known hosts")
+		}
 	}
-	response := &CreateNormalTunnelResponse{Tunnel: tunnel}
 
 	// if requested, we will generate a keypair and return the public key to the user
 	if request.CreateKeyPair {
 		keyId := uuid.New()
-		keyPair, err := GenerateKeyPair()
+		keyPair, err := GenerateKeyPair(request.KeyType)
 		if err != nil {
-			return nil, errors.Wrap(err, "could not generate keypair")
+			return postgres.NormalTunnel{}, nil, errors.Wrap(err, "could not generate keypair")
 		}
 
 		// insert into Keystore
 		if err := s.Keystore.Set(ctx, keyId, keyPair.PrivateKey); err != nil {
-			return nil, errors.Wrap(err, "could not set key")
+			return postgres.NormalTunnel{}, nil, errors.Wrap(err, "could not set key")
 		}
 
 		// add to DB and attach to tunnel
 		if err := s.SQL.AuthorizeKeyForTunnel(ctx, Normal, record.ID, keyId); err != nil {
-			return nil, errors.Wrap(err, "could not auth key for tunnel")
+			return postgres.NormalTunnel{}, nil, errors.Wrap(err, "could not auth key for tunnel")
 		}
 
 		// return the public key to the user
 		keyString := string(keyPair.PublicKey)
-		response.PublicKey = &keyString
+		return record, &keyString, nil
+	}
+
+	return record, nil, nil
+}
+
+type CreateDynamicTunnelRequest struct {
+	CreateNormalTunnelRequest
+
+	// AllowedDestinations are the hosts and ports that clients of the tunnel may connect to
+	AllowedDestinations []AllowedDestination `json:"allowedDestinations"`
+}
+
+func (r CreateDynamicTunnelRequest) Validate() error {
+	re := newRequestErrors()
+	if r.ServiceHost != "" || r.ServicePort != 0 || r.ServiceSocketPath != "" || len(r.Services) > 0 || len(r.UpstreamTargets) > 0 {
+		re.addError("dynamic tunnels connect to allowedDestinations, rather than a service")
+	}
+	if err := validateAllowedDestinations(r.AllowedDestinations); err != nil {
+		re.addError(err.Error())
+	}
+	r.validateConnection(re)
+	if re.IsEmpty() {
+		return nil
 	}
+	return re
+}
 
-	return response, nil
+type CreateDynamicTunnelResponse struct {
+	Tunnel `json:"tunnel"`
+
+	PublicKey *string `json:"publicKey,omitempty"`
+}
+
+// CreateDynamicTunnel creates a tunnel that serves SOCKS5, and connects to the requested destinations through its
+// bastion. Dynamic tunnels are stored, and authorized keys attached, like normal tunnels.
+func (s API) CreateDynamicTunnel(ctx context.Context, request CreateDynamicTunnelRequest) (*CreateDynamicTunnelResponse, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	record, publicKey, err := s.createNormalTunnel(ctx, request.CreateNormalTunnelRequest, func(record *postgres.NormalTunnel) {
+		record.Dynamic = true
+		record.AllowedDestinations = sqlFromAllowedDestinations(request.AllowedDestinations)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateDynamicTunnelResponse{Tunnel: dynamicTunnelFromSQL(record), PublicKey: publicKey}, nil
 }
 
 type CreateReverseTunnelRequest struct {
@@ -118,6 +561,29 @@ type CreateReverseTunnelRequest struct {
 
 	Keys          []uuid.UUID `json:"keys"`
 	CreateKeyPair bool        `json:"createKeyPair"`
+
+	// KeyType is the algorithm of the generated key pair, if CreateKeyPair is set
+	KeyType KeyType `json:"keyType"`
+}
+
+func (r CreateReverseTunnelRequest) Validate() error {
+	re := newRequestErrors()
+	if err := validateKeyType(r.KeyType); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateClientPolicy(r.ClientPolicy); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateMaxClients(r.MaxClients); err != nil {
+		re.addError(err.Error())
+	}
+	if err := validateAllowedSourceCIDRs(r.AllowedSourceCIDRs); err != nil {
+		re.addError(err.Error())
+	}
+	if re.IsEmpty() {
+		return nil
+	}
+	return re
 }
 
 type CreateReverseTunnelResponse struct {
@@ -126,7 +592,27 @@ type CreateReverseTunnelResponse struct {
 }
 
 func (s API) CreateReverseTunnel(ctx context.Context, request CreateReverseTunnelRequest) (*CreateReverseTunnelResponse, error) {
-	var tunnelData postgres.ReverseTunnel
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Reject keys that can't be parsed, or whose authorized_keys options can't, since the tunnel would leave them out
+	for _, keyID := range request.Keys {
+		contents, err := s.Keystore.Get(ctx, keyID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read key %s", keyID.String())
+		}
+		if _, _, err := parseAuthorizedKey(contents); err != nil {
+			return nil, newRequestError("key %s: %s", keyID.String(), err.Error())
+		}
+	}
+
+	// spread connections across every client unless otherwise specified
+	tunnelData := postgres.ReverseTunnel{
+		ClientPolicy:       firstNotEmptyString(request.ClientPolicy, ClientPolicyRoundRobin),
+		MaxClients:         request.MaxClients,
+		AllowedSourceCIDRs: append(pq.StringArray{}, request.AllowedSourceCIDRs...),
+	}
 	var response CreateReverseTunnelResponse
 
 	// Default authorized keys to those provided in API request
@@ -135,7 +621,7 @@ func (s API) CreateReverseTunnel(ctx context.Context, request CreateReverseTunne
 	// If requested, we will generate a keypair and return the public key to the user
 	if request.CreateKeyPair {
 		keyId := uuid.New()
-		keyPair, err := GenerateKeyPair()
+		keyPair, err := GenerateKeyPair(request.KeyType)
 		if err != nil {
 			return nil, errors.Wrap(err, "could not generate keypair")
 		}
@@ -178,6 +664,10 @@ func findTunnel(ctx context.Context, sql sqlClient, id uuid.UUID) (Tunnel, Tunne
 	// Normal tunnel next
 	normalTunnel, err := sql.GetNormalTunnel(ctx, id)
 	if err == nil {
+		// Dynamic tunnels are stored alongside normal tunnels
+		if normalTunnel.Dynamic {
+			return dynamicTunnelFromSQL(normalTunnel), Dynamic, nil
+		}
 		return normalTunnelFromSQL(normalTunnel), Normal, nil
 	} else if err != postgres.ErrTunnelNotFound {
 		// internal server error
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/stats"
+	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/pkg/errors"
+	"net"
+	"slices"
+	"time"
+)
+
+// DynamicTunnel connects to a bastion like a NormalTunnel, but its listener speaks SOCKS5, so that clients can reach
+// any destination on the bastion's network that the tunnel's allowlist permits.
+type DynamicTunnel struct {
+	NormalTunnel
+
+	// AllowedDestinations are the hosts and ports that clients may connect to. Anything else is refused.
+	AllowedDestinations []AllowedDestination `json:"allowedDestinations"`
+}
+
+func (t DynamicTunnel) Start(ctx context.Context, listener *net.TCPListener, statusUpdate chan<- StatusUpdate) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	logger := log.FromContext(ctx)
+
+	allowlist, err := newDestinationAllowlist(t.AllowedDestinations)
+	if err != nil {
+		return errors.Wrap(err, "parse allowed destinations")
+	}
+
+	sshClient, err := t.connect(ctx, cancel, statusUpdate)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Release()
+
+	// If the context has been cancelled at this point in time, stop the tunnel.
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	// Create a SOCKSServer, which will dial each requested destination over the SSH connection
+	server := &SOCKSServer{
+		Listener:          listener,
+		Dial:              sshClient.Dial,
+		Allowlist:         allowlist,
+		KeepaliveInterval: 5 * time.Second,
+		Stats:             stats.GetStats(ctx),
+		logger:            logger.Named("SOCKS"),
+	}
+
+	logger.Debug("Starting SOCKS server")
+	go func() {
+		defer logger.Debug("SOCKS server stopped")
+		if err := server.Serve(ctx); err != nil {
+			// If it's simply a closed error, we can return without logging an error.
+			if !errors.Is(err, net.ErrClosed) {
+				cancel(errors.Wrap(err, "SOCKS serve"))
+			}
+		}
+	}()
+
+	// Continually report tunnel status until the tunnel shuts down
+	go intervalStatusReporter(ctx, statusUpdate, func() StatusUpdate {
+		return t.onlineStatus(sshClient)
+	})
+	go t.reportKeepalives(ctx, sshClient, statusUpdate)
+
+	<-ctx.Done()
+
+	// If the context was simply cancelled (with no error), return nil
+	//	If the context was cancelled with a real error, return that
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		return cause
+	} else {
+		return nil
+	}
+}
+
+func (t DynamicTunnel) Equal(v interface{}) bool {
+	t2, ok := v.(DynamicTunnel)
+	if !ok {
+		return false
+	}
+
+	return t.NormalTunnel.Equal(t2.NormalTunnel) &&
+		slices.EqualFunc(t.AllowedDestinations, t2.AllowedDestinations, AllowedDestination.Equal)
+}
+
+func (d AllowedDestination) Equal(d2 AllowedDestination) bool {
+	return d.Host == d2.Host && slices.Equal(d.Ports, d2.Ports)
+}
+
+func InjectDynamicTunnelDependencies(f func(ctx context.Context) ([]DynamicTunnel, error), services NormalTunnelServices, options SSHClientOptions) ListFunc {
+	return func(ctx context.Context) ([]Tunnel, error) {
+		dts, err := f(ctx)
+		if err != nil {
+			return []Tunnel{}, err
+		}
+		tunnels := make([]Tunnel, len(dts))
+		for i, dt := range dts {
+			dt.services = services
+			dt.clientOptions = options
+			tunnels[i] = dt
+		}
+		return tunnels, nil
+	}
+}
+
+func sqlFromAllowedDestinations(destinations []AllowedDestination) postgres.Destinations {
+	records := make(postgres.Destinations, len(destinations))
+	for i, destination := range destinations {
+		records[i] = postgres.Destination(destination)
+	}
+	return records
+}
+
+func allowedDestinationsFromSQL(records postgres.Destinations) []AllowedDestination {
+	destinations := make([]AllowedDestination, len(records))
+	for i, record := range records {
+		destinations[i] = AllowedDestination(record)
+	}
+	return destinations
+}
+
+// convert a SQL DB representation of a dynamic tunnel into the DynamicTunnel struct.
+// Dynamic tunnels are stored alongside normal tunnels, since they share their SSH configuration.
+func dynamicTunnelFromSQL(record postgres.NormalTunnel) DynamicTunnel {
+	return DynamicTunnel{
+		NormalTunnel:        normalTunnelFromSQL(record),
+		AllowedDestinations: allowedDestinationsFromSQL(record.AllowedDestinations),
+	}
+}
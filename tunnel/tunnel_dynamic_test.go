@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/stats"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/proxy"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDynamicTunnel_SOCKS(t *testing.T) {
+	ctx, cancel := context.WithCancel(stats.InjectContext(context.Background(), stats.New(&statsd.NoOpClient{})))
+	defer cancel()
+
+	sshHost, sshPort := startTestSSHServer(t)
+	allowedPort := startTestEchoServer(t, "allowed: ")
+	deniedPort := startTestEchoServer(t, "denied: ")
+
+	tunnel := DynamicTunnel{
+		NormalTunnel: NormalTunnel{
+			ID:            uuid.New(),
+			SSHHost:       sshHost,
+			SSHPort:       sshPort,
+			clientOptions: SSHClientOptions{User: "passage", DialTimeout: 5 * time.Second, KeepaliveInterval: time.Minute},
+			services:      newTestNormalTunnelServices(t),
+		},
+		AllowedDestinations: []AllowedDestination{
+			{Host: "127.0.0.0/8", Ports: []string{strconv.Itoa(allowedPort)}},
+		},
+	}
+
+	listener, err := newEphemeralTCPListener("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	statusUpdates := make(chan StatusUpdate)
+	ready := make(chan struct{})
+	go func() {
+		for update := range statusUpdates {
+			if update.Status == StatusReady {
+				select {
+				case <-ready:
+				default:
+					close(ready)
+				}
+			}
+		}
+	}()
+	go tunnel.Start(ctx, listener, statusUpdates)
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come online")
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", listener.Addr().String(), nil, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Allowed destinations are dialed through the bastion
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(allowedPort)))
+	if assert.NoError(t, err) {
+		_, _ = conn.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if assert.NoError(t, err) {
+			assert.Equal(t, "allowed: hello\n", line)
+		}
+		conn.Close()
+	}
+
+	// Destinations outside the allowlist are refused
+	_, err = dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(deniedPort)))
+	assert.ErrorContains(t, err, "not allowed")
+}
+
+func TestCreateDynamicTunnelRequest_Validate(t *testing.T) {
+	request := func(mutate func(*CreateDynamicTunnelRequest)) CreateDynamicTunnelRequest {
+		r := CreateDynamicTunnelRequest{
+			CreateNormalTunnelRequest: CreateNormalTunnelRequest{NormalTunnel: NormalTunnel{SSHHost: "bastion.example.com"}},
+			AllowedDestinations:       []AllowedDestination{{Host: "10.0.0.0/8", Ports: []string{"5432"}}},
+		}
+		mutate(&r)
+		return r
+	}
+
+	assert.NoError(t, request(func(r *CreateDynamicTunnelRequest) {}).Validate())
+	assert.Error(t, request(func(r *CreateDynamicTunnelRequest) { r.SSHHost = "" }).Validate())
+	assert.Error(t, request(func(r *CreateDynamicTunnelRequest) { r.AllowedDestinations = nil }).Validate())
+	assert.Error(t, request(func(r *CreateDynamicTunnelRequest) { r.ServiceHost = "db.internal" }).Validate())
+}
@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"github.com/hightouchio/passage/log"
@@ -10,12 +11,19 @@ import (
 	"github.com/hightouchio/passage/tunnel/keystore"
 	"io"
 	"net"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -30,8 +38,50 @@ type NormalTunnel struct {
 	ServiceHost string `json:"serviceHost"`
 	ServicePort int    `json:"servicePort"`
 
+	// ServiceSocketPath is a Unix socket on the bastion to forward to, instead of ServiceHost and ServicePort
+	ServiceSocketPath string `json:"serviceSocketPath,omitempty"`
+
+	// UpstreamTargets are additional hosts to forward to if the ServiceHost is unreachable, chosen according to
+	//	the UpstreamPolicy (failover or round-robin)
+	UpstreamTargets []UpstreamTarget `json:"upstreamTargets"`
+	UpstreamPolicy  string           `json:"upstreamPolicy"`
+
+	// Services are additional upstream services reachable through the same bastion. Each is served on its own
+	//	listener, and shares the tunnel's SSH connection.
+	Services []NamedService `json:"services"`
+
 	HealthcheckEnabled bool `json:"healthcheck_enabled"`
 
+	// AlternateBastions are connected to if the bastion at SSHHost is unreachable, according to the BastionStrategy
+	//	(ordered or parallel)
+	AlternateBastions []SSHBastion `json:"alternateBastions"`
+	BastionStrategy   string       `json:"bastionStrategy"`
+
+	// JumpHosts are SSH servers that Passage connects through, in order, before connecting to the bastion
+	JumpHosts []JumpHost `json:"jumpHosts"`
+
+	// CertificatePrincipals are the principals that user certificates are minted for, if a user CA is configured
+	CertificatePrincipals []string `json:"certificatePrincipals"`
+
+	// PasswordKeyID identifies a password in the keystore, for bastions that require password or
+	//	keyboard-interactive auth. It's only set from a password that the API stored, so it's never read from or
+	//	written to JSON.
+	PasswordKeyID *uuid.UUID `json:"-"`
+
+	// ProxyURL is an HTTP CONNECT or SOCKS5 egress proxy to connect to the bastion through. If empty, the global
+	//	proxy is used, if any. Its password is stored in the keystore, so it's redacted when read from the API.
+	ProxyURL string `json:"proxyUrl"`
+
+	// ProxyPasswordKeyID identifies the egress proxy's password in the keystore
+	ProxyPasswordKeyID *uuid.UUID `json:"-"`
+
+	// HostKeyVerification determines how the bastion's host key is verified (tofu or strict)
+	HostKeyVerification string `json:"hostKeyVerification"`
+
+	// CryptoPolicy overrides the global SSH client algorithms for this tunnel, for bastions that only support
+	//	legacy algorithms. Each kind of algorithm that it sets replaces the global list.
+	CryptoPolicy CryptoPolicy `json:"cryptoPolicy"`
+
 	// Deprecated
 	TunnelPort int `json:"tunnelPort"`
 
@@ -45,60 +95,35 @@ func (t NormalTunnel) Start(ctx context.Context, listener *net.TCPListener, stat
 
 	logger := log.FromContext(ctx)
 
-	// Establish a connection to the remote SSH server
-	sshClient, keepalive, err := NewSSHClient(ctx, SSHClientOptions{
-		Host: t.SSHHost,
-		Port: t.SSHPort,
-
-		// Select the SSH user to use for the client connection
-		//	If the tunnel has explicitly set a user, use that.
-		//	If not, fall back to the default.
-		User: firstNotEmptyString(t.SSHUser, t.clientOptions.User),
-
-		// Select the SSH auth methods to use for the client connection
-		GetKeySigners: t.getAuthSigners,
-
-		// Pass these options in from the global config
-		DialTimeout:       t.clientOptions.DialTimeout,
-		KeepaliveInterval: t.clientOptions.KeepaliveInterval,
-	})
+	sshClient, err := t.connect(ctx, cancel, statusUpdate)
 	if err != nil {
-		return errors.Wrap(err, "SSH connect")
+		return err
 	}
-	statusUpdate <- StatusUpdate{StatusBooting, "SSH connection established"}
-
-	// Shut down the tunnel if the SSH connection ends
-	go func() {
-		if err := sshClient.Wait(); err != nil {
-			cancel(errors.Wrap(err, "SSH connection closed"))
-		}
-	}()
-
-	// Listen for keepalive failures
-	go func() {
-		defer cancel(nil)
-
-		select {
-		case <-ctx.Done():
-			return
-		case err, ok := <-keepalive:
-			// If the channel closed, just ignore it
-			if !ok {
-				return
-			}
-			statusUpdate <- StatusUpdate{StatusError, fmt.Sprintf("SSH keepalive failed: %s", err.Error())}
-		}
-	}()
+	defer sshClient.Release()
 
 	// Function which gets a connection to the upstream server
+	primaryService := NamedService{ServiceHost: t.ServiceHost, ServicePort: t.ServicePort, ServiceSocketPath: t.ServiceSocketPath}
 	getUpstreamConn := func() (io.ReadWriteCloser, error) {
-		return sshClient.Dial("tcp", net.JoinHostPort(t.ServiceHost, strconv.Itoa(t.ServicePort)))
+		return primaryService.dial(sshClient.Client)
+	}
+	checkUpstream := getUpstreamConn
+
+	// If the tunnel has several upstream targets, choose between them and skip those the healthcheck found unreachable
+	if len(t.UpstreamTargets) > 0 {
+		targets := append([]UpstreamTarget{{ServiceHost: t.ServiceHost, ServicePort: t.ServicePort}}, t.UpstreamTargets...)
+		selector := newUpstreamSelector(targets, t.UpstreamPolicy)
+		getUpstreamConn = func() (io.ReadWriteCloser, error) {
+			return selector.dial(sshClient.Dial)
+		}
+		checkUpstream = func() (io.ReadWriteCloser, error) {
+			return selector.check(sshClient.Dial)
+		}
 	}
 
 	if t.HealthcheckEnabled {
 		logger.Debug("Starting upstream healthcheck")
 		// Start upstream reachability test
-		go upstreamHealthcheck(ctx, t, logger, t.services.Discovery, getUpstreamConn)
+		go upstreamHealthcheck(ctx, t, logger, t.services.Discovery, checkUpstream)
 	}
 
 	// If the context has been cancelled at this point in time, stop the tunnel.
@@ -129,11 +154,21 @@ func (t NormalTunnel) Start(ctx context.Context, listener *net.TCPListener, stat
 		}
 	}()
 
+	// Serve each named service on its own listener, over the same SSH connection
+	for _, service := range t.Services {
+		stopService, err := t.serveNamedService(ctx, cancel, listener, service, sshClient.Client)
+		if err != nil {
+			return errors.Wrapf(err, "serve service %s", service.Name)
+		}
+		defer stopService()
+	}
+
 	// Continually report tunnel status until the tunnel shuts down
 	go intervalStatusReporter(ctx, statusUpdate, func() StatusUpdate {
 		// If we're at this point in the tunnel, we're online
-		return StatusUpdate{Status: StatusReady, Message: "Tunnel is online"}
+		return t.onlineStatus(sshClient)
 	})
+	go t.reportKeepalives(ctx, sshClient, statusUpdate)
 
 	<-ctx.Done()
 
@@ -146,6 +181,345 @@ func (t NormalTunnel) Start(ctx context.Context, listener *net.TCPListener, stat
 	}
 }
 
+// connect borrows an SSH connection to the tunnel's bastion, and cancels the tunnel if the connection ends.
+// The caller must release the returned lease.
+func (t NormalTunnel) connect(ctx context.Context, cancel context.CancelCauseFunc, statusUpdate chan<- StatusUpdate) (*SSHClientLease, error) {
+	hostKeyCallback, err := t.getHostKeyCallback(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get host key callback")
+	}
+
+	// Use the tunnel's egress proxy if it has one, falling back to the global proxy
+	proxyURL := t.clientOptions.ProxyURL
+	if t.ProxyURL != "" {
+		if proxyURL, err = t.getProxyURL(ctx); err != nil {
+			return nil, errors.Wrap(err, "get proxy URL")
+		}
+	}
+
+	// Borrow a connection to the remote SSH server, which may be shared with other tunnels
+	var connected atomic.Bool
+	sshClient, err := t.getSSHClient(ctx, SSHClientOptions{
+		Host: t.SSHHost,
+		Port: t.SSHPort,
+
+		// Select the SSH user to use for the client connection
+		//	If the tunnel has explicitly set a user, use that.
+		//	If not, fall back to the default.
+		User: firstNotEmptyString(t.SSHUser, t.clientOptions.User),
+
+		// Select the SSH auth methods to use for the client connection
+		GetKeySigners: t.getAuthSigners,
+		GetPassword:   t.getPasswordFunc(),
+
+		// Verify the bastion's host key against the tunnel's known hosts
+		HostKeyCallback: hostKeyCallback,
+
+		// Fall back to alternate bastions if the primary is unreachable
+		AlternateBastions: t.AlternateBastions,
+		BastionStrategy:   t.BastionStrategy,
+
+		// Connect through any jump hosts before reaching the bastion
+		JumpHosts: t.getJumpHostOptions(),
+		ProxyURL:  proxyURL,
+
+		// Use the global crypto policy, unless the tunnel overrides it
+		CryptoPolicy: t.clientOptions.CryptoPolicy.override(t.CryptoPolicy),
+
+		// Record failed handshakes as they happen, so that the reason the tunnel is broken can be diagnosed
+		OnHandshake: func(handshake SSHHandshake) {
+			if handshake.Error != "" && !connected.Load() {
+				t.recordHandshake(ctx, handshake)
+			}
+		},
+
+		// Pass these options in from the global config
+		DialTimeout:       t.clientOptions.DialTimeout,
+		KeepaliveInterval: t.clientOptions.KeepaliveInterval,
+	})
+	if err != nil {
+		// Make failures at a specific hop, and host key mismatches, clearly visible rather than a generic connection failure
+		var bastionErr SSHBastionError
+		var hopErr SSHHopError
+		var mismatch HostKeyMismatchError
+		switch {
+		case errors.As(err, &bastionErr):
+			statusUpdate <- StatusUpdate{StatusError, bastionErr.Error()}
+		case errors.As(err, &hopErr):
+			statusUpdate <- StatusUpdate{StatusError, hopErr.Error()}
+		case errors.As(err, &mismatch):
+			statusUpdate <- StatusUpdate{StatusError, mismatch.Error()}
+		}
+		return nil, errors.Wrap(err, "SSH connect")
+	}
+	connected.Store(true)
+	t.recordHandshake(ctx, sshClient.Handshake())
+	statusUpdate <- StatusUpdate{StatusBooting, fmt.Sprintf("SSH connection established to bastion %s", sshClient.Bastion())}
+
+	// Shut down the tunnel if the SSH connection ends or keepalives fail.
+	//	If the connection is shared, this is reported to every tunnel using it.
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sshClient.Done():
+			statusUpdate <- StatusUpdate{StatusError, sshClient.Err().Error()}
+			cancel(sshClient.Err())
+		}
+	}()
+
+	return sshClient, nil
+}
+
+// recordHandshake saves the details of the most recent SSH handshake with the bastion, so that the API can report them
+func (t NormalTunnel) recordHandshake(ctx context.Context, handshake SSHHandshake) {
+	if err := t.services.SQL.SetTunnelHandshake(ctx, sqlFromHandshake(t.ID, handshake)); err != nil {
+		log.FromContext(ctx).Errorw("Record SSH handshake", zap.Error(err))
+	}
+}
+
+// onlineStatus reports that the tunnel is online, and if it has several bastions, which one is in use.
+// If keepalives to the bastion are slower than the degraded threshold, the tunnel is reported as degraded.
+func (t NormalTunnel) onlineStatus(sshClient *SSHClientLease) StatusUpdate {
+	message := "Tunnel is online"
+	if len(t.AlternateBastions) > 0 {
+		message = fmt.Sprintf("Tunnel is online via bastion %s", sshClient.Bastion())
+	}
+
+	if rtt, _ := sshClient.RTT(); t.isDegraded(rtt) {
+		return StatusUpdate{
+			Status:  StatusDegraded,
+			Message: fmt.Sprintf("%s, but keepalives took %s (threshold %s)", message, rtt.Round(time.Millisecond), t.clientOptions.KeepaliveDegradedThreshold),
+		}
+	}
+	return StatusUpdate{Status: StatusReady, Message: message}
+}
+
+// isDegraded is whether a keepalive round trip time is slower than the degraded threshold, if one is configured
+func (t NormalTunnel) isDegraded(rtt time.Duration) bool {
+	threshold := t.clientOptions.KeepaliveDegradedThreshold
+	return threshold > 0 && rtt > threshold
+}
+
+// keepaliveRecordInterval is how often the round trip time of a tunnel's keepalives is saved, unless the tunnel
+// becomes degraded or recovers in between
+const keepaliveRecordInterval = 5 * time.Minute
+
+// reportKeepalives records the round trip time of each keepalive to the bastion, and reports the tunnel's status as
+// soon as it becomes degraded or recovers, rather than waiting for the next status report
+func (t NormalTunnel) reportKeepalives(ctx context.Context, sshClient *SSHClientLease, statusUpdate chan<- StatusUpdate) {
+	logger := log.FromContext(ctx)
+	st := stats.GetStats(ctx)
+
+	_, updated := sshClient.RTT()
+	var degraded bool
+	var lastRecorded time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updated:
+		}
+
+		var rtt time.Duration
+		rtt, updated = sshClient.RTT()
+		st.Histogram(StatTunnelKeepaliveRTT, float64(rtt)/float64(time.Millisecond), stats.Tags{}, 1)
+
+		// Save the round trip time, so that the API can report it. It's only saved occasionally, or when the status
+		//	changes, so that keepalives don't cause a steady stream of writes.
+		statusChanged := t.isDegraded(rtt) != degraded
+		if statusChanged || time.Since(lastRecorded) >= keepaliveRecordInterval {
+			if err := t.services.SQL.SetTunnelKeepalive(ctx, t.ID, rtt); err != nil {
+				logger.Errorw("Record keepalive", zap.Error(err))
+			} else {
+				lastRecorded = time.Now()
+			}
+		}
+
+		if statusChanged {
+			degraded = !degraded
+			select {
+			case <-ctx.Done():
+				return
+			case statusUpdate <- t.onlineStatus(sshClient):
+			}
+		}
+	}
+}
+
+// NamedServicePorts remembers the ports that named services listen on, so that a restarted tunnel serves its named
+// services on the same ports that clients already know
+type NamedServicePorts struct {
+	mu    sync.Mutex
+	ports map[namedServiceKey]int
+}
+
+type namedServiceKey struct {
+	tunnelID uuid.UUID
+	name     string
+}
+
+func NewNamedServicePorts() *NamedServicePorts {
+	return &NamedServicePorts{ports: make(map[namedServiceKey]int)}
+}
+
+// listen opens a listener for a named service on the port it last listened on, falling back to a random, unused port
+// if there isn't one or it's been taken
+func (p *NamedServicePorts) listen(ip string, tunnelID uuid.UUID, name string) (*net.TCPListener, error) {
+	if p == nil {
+		return newEphemeralTCPListener(ip)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := namedServiceKey{tunnelID, name}
+	if port, ok := p.ports[key]; ok {
+		if listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(ip), Port: port}); err == nil {
+			return listener, nil
+		}
+	}
+
+	listener, err := newEphemeralTCPListener(ip)
+	if err != nil {
+		return nil, err
+	}
+	p.ports[key] = portFromNetAddr(listener.Addr())
+	return listener, nil
+}
+
+// serveNamedService opens a listener for a named service, registers it with service discovery, and forwards its
+// connections over the SSH client. The returned function stops the service.
+func (t NormalTunnel) serveNamedService(
+	ctx context.Context,
+	cancel context.CancelCauseFunc,
+	primaryListener *net.TCPListener,
+	service NamedService,
+	sshClient *ssh.Client,
+) (func(), error) {
+	logger := log.FromContext(ctx).With(zap.String("service", service.Name))
+
+	// Listen on the same interface as the tunnel's primary listener, and on the same port as before the tunnel restarted
+	serviceListener, err := t.services.NamedServicePorts.listen(primaryListener.Addr().(*net.TCPAddr).IP.String(), t.ID, service.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "open listener")
+	}
+	logger.Debugw("Start service listener", "listen_addr", serviceListener.Addr().String())
+
+	if err := t.services.Discovery.RegisterTunnelService(t.ID, service.Name, portFromNetAddr(serviceListener.Addr())); err != nil {
+		serviceListener.Close()
+		return nil, errors.Wrap(err, "register with service discovery")
+	}
+
+	getUpstreamConn := func() (io.ReadWriteCloser, error) {
+		return service.dial(sshClient)
+	}
+
+	if t.HealthcheckEnabled {
+		go namedServiceUpstreamHealthcheck(ctx, t, service.Name, logger, t.services.Discovery, getUpstreamConn)
+	}
+
+	forwarder := &TCPForwarder{
+		Listener:          serviceListener,
+		GetUpstreamConn:   getUpstreamConn,
+		KeepaliveInterval: 5 * time.Second,
+		Stats:             stats.GetStats(ctx).WithTags(stats.Tags{"service": service.Name}),
+		logger:            logger.Named("Forwarder"),
+	}
+	go func() {
+		if err := forwarder.Serve(); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				cancel(errors.Wrapf(err, "service %s forwarder serve", service.Name))
+			}
+		}
+	}()
+
+	return func() {
+		forwarder.Close()
+		if err := t.services.Discovery.DeregisterTunnelService(t.ID, service.Name); err != nil {
+			logger.Errorw("deregister service from service discovery", zap.Error(err))
+		}
+	}, nil
+}
+
+// getSSHClient borrows an SSH client from the shared pool. Tunnels connecting to the same bastion, as the same user,
+// with the same keys share one connection. Without a shared pool, the tunnel gets a dedicated connection.
+func (t NormalTunnel) getSSHClient(ctx context.Context, options SSHClientOptions) (*SSHClientLease, error) {
+	pool := t.services.SSHClientPool
+	if pool == nil {
+		return NewSSHClientPool().Get(ctx, t.ID.String(), options)
+	}
+
+	key, err := t.sshClientPoolKey(ctx, options)
+	if err != nil {
+		return nil, errors.Wrap(err, "get SSH client pool key")
+	}
+	return pool.Get(ctx, key, options)
+}
+
+// sshClientPoolKey identifies the connection by the (host, port, user, key set) of every hop
+func (t NormalTunnel) sshClientPoolKey(ctx context.Context, options SSHClientOptions) (string, error) {
+	keys, err := t.services.SQL.GetNormalTunnelPrivateKeys(ctx, t.ID)
+	if err != nil {
+		return "", errors.Wrap(err, "could not look up private keys")
+	}
+	tunnelCredentials := make([]string, len(keys))
+	for i, key := range keys {
+		tunnelCredentials[i] = key.ID.String()
+	}
+
+	// Certificates minted for this tunnel are part of its credentials
+	if t.services.UserCA != nil {
+		tunnelCredentials = append(tunnelCredentials, "principals="+strings.Join(t.getCertificatePrincipals(), ","))
+	}
+	if t.PasswordKeyID != nil {
+		tunnelCredentials = append(tunnelCredentials, "password="+t.PasswordKeyID.String())
+	}
+
+	hopKey := func(user, host string, port int, credentials []string) string {
+		credentials = slices.Clone(credentials)
+		slices.Sort(credentials)
+		return fmt.Sprintf("%s@%s[%s]", user, net.JoinHostPort(host, strconv.Itoa(port)), strings.Join(credentials, ","))
+	}
+
+	hops := make([]string, 0, len(t.JumpHosts)+1)
+	for i, jumpHost := range t.JumpHosts {
+		credentials := tunnelCredentials
+		if len(jumpHost.Keys) > 0 {
+			credentials = make([]string, len(jumpHost.Keys))
+			for j, key := range jumpHost.Keys {
+				credentials[j] = key.String()
+			}
+		}
+		hops = append(hops, hopKey(options.JumpHosts[i].User, jumpHost.SSHHost, jumpHost.SSHPort, credentials))
+	}
+	hops = append(hops, hopKey(options.User, options.Host, options.Port, tunnelCredentials))
+
+	key := strings.Join(hops, " -> ")
+
+	// Tunnels with alternate bastions may end up connected to any of them
+	if len(options.AlternateBastions) > 0 {
+		alternates := make([]string, len(options.AlternateBastions))
+		for i, bastion := range options.AlternateBastions {
+			alternates[i] = bastion.String()
+		}
+		key = fmt.Sprintf("%s or %s (%s)", key, strings.Join(alternates, ", "), firstNotEmptyString(options.BastionStrategy, BastionStrategyOrdered))
+	}
+
+	// Connections through different egress proxies are different connections
+	//	The key is logged, so it identifies the proxy's credentials by a hash of the URL rather than the URL itself.
+	if options.ProxyURL != nil {
+		hash := sha256.Sum256([]byte(options.ProxyURL.String()))
+		key = fmt.Sprintf("%s via %s (%x)", key, options.ProxyURL.Redacted(), hash[:8])
+	}
+
+	// Connections that allow different algorithms may have negotiated different ones
+	if !options.CryptoPolicy.IsEmpty() {
+		key = fmt.Sprintf("%s with %s", key, options.CryptoPolicy.String())
+	}
+	return key, nil
+}
+
 // firstNotEmptyString returns the first string that is not empty
 func firstNotEmptyString(options ...string) string {
 	if len(options) == 0 {
@@ -169,13 +543,86 @@ func (t NormalTunnel) getAuthSigners(ctx context.Context) ([]ssh.Signer, error)
 		return []ssh.Signer{}, errors.Wrap(err, "could not look up private keys")
 	}
 
+	signers, err := t.getSignersForKeys(ctx, keyIDs(keys))
+	if err != nil {
+		return []ssh.Signer{}, err
+	}
+
+	// If a user CA is configured, authenticate with a short-lived certificate before falling back to the tunnel's keys
+	if t.services.UserCA != nil {
+		certSigner, err := t.services.UserCA.NewCertSigner(ctx, fmt.Sprintf("passage-tunnel-%s", t.ID), t.getCertificatePrincipals())
+		if err != nil {
+			return []ssh.Signer{}, errors.Wrap(err, "could not mint user certificate")
+		}
+		signers = append([]ssh.Signer{certSigner}, signers...)
+	}
+
+	return signers, nil
+}
+
+// getCertificatePrincipals returns the principals that user certificates are minted for.
+//
+//	If the tunnel has not configured any, the certificate is valid for the SSH user.
+func (t NormalTunnel) getCertificatePrincipals() []string {
+	if len(t.CertificatePrincipals) > 0 {
+		return t.CertificatePrincipals
+	}
+	return []string{firstNotEmptyString(t.SSHUser, t.clientOptions.User)}
+}
+
+// getPasswordFunc returns a function which reads the tunnel's password from the keystore, or nil if it has none
+func (t NormalTunnel) getPasswordFunc() func(context.Context) (string, error) {
+	if t.PasswordKeyID == nil {
+		return nil
+	}
+
+	keyID := *t.PasswordKeyID
+	return func(ctx context.Context) (string, error) {
+		password, err := t.services.Keystore.Get(ctx, keyID)
+		if err != nil {
+			return "", errors.Wrapf(err, "could not get password %s", keyID)
+		}
+		return string(password), nil
+	}
+}
+
+// getProxyURL parses the tunnel's egress proxy URL, and reads its password from the keystore
+func (t NormalTunnel) getProxyURL(ctx context.Context) (*url.URL, error) {
+	proxyURL, err := ParseProxyURL(t.ProxyURL)
+	if err != nil || proxyURL == nil || t.ProxyPasswordKeyID == nil {
+		return proxyURL, err
+	}
+
+	password, err := t.services.Keystore.Get(ctx, *t.ProxyPasswordKeyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get proxy password %s", *t.ProxyPasswordKeyID)
+	}
+	username := ""
+	if proxyURL.User != nil {
+		username = proxyURL.User.Username()
+	}
+	proxyURL.User = url.UserPassword(username, string(password))
+	return proxyURL, nil
+}
+
+// keyIDs returns the IDs of keys
+func keyIDs(keys []postgres.Key) []uuid.UUID {
+	ids := make([]uuid.UUID, len(keys))
+	for i, key := range keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+// getSignersForKeys reads private keys from the keystore and structures them for use by the SSH client library
+func (t NormalTunnel) getSignersForKeys(ctx context.Context, keyIDs []uuid.UUID) ([]ssh.Signer, error) {
 	var signers []ssh.Signer
 
 	// parse private keys and prepare for SSH
-	for _, key := range keys {
-		privateKeyBytes, err := t.services.Keystore.Get(ctx, key.ID)
+	for _, keyID := range keyIDs {
+		privateKeyBytes, err := t.services.Keystore.Get(ctx, keyID)
 		if err != nil {
-			return []ssh.Signer{}, errors.Wrapf(err, "could not get contents for key %s", key.ID)
+			return []ssh.Signer{}, errors.Wrapf(err, "could not get contents for key %s", keyID)
 		}
 
 		// Generate ssh.Signers for the private key
@@ -190,14 +637,85 @@ func (t NormalTunnel) getAuthSigners(ctx context.Context) ([]ssh.Signer, error)
 	return signers, nil
 }
 
+// getJumpHostOptions converts the tunnel's jump hosts into SSH client options.
+//
+//	Jump hosts without their own user or keys fall back to the tunnel's user and credentials.
+func (t NormalTunnel) getJumpHostOptions() []SSHJumpHostOptions {
+	options := make([]SSHJumpHostOptions, len(t.JumpHosts))
+	for i, jumpHost := range t.JumpHosts {
+		getKeySigners := t.getAuthSigners
+		getPassword := t.getPasswordFunc()
+		if len(jumpHost.Keys) > 0 {
+			jumpHostKeys := jumpHost.Keys
+			getKeySigners = func(ctx context.Context) ([]ssh.Signer, error) {
+				// Tunnels created before jump host keys were validated may refer to other tunnels' keys
+				keys, err := t.services.SQL.GetNormalTunnelPrivateKeys(ctx, t.ID)
+				if err != nil {
+					return []ssh.Signer{}, errors.Wrap(err, "could not look up private keys")
+				}
+				if err := validateJumpHostKeys([]JumpHost{jumpHost}, keyIDs(keys)); err != nil {
+					return []ssh.Signer{}, err
+				}
+				return t.getSignersForKeys(ctx, jumpHostKeys)
+			}
+			getPassword = nil
+		}
+
+		options[i] = SSHJumpHostOptions{
+			Host:          jumpHost.SSHHost,
+			Port:          jumpHost.SSHPort,
+			User:          firstNotEmptyString(jumpHost.SSHUser, t.SSHUser, t.clientOptions.User),
+			GetKeySigners: getKeySigners,
+			GetPassword:   getPassword,
+		}
+	}
+	return options
+}
+
+// getHostKeyCallback loads the known hosts for this tunnel and builds a callback to verify the bastion's host key
+func (t NormalTunnel) getHostKeyCallback(ctx context.Context) (ssh.HostKeyCallback, error) {
+	records, err := t.services.SQL.GetNormalTunnelKnownHosts(ctx, t.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not look up known hosts")
+	}
+
+	knownHosts := make([]knownHost, 0, len(records))
+	for _, record := range records {
+		entry, err := parseKnownHost(record.Entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse known host %q", record.Entry)
+		}
+		knownHosts = append(knownHosts, entry)
+	}
+
+	verification := firstNotEmptyString(t.HostKeyVerification, HostKeyVerificationTOFU)
+	return newHostKeyCallback(knownHosts, verification, func(entry string) error {
+		log.FromContext(ctx).With(zap.String("known_host", entry)).Info("Trusting host key on first use")
+		return t.services.SQL.AddNormalTunnelKnownHost(ctx, t.ID, entry)
+	}), nil
+}
+
 // NormalTunnelServices are the external dependencies that NormalTunnel needs to do its job
 type NormalTunnelServices struct {
 	SQL interface {
 		GetNormalTunnelPrivateKeys(ctx context.Context, tunnelID uuid.UUID) ([]postgres.Key, error)
+		GetNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID) ([]postgres.KnownHost, error)
+		AddNormalTunnelKnownHost(ctx context.Context, tunnelID uuid.UUID, entry string) error
+		SetTunnelHandshake(ctx context.Context, handshake postgres.Handshake) error
+		SetTunnelKeepalive(ctx context.Context, tunnelID uuid.UUID, rtt time.Duration) error
 	}
 	Keystore keystore.Keystore
 
 	Discovery discovery.Service
+
+	// SSHClientPool shares SSH connections between tunnels. If nil, every tunnel gets its own connection.
+	SSHClientPool *SSHClientPool
+
+	// NamedServicePorts keeps named services on the same ports when tunnels restart. If nil, they listen on new ports.
+	NamedServicePorts *NamedServicePorts
+
+	// UserCA signs user certificates for SSH authentication. If nil, only the tunnel's keys are used.
+	UserCA *UserCertificateAuthority
 }
 
 func InjectNormalTunnelDependencies(f func(ctx context.Context) ([]NormalTunnel, error), services NormalTunnelServices, options SSHClientOptions) ListFunc {
@@ -228,7 +746,59 @@ func (t NormalTunnel) Equal(v interface{}) bool {
 		t.SSHPort == t2.SSHPort &&
 		t.ServiceHost == t2.ServiceHost &&
 		t.ServicePort == t2.ServicePort &&
-		t.HealthcheckEnabled == t2.HealthcheckEnabled
+		t.ServiceSocketPath == t2.ServiceSocketPath &&
+		slices.Equal(t.Services, t2.Services) &&
+		slices.Equal(t.UpstreamTargets, t2.UpstreamTargets) &&
+		t.UpstreamPolicy == t2.UpstreamPolicy &&
+		t.HealthcheckEnabled == t2.HealthcheckEnabled &&
+		slices.Equal(t.AlternateBastions, t2.AlternateBastions) &&
+		t.BastionStrategy == t2.BastionStrategy &&
+		t.HostKeyVerification == t2.HostKeyVerification &&
+		t.CryptoPolicy.Equal(t2.CryptoPolicy) &&
+		slices.EqualFunc(t.JumpHosts, t2.JumpHosts, JumpHost.Equal) &&
+		t.ProxyURL == t2.ProxyURL &&
+		equalUUIDPtr(t.ProxyPasswordKeyID, t2.ProxyPasswordKeyID) &&
+		slices.Equal(t.CertificatePrincipals, t2.CertificatePrincipals) &&
+		equalUUIDPtr(t.PasswordKeyID, t2.PasswordKeyID)
+}
+
+func equalUUIDPtr(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// NamedService is an additional upstream service that a normal tunnel forwards to, with its own listener
+type NamedService struct {
+	Name              string `json:"name"`
+	ServiceHost       string `json:"serviceHost,omitempty"`
+	ServicePort       int    `json:"servicePort,omitempty"`
+	ServiceSocketPath string `json:"serviceSocketPath,omitempty"`
+}
+
+// dial opens a connection to the service through the SSH client
+func (s NamedService) dial(client *ssh.Client) (io.ReadWriteCloser, error) {
+	// Unix sockets are dialed with a direct-streamlocal@openssh.com channel
+	if s.ServiceSocketPath != "" {
+		return client.Dial("unix", s.ServiceSocketPath)
+	}
+	return client.Dial("tcp", net.JoinHostPort(s.ServiceHost, strconv.Itoa(s.ServicePort)))
+}
+
+// JumpHost is an SSH server that a normal tunnel connects through before reaching its bastion
+type JumpHost struct {
+	SSHUser string      `json:"sshUser,omitempty"`
+	SSHHost string      `json:"sshHost"`
+	SSHPort int         `json:"sshPort"`
+	Keys    []uuid.UUID `json:"keys,omitempty"`
+}
+
+func (j JumpHost) Equal(j2 JumpHost) bool {
+	return j.SSHUser == j2.SSHUser &&
+		j.SSHHost == j2.SSHHost &&
+		j.SSHPort == j2.SSHPort &&
+		slices.Equal(j.Keys, j2.Keys)
 }
 
 // sqlFromNormalTunnel converts tunnel data into something that can be inserted into the DB
@@ -239,7 +809,103 @@ func sqlFromNormalTunnel(tunnel NormalTunnel) postgres.NormalTunnel {
 		SSHPort:     tunnel.SSHPort,
 		ServiceHost: tunnel.ServiceHost,
 		ServicePort: tunnel.ServicePort,
+
+		ServiceSocketPath: tunnel.ServiceSocketPath,
+		Services:          sqlFromNamedServices(tunnel.Services),
+
+		UpstreamTargets: sqlFromUpstreamTargets(tunnel.UpstreamTargets),
+		UpstreamPolicy:  tunnel.UpstreamPolicy,
+
+		AlternateBastions: sqlFromBastions(tunnel.AlternateBastions),
+		BastionStrategy:   tunnel.BastionStrategy,
+
+		HostKeyVerification: tunnel.HostKeyVerification,
+		JumpHosts:           sqlFromJumpHosts(tunnel.JumpHosts),
+		CryptoPolicy:        sqlFromCryptoPolicy(tunnel.CryptoPolicy),
+
+		CertificatePrincipals: append(pq.StringArray{}, tunnel.CertificatePrincipals...),
+		PasswordKeyID:         sqlFromUUIDPtr(tunnel.PasswordKeyID),
+		ProxyURL:              tunnel.ProxyURL,
+		ProxyPasswordKeyID:    sqlFromUUIDPtr(tunnel.ProxyPasswordKeyID),
+	}
+}
+
+func sqlFromUUIDPtr(id *uuid.UUID) uuid.NullUUID {
+	if id == nil {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: *id, Valid: true}
+}
+
+func uuidPtrFromSQL(id uuid.NullUUID) *uuid.UUID {
+	if !id.Valid {
+		return nil
+	}
+	return &id.UUID
+}
+
+func sqlFromUpstreamTargets(targets []UpstreamTarget) postgres.UpstreamTargets {
+	records := make(postgres.UpstreamTargets, len(targets))
+	for i, target := range targets {
+		records[i] = postgres.UpstreamTarget(target)
+	}
+	return records
+}
+
+func upstreamTargetsFromSQL(records postgres.UpstreamTargets) []UpstreamTarget {
+	targets := make([]UpstreamTarget, len(records))
+	for i, record := range records {
+		targets[i] = UpstreamTarget(record)
 	}
+	return targets
+}
+
+func sqlFromNamedServices(services []NamedService) postgres.NamedServices {
+	records := make(postgres.NamedServices, len(services))
+	for i, service := range services {
+		records[i] = postgres.NamedService(service)
+	}
+	return records
+}
+
+func namedServicesFromSQL(records postgres.NamedServices) []NamedService {
+	services := make([]NamedService, len(records))
+	for i, record := range records {
+		services[i] = NamedService(record)
+	}
+	return services
+}
+
+func sqlFromBastions(bastions []SSHBastion) postgres.Bastions {
+	records := make(postgres.Bastions, len(bastions))
+	for i, bastion := range bastions {
+		records[i] = postgres.Bastion{SSHHost: bastion.Host, SSHPort: bastion.Port}
+	}
+	return records
+}
+
+func bastionsFromSQL(records postgres.Bastions) []SSHBastion {
+	bastions := make([]SSHBastion, len(records))
+	for i, record := range records {
+		bastions[i] = SSHBastion{Host: record.SSHHost, Port: record.SSHPort}
+	}
+	return bastions
+}
+
+func sqlFromJumpHosts(jumpHosts []JumpHost) postgres.JumpHosts {
+	records := make(postgres.JumpHosts, len(jumpHosts))
+	for i, jumpHost := range jumpHosts {
+		records[i] = postgres.JumpHost(jumpHost)
+	}
+	return records
+}
+
+func jumpHostsFromSQL(records postgres.JumpHosts) []JumpHost {
+	jumpHosts := make([]JumpHost, len(records))
+	for i, record := range records {
+		jumpHosts[i] = JumpHost(record)
+	}
+	return jumpHosts
 }
 
 // convert a SQL DB representation of a postgres.NormalTunnel into the primary NormalTunnel struct
@@ -253,8 +919,24 @@ func normalTunnelFromSQL(record postgres.NormalTunnel) NormalTunnel {
 		SSHPort:            record.SSHPort,
 		ServiceHost:        record.ServiceHost,
 		ServicePort:        record.ServicePort,
+		ServiceSocketPath:  record.ServiceSocketPath,
+		Services:           namedServicesFromSQL(record.Services),
+		UpstreamTargets:    upstreamTargetsFromSQL(record.UpstreamTargets),
+		UpstreamPolicy:     record.UpstreamPolicy,
 		HealthcheckEnabled: record.HealthcheckEnabled,
 		TunnelPort:         record.TunnelPort,
+
+		AlternateBastions: bastionsFromSQL(record.AlternateBastions),
+		BastionStrategy:   record.BastionStrategy,
+
+		HostKeyVerification: record.HostKeyVerification,
+		JumpHosts:           jumpHostsFromSQL(record.JumpHosts),
+		CryptoPolicy:        cryptoPolicyFromSQL(record.CryptoPolicy),
+
+		CertificatePrincipals: record.CertificatePrincipals,
+		PasswordKeyID:         uuidPtrFromSQL(record.PasswordKeyID),
+		ProxyURL:              redactProxyURL(record.ProxyURL, record.ProxyPasswordKeyID.Valid),
+		ProxyPasswordKeyID:    uuidPtrFromSQL(record.ProxyPasswordKeyID),
 	}
 }
 
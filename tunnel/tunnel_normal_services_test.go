@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/stats"
+	"github.com/hightouchio/passage/tunnel/discovery/static"
+	"github.com/hightouchio/passage/tunnel/keystore/in_memory"
+	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testNormalTunnelSQL serves a single tunnel key, and trusts every host key
+type testNormalTunnelSQL struct {
+	keyID uuid.UUID
+}
+
+func (s testNormalTunnelSQL) GetNormalTunnelPrivateKeys(ctx context.Context, tunnelID uuid.UUID) ([]postgres.Key, error) {
+	return []postgres.Key{{ID: s.keyID}}, nil
+}
+
+func (s testNormalTunnelSQL) GetNormalTunnelKnownHosts(ctx context.Context, tunnelID uuid.UUID) ([]postgres.KnownHost, error) {
+	return nil, nil
+}
+
+func (s testNormalTunnelSQL) AddNormalTunnelKnownHost(ctx context.Context, tunnelID uuid.UUID, entry string) error {
+	return nil
+}
+
+func (s testNormalTunnelSQL) SetTunnelHandshake(ctx context.Context, handshake postgres.Handshake) error {
+	return nil
+}
+
+func (s testNormalTunnelSQL) SetTunnelKeepalive(ctx context.Context, tunnelID uuid.UUID, rtt time.Duration) error {
+	return nil
+}
+
+// testServiceDiscovery records the ports that named services are registered on
+type testServiceDiscovery struct {
+	static.Discovery
+	registered chan int
+}
+
+func (d testServiceDiscovery) RegisterTunnelService(id uuid.UUID, name string, port int) error {
+	d.registered <- port
+	return nil
+}
+
+// startTestEchoServer starts a TCP server which responds to each line with a prefix
+func startTestEchoServer(t *testing.T, prefix string) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestEcho(t, listener, prefix)
+	return portFromNetAddr(listener.Addr())
+}
+
+// startTestUnixEchoServer starts a Unix socket server which responds to each line with a prefix
+func startTestUnixEchoServer(t *testing.T, prefix string) string {
+	socketPath := filepath.Join(t.TempDir(), "echo.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestEcho(t, listener, prefix)
+	return socketPath
+}
+
+func serveTestEcho(t *testing.T, listener net.Listener, prefix string) {
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					_, _ = conn.Write([]byte(prefix + scanner.Text() + "\n"))
+				}
+			}()
+		}
+	}()
+}
+
+func newTestNormalTunnelServices(t *testing.T) NormalTunnelServices {
+	keyPair, err := GenerateKeyPair(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := uuid.New()
+	keystore := in_memory.New()
+	if err := keystore.Set(context.Background(), keyID, keyPair.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	return NormalTunnelServices{
+		SQL:       testNormalTunnelSQL{keyID: keyID},
+		Keystore:  keystore,
+		Discovery: static.Discovery{},
+	}
+}
+
+func TestNormalTunnel_NamedServices(t *testing.T) {
+	ctx, cancel := context.WithCancel(stats.InjectContext(context.Background(), stats.New(&statsd.NoOpClient{})))
+	defer cancel()
+
+	sshHost, sshPort := startTestSSHServer(t)
+	primaryPort := startTestEchoServer(t, "primary: ")
+	replicaPort := startTestEchoServer(t, "replica: ")
+
+	services := newTestNormalTunnelServices(t)
+	serviceDiscovery := testServiceDiscovery{registered: make(chan int, 1)}
+	services.Discovery = serviceDiscovery
+
+	tunnel := NormalTunnel{
+		ID:          uuid.New(),
+		SSHHost:     sshHost,
+		SSHPort:     sshPort,
+		ServiceHost: "127.0.0.1",
+		ServicePort: primaryPort,
+		Services: []NamedService{
+			{Name: "replica", ServiceHost: "127.0.0.1", ServicePort: replicaPort},
+		},
+		clientOptions: SSHClientOptions{User: "passage", DialTimeout: 5 * time.Second, KeepaliveInterval: time.Minute},
+		services:      services,
+	}
+
+	listener, err := newEphemeralTCPListener("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	statusUpdates := make(chan StatusUpdate)
+	go func() {
+		for range statusUpdates {
+		}
+	}()
+	go tunnel.Start(ctx, listener, statusUpdates)
+
+	var replicaListenerPort int
+	select {
+	case replicaListenerPort = <-serviceDiscovery.registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("named service was not registered")
+	}
+
+	// Each listener forwards to its own service
+	for port, expected := range map[int]string{
+		portFromNetAddr(listener.Addr()): "primary: hello",
+		replicaListenerPort:              "replica: hello",
+	} {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		_, _ = conn.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected+"\n", line)
+		}
+		conn.Close()
+	}
+}
+
+func TestNormalTunnel_ServiceSocketPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(stats.InjectContext(context.Background(), stats.New(&statsd.NoOpClient{})))
+	defer cancel()
+
+	sshHost, sshPort := startTestSSHServer(t)
+	tunnel := NormalTunnel{
+		ID:                uuid.New(),
+		SSHHost:           sshHost,
+		SSHPort:           sshPort,
+		ServiceSocketPath: startTestUnixEchoServer(t, "socket: "),
+		clientOptions:     SSHClientOptions{User: "passage", DialTimeout: 5 * time.Second, KeepaliveInterval: time.Minute},
+		services:          newTestNormalTunnelServices(t),
+	}
+
+	listener, err := newEphemeralTCPListener("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	statusUpdates := make(chan StatusUpdate)
+	go func() {
+		for range statusUpdates {
+		}
+	}()
+	go tunnel.Start(ctx, listener, statusUpdates)
+
+	// The listener forwards to the Unix socket on the bastion
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if assert.NoError(t, err) {
+		assert.Equal(t, "socket: hello\n", line)
+	}
+}
+
+func TestNamedServicePorts(t *testing.T) {
+	ports := NewNamedServicePorts()
+	tunnelID := uuid.New()
+
+	listener, err := ports.listen("127.0.0.1", tunnelID, "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := portFromNetAddr(listener.Addr())
+
+	// While the port is taken, the service listens on another one
+	other, err := ports.listen("127.0.0.1", tunnelID, "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, port, portFromNetAddr(other.Addr()))
+	port = portFromNetAddr(other.Addr())
+	listener.Close()
+	other.Close()
+
+	// Once it's free again, the restarted service listens on the port it last listened on
+	listener, err = ports.listen("127.0.0.1", tunnelID, "replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	assert.Equal(t, port, portFromNetAddr(listener.Addr()))
+}
+
+func TestCreateNormalTunnelRequest_ValidateNamedServices(t *testing.T) {
+	request := func(services ...NamedService) CreateNormalTunnelRequest {
+		return CreateNormalTunnelRequest{NormalTunnel: NormalTunnel{
+			SSHHost:     "bastion.example.com",
+			ServiceHost: "db.internal",
+			ServicePort: 5432,
+			Services:    services,
+		}}
+	}
+
+	assert.NoError(t, request(
+		NamedService{Name: "replica", ServiceHost: "replica.internal", ServicePort: 5432},
+		NamedService{Name: "docker", ServiceSocketPath: "/var/run/docker.sock"},
+	).Validate())
+
+	assert.Error(t, request(NamedService{Name: "", ServiceHost: "replica.internal", ServicePort: 5432}).Validate())
+	assert.Error(t, request(NamedService{Name: "Replica DB", ServiceHost: "replica.internal", ServicePort: 5432}).Validate())
+	assert.Error(t, request(NamedService{Name: "replica", ServiceHost: "replica.internal"}).Validate())
+	assert.Error(t, request(
+		NamedService{Name: "replica", ServiceHost: "replica.internal", ServicePort: 5432},
+		NamedService{Name: "replica", ServiceHost: "replica2.internal", ServicePort: 5432},
+	).Validate())
+}
@@ -2,15 +2,19 @@ package tunnel
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/gliderlabs/ssh"
 	"github.com/hightouchio/passage/log"
 	"github.com/hightouchio/passage/stats"
 	"github.com/hightouchio/passage/tunnel/discovery"
 	"github.com/hightouchio/passage/tunnel/keystore"
 	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
 	"net"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -27,31 +31,70 @@ type ReverseTunnel struct {
 	TunnelPort         int  `json:"tunnelPort"`
 	HealthcheckEnabled bool `json:"healthcheck_enabled"`
 
+	// ClientPolicy decides how tunnel connections are forwarded when more than one client is connected (newest-wins,
+	//	active-passive, or round-robin), and MaxClients caps the number of connected clients. Zero is unlimited.
+	ClientPolicy string `json:"clientPolicy"`
+	MaxClients   int    `json:"maxClients"`
+
+	// AllowedSourceCIDRs restrict the addresses that clients may connect from. If it's empty, any address is allowed.
+	AllowedSourceCIDRs []string `json:"allowedSourceCidrs"`
+
+	// authorizedKeyIDs are the IDs of the tunnel's keys, and authorizedKeysHash is a hash of them and their contents
+	authorizedKeyIDs   []string
 	authorizedKeysHash string
 	services           ReverseTunnelServices
 }
 
 func (t ReverseTunnel) Start(ctx context.Context, listener *net.TCPListener, statusUpdate chan<- StatusUpdate) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
 	logger := log.FromContext(ctx)
 
 	logger.Debug("Get authorized keys")
-	authorizedKeys, err := t.getAuthorizedKeys(ctx)
+	authorizedKeys, keyOptions, err := t.getAuthorizedKeys(ctx, logger)
 	if err != nil {
 		return errors.Wrap(err, "get authorized keys")
 	}
 
+	allowedSources, err := parseAllowedSourceCIDRs(t.AllowedSourceCIDRs)
+	if err != nil {
+		return errors.Wrap(err, "parse allowed source CIDRs")
+	}
+
 	// Create a channel to receive incoming SSH connections
 	//	for this tunnel
 	connectionChan := make(chan ReverseForwardingConnection)
 	defer close(connectionChan)
 
+	// Run a dedicated SSH server on the tunnel's SSHD port, if configured, rather than sharing one with other tunnels
+	sshServer := t.services.SSHServer
+	if t.services.NewDedicatedSSHServer != nil {
+		if t.SSHDPort == 0 {
+			return errors.New("tunnel has no SSHD port")
+		}
+		sshServer = t.services.NewDedicatedSSHServer(t.SSHDPort)
+
+		// Listen before serving, so that the tunnel fails if the port can't be bound
+		sshListener, err := net.Listen("tcp", sshServer.BindAddr)
+		if err != nil {
+			return errors.Wrap(err, "listen for dedicated SSHD")
+		}
+		go func() {
+			if err := sshServer.Serve(sshListener); err != nil && !errors.Is(err, ErrSshServerClosed) {
+				cancel(errors.Wrap(err, "dedicated SSHD serve"))
+			}
+		}()
+		defer sshServer.Close()
+		logger.With(zap.String("sshd_addr", sshServer.BindAddr)).Info("Started dedicated SSHD")
+	}
+
 	logger.Debug("Register tunnel with SSHD")
-	t.services.SSHServer.RegisterTunnel(SSHServerRegisteredTunnel{
+	sshServer.RegisterTunnel(SSHServerRegisteredTunnel{
 		ID:             t.ID,
 		AuthorizedKeys: authorizedKeys,
+		AllowedSources: allowedSources,
+		KeyOptions:     keyOptions,
 
 		// This is not actually the port that the tunnel is listening on,
 		//	but the port that the tunnel is *registered* on, which is how we uniquely identify incoming requests
@@ -60,15 +103,22 @@ func (t ReverseTunnel) Start(ctx context.Context, listener *net.TCPListener, sta
 
 		// Pass the receiver channel, so we can receive SSH connections from the SSHD server
 		Connections: connectionChan,
+
+		// Save the details of each client connection, so they can be reported by the API
+		OnHandshake: func(handshake SSHHandshake) {
+			if err := t.services.SQL.SetTunnelHandshake(ctx, sqlFromHandshake(t.ID, handshake)); err != nil {
+				logger.Errorw("Save handshake", zap.Error(err))
+			}
+		},
 	})
-	defer t.services.SSHServer.DeregisterTunnel(t.ID)
+	defer sshServer.DeregisterTunnel(t.ID)
 
-	// Keep track of the number of active connections on this tunnel
-	var connectionCount atomic.Int32
+	// Keep track of the clients connected to this tunnel, and choose which one each connection is forwarded to
+	clients := newReverseClientSet(t.ClientPolicy, t.MaxClients)
 
-	// Regularly report status based on the number of active connections
+	// Regularly report status based on the number of connected clients
 	go intervalStatusReporter(ctx, statusUpdate, func() StatusUpdate {
-		if connectionCount.Load() > 0 {
+		if clients.count() > 0 {
 			return StatusUpdate{StatusReady, "Tunnel is online"}
 		} else {
 			return StatusUpdate{StatusBooting, "Tunnel is waiting for connections"}
@@ -78,9 +128,35 @@ func (t ReverseTunnel) Start(ctx context.Context, listener *net.TCPListener, sta
 	// Regularly report server-wide stats
 	go intervalMetricReporter(ctx, func() {
 		// Report the current client connection count
-		stats.GetStats(ctx).Gauge(StatTunnelReverseForwardClientConnectionCount, float64(connectionCount.Load()), stats.Tags{}, 1)
+		stats.GetStats(ctx).Gauge(StatTunnelReverseForwardClientConnectionCount, float64(clients.count()), stats.Tags{}, 1)
 	})
 
+	// Create a TCPForwarder, which will bidirectionally proxy connections and traffic between the local
+	//	tunnel listener and the connected clients.
+	forwarder := &TCPForwarder{
+		Listener:          listener,
+		GetUpstreamConn:   clients.dial,
+		KeepaliveInterval: 5 * time.Second,
+		Stats:             stats.GetStats(ctx),
+		logger:            logger.Named("Forwarder"),
+	}
+	defer forwarder.Close()
+
+	// Start port forwarding
+	go func() {
+		if err := forwarder.Serve(); err != nil {
+			// If it's simply a closed error, we can return without logging an error.
+			if !errors.Is(err, net.ErrClosed) {
+				cancel(errors.Wrap(err, "forwarder serve"))
+			}
+		}
+	}()
+
+	if t.HealthcheckEnabled {
+		logger.Debug("Starting upstream healthcheck")
+		go upstreamHealthcheck(ctx, t, logger, t.services.Discovery, clients.dial)
+	}
+
 	// Handle incoming SSH port forwarding connections
 	logger.Info("Tunnel registered with SSH server. Waiting for connections")
 	connWg := sync.WaitGroup{}
@@ -96,13 +172,20 @@ func (t ReverseTunnel) Start(ctx context.Context, listener *net.TCPListener, sta
 					return
 				}
 
-				connectionCount.Add(1)
+				// Admit the client according to the client policy, or reject its port forward
+				client, err := clients.add(conn)
+				conn.admit(err)
+				if err != nil {
+					sshSessionLogger(logger, conn).Warnw("Reject client", zap.Error(err), zap.Int("max_clients", t.MaxClients))
+					continue
+				}
+
 				connWg.Add(1)
 				go func() {
 					defer connWg.Done()
-					defer connectionCount.Add(-1)
+					defer clients.remove(client)
 
-					t.handleConnection(ctx, conn, logger, listener)
+					t.handleConnection(ctx, client, logger)
 				}()
 			}
 		}
@@ -110,117 +193,173 @@ func (t ReverseTunnel) Start(ctx context.Context, listener *net.TCPListener, sta
 
 	// Wait for all connections to close
 	connWg.Wait()
+
+	// If the context was simply cancelled (with no error), return nil
+	//	If the context was cancelled with a real error, return that
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+		return cause
+	}
 	return nil
 }
 
-// handleConnection handles an SSH protocol connection and sets up port forwarding
-func (t ReverseTunnel) handleConnection(
-	ctx context.Context,
-	conn ReverseForwardingConnection,
-	log *log.Logger,
-	listener *net.TCPListener,
-) {
-	// Create a new context to handle this connection's lifecycle
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	logger := sshSessionLogger(log, conn)
+// handleConnection forwards tunnel connections to a client, until its SSH connection closes, it cancels the port
+// forward, or it's evicted by a newer client
+func (t ReverseTunnel) handleConnection(ctx context.Context, client *reverseClient, log *log.Logger) {
+	logger := sshSessionLogger(log, client.conn)
 	logger.Info("Start tunnel port forwarding")
 	defer logger.Info("Stop tunnel port forwarding")
 
-	// Wait for either server or client connection to close, and stop forwarding
-	go func() {
-		defer cancel()
-		select {
-		case <-ctx.Done(): // Wait for server connection to close
-		case <-conn.Done(): // Wait for client connection to close
-		}
-	}()
-
-	if t.HealthcheckEnabled {
-		logger.Debug("Starting upstream healthcheck")
-		// Start upstream reachability test
-		// TODO: If we have multiple forwarders, the healthchecks can conflict.
-		//		We should probably have a single healthcheck for the tunnel
-		go upstreamHealthcheck(ctx, t, logger, t.services.Discovery, conn.Dial)
+	select {
+	case <-ctx.Done(): // Wait for server connection to close
+	case <-client.conn.Done(): // Wait for client connection to close
+	case <-client.conn.Cancelled(): // Wait for client to cancel the forward
+	case <-client.evicted: // Wait for a newer client to replace this one
+		logger.Info("Client evicted by a newer client")
 	}
-
-	// Create a TCPForwarder, which will bidirectionally proxy connections and traffic between a local
-	//	tunnel listener and a remote SSH connection.
-	forwarder := &TCPForwarder{
-		Listener:          listener,
-		GetUpstreamConn:   conn.Dial,
-		KeepaliveInterval: 5 * time.Second,
-		Stats:             stats.GetStats(ctx),
-		logger:            logger.Named("Forwarder"),
-	}
-	defer forwarder.Close()
-
-	// Start port forwarding
-	go func() {
-		defer cancel()
-		if err := forwarder.Serve(); err != nil {
-			// If it's simply a closed error, we can return without logging an error.
-			if !errors.Is(err, net.ErrClosed) {
-				logger.Errorw("Forwarder serve", zap.Error(err))
-			}
-		}
-	}()
-
-	// Wait for connection to end
-	<-conn.Done()
 }
 
-func (t ReverseTunnel) getAuthorizedKeys(ctx context.Context) ([]ssh.PublicKey, error) {
+// getAuthorizedKeys reads the tunnel's authorized keys, and their authorized_keys options, by fingerprint. Keys that
+// can't be parsed are logged and left out, so that one bad key doesn't take down the tunnel for the others.
+func (t ReverseTunnel) getAuthorizedKeys(ctx context.Context, logger *log.Logger) ([]ssh.PublicKey, map[string]AuthorizedKeyOptions, error) {
 	registeredKeys, err := t.services.SQL.GetReverseTunnelAuthorizedKeys(ctx, t.ID)
 	if err != nil {
-		return []ssh.PublicKey{}, errors.Wrap(err, "could not read keys from database")
+		return []ssh.PublicKey{}, nil, errors.Wrap(err, "could not read keys from database")
 	}
 
-	authorizedKeys := make([]ssh.PublicKey, len(registeredKeys))
-	for i, registeredKey := range registeredKeys {
+	authorizedKeys := make([]ssh.PublicKey, 0, len(registeredKeys))
+	keyOptions := make(map[string]AuthorizedKeyOptions)
+	for _, registeredKey := range registeredKeys {
 		keyBytes, err := t.services.Keystore.Get(ctx, registeredKey.ID)
 		if err != nil {
-			return authorizedKeys, errors.Wrapf(err, "could not read key %s from keystore", registeredKey.ID.String())
+			return authorizedKeys, nil, errors.Wrapf(err, "could not read key %s from keystore", registeredKey.ID.String())
 		}
 
-		key, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+		key, opts, err := parseAuthorizedKey(keyBytes)
 		if err != nil {
-			return authorizedKeys, errors.Wrapf(err, "could not parse key %s", registeredKey.ID.String())
+			logger.With(zap.String("key_id", registeredKey.ID.String())).Errorw("Skip authorized key", zap.Error(err))
+			continue
 		}
 
-		authorizedKeys[i] = key
+		authorizedKeys = append(authorizedKeys, key)
+		keyOptions[gossh.FingerprintSHA256(key)] = opts
 	}
 
-	return authorizedKeys, nil
+	return authorizedKeys, keyOptions, nil
 }
 
 // ReverseTunnelServices are the external dependencies that ReverseTunnel needs to do its job
 type ReverseTunnelServices struct {
 	SQL interface {
 		GetReverseTunnelAuthorizedKeys(ctx context.Context, tunnelID uuid.UUID) ([]postgres.Key, error)
+		SetTunnelHandshake(ctx context.Context, handshake postgres.Handshake) error
 	}
 	SSHServer *SSHServer
 	Keystore  keystore.Keystore
 	Discovery discovery.Service
+
+	// NewDedicatedSSHServer creates an SSH server that listens on a tunnel's SSHD port. If it's set, each tunnel runs
+	//	its own server instead of registering with SSHServer.
+	NewDedicatedSSHServer func(sshdPort int) *SSHServer
 }
 
 func InjectReverseTunnelDependencies(f func(ctx context.Context) ([]ReverseTunnel, error), services ReverseTunnelServices) ListFunc {
+	digests := newAuthorizedKeyDigests(services.Keystore)
 	return func(ctx context.Context) ([]Tunnel, error) {
 		sts, err := f(ctx)
 		if err != nil {
 			return []Tunnel{}, err
 		}
+
+		// Hash the contents of each tunnel's keys, so that tunnels restart when a key's options change
+		keyIDs := make([][]string, len(sts))
+		for i, st := range sts {
+			keyIDs[i] = st.authorizedKeyIDs
+		}
+		hashes := digests.hash(ctx, keyIDs, time.Now())
+
 		// Inject dependencies
 		tunnels := make([]Tunnel, len(sts))
 		for i, st := range sts {
 			st.services = services
+			st.authorizedKeysHash = hashes[i]
 			tunnels[i] = st
 		}
 		return tunnels, nil
 	}
 }
 
+// authorizedKeyDigestTTL is how long the digest of a key's contents is reused for before the key is read again
+const authorizedKeyDigestTTL = 1 * time.Minute
+
+// authorizedKeyDigests caches digests of the contents of reverse tunnel keys, by key ID, so that the keystore isn't
+// read for every key on every refresh
+type authorizedKeyDigests struct {
+	keystore keystore.Keystore
+
+	lock    sync.Mutex
+	digests map[string]authorizedKeyDigest
+}
+
+type authorizedKeyDigest struct {
+	digest string
+	readAt time.Time
+}
+
+func newAuthorizedKeyDigests(keystore keystore.Keystore) *authorizedKeyDigests {
+	return &authorizedKeyDigests{keystore: keystore, digests: make(map[string]authorizedKeyDigest)}
+}
+
+// hash returns a hash of each list of key IDs and the contents of those keys. If a key can't be read, its last
+// digest is used.
+func (d *authorizedKeyDigests) hash(ctx context.Context, keyIDLists [][]string, now time.Time) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Forget the digests of keys that are no longer authorized for any tunnel
+	digests := make(map[string]authorizedKeyDigest)
+	hashes := make([]string, len(keyIDLists))
+	for i, keyIDs := range keyIDLists {
+		keyIDs = slices.Clone(keyIDs)
+		slices.Sort(keyIDs)
+		hash := sha256.New()
+		for _, keyID := range keyIDs {
+			digest, ok := digests[keyID]
+			if !ok {
+				digest = d.digest(ctx, keyID, now)
+				digests[keyID] = digest
+			}
+			fmt.Fprintf(hash, "%s:%s\n", keyID, digest.digest)
+		}
+		hashes[i] = hex.EncodeToString(hash.Sum(nil))
+	}
+	d.digests = digests
+
+	return hashes
+}
+
+// digest returns the cached digest of a key's contents, or reads the key again if it's expired
+func (d *authorizedKeyDigests) digest(ctx context.Context, keyID string, now time.Time) authorizedKeyDigest {
+	cached, ok := d.digests[keyID]
+	if ok && now.Sub(cached.readAt) < authorizedKeyDigestTTL {
+		return cached
+	}
+
+	id, err := uuid.Parse(keyID)
+	if err != nil {
+		return cached
+	}
+	contents, err := d.keystore.Get(ctx, id)
+	if err != nil {
+		log.FromContext(ctx).With(zap.String("key_id", keyID)).Warnw("Read authorized key", zap.Error(err))
+		// Wait for the TTL before trying again, so that an unavailable keystore isn't read on every refresh
+		cached.readAt = now
+		return cached
+	}
+
+	sum := sha256.Sum256(contents)
+	return authorizedKeyDigest{digest: hex.EncodeToString(sum[:]), readAt: now}
+}
+
 func (t ReverseTunnel) Equal(v interface{}) bool {
 	t2, ok := v.(ReverseTunnel)
 	if !ok {
@@ -231,7 +370,10 @@ func (t ReverseTunnel) Equal(v interface{}) bool {
 		t.SSHDPort == t2.SSHDPort &&
 		t.TunnelPort == t2.TunnelPort &&
 		t.authorizedKeysHash == t2.authorizedKeysHash &&
-		t.HealthcheckEnabled == t2.HealthcheckEnabled
+		t.HealthcheckEnabled == t2.HealthcheckEnabled &&
+		t.ClientPolicy == t2.ClientPolicy &&
+		t.MaxClients == t2.MaxClients &&
+		slices.Equal(t.AllowedSourceCIDRs, t2.AllowedSourceCIDRs)
 }
 
 // convert a SQL DB representation of a postgres.ReverseTunnel into the primary ReverseTunnel struct
@@ -243,7 +385,10 @@ func reverseTunnelFromSQL(record postgres.ReverseTunnel) ReverseTunnel {
 		TunnelPort:         record.TunnelPort,
 		SSHDPort:           record.SSHDPort,
 		HealthcheckEnabled: record.HealthcheckEnabled,
-		authorizedKeysHash: record.AuthorizedKeysHash,
+		ClientPolicy:       record.ClientPolicy,
+		MaxClients:         record.MaxClients,
+		AllowedSourceCIDRs: record.AllowedSourceCIDRs,
+		authorizedKeyIDs:   record.AuthorizedKeyIDs,
 	}
 }
 
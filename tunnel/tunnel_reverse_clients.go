@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Client policies, for reverse tunnels with more than one connected client
+const (
+	// ClientPolicyNewestWins allows a single client. A newly connected client evicts the previous one.
+	ClientPolicyNewestWins = "newest-wins"
+
+	// ClientPolicyActivePassive forwards to the oldest connected client, and fails over to the next oldest
+	ClientPolicyActivePassive = "active-passive"
+
+	// ClientPolicyRoundRobin spreads connections across every connected client
+	ClientPolicyRoundRobin = "round-robin"
+)
+
+func validateClientPolicy(policy string) error {
+	switch policy {
+	case "", ClientPolicyNewestWins, ClientPolicyActivePassive, ClientPolicyRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("clientPolicy must be one of %q, %q, or %q", ClientPolicyNewestWins, ClientPolicyActivePassive, ClientPolicyRoundRobin)
+	}
+}
+
+func validateMaxClients(maxClients int) error {
+	if maxClients < 0 {
+		return fmt.Errorf("maxClients must not be negative")
+	}
+	return nil
+}
+
+// reverseClient is a client's port forward to a reverse tunnel
+type reverseClient struct {
+	conn ReverseForwardingConnection
+
+	// evicted is closed when the client is replaced by a newer one
+	evicted chan struct{}
+}
+
+// reverseClientSet is the clients connected to a reverse tunnel, in the order they connected. It chooses which
+// client each tunnel connection is forwarded to, according to the tunnel's client policy.
+type reverseClientSet struct {
+	policy     string
+	maxClients int
+
+	clients []*reverseClient
+	next    int
+	sync.Mutex
+}
+
+func newReverseClientSet(policy string, maxClients int) *reverseClientSet {
+	return &reverseClientSet{
+		policy:     firstNotEmptyString(policy, ClientPolicyRoundRobin),
+		maxClients: maxClients,
+	}
+}
+
+var errTooManyClients = errors.New("tunnel has too many clients")
+
+// add admits a client to the set. It returns errTooManyClients if the tunnel already has its maximum number of
+// clients, unless the policy is newest-wins, in which case the existing client is evicted instead. Evicted clients'
+// SSH connections are closed, so that they reconnect rather than hold on to a forward that's no longer used.
+func (s *reverseClientSet) add(conn ReverseForwardingConnection) (*reverseClient, error) {
+	s.Lock()
+	var evicted []*reverseClient
+	if s.policy == ClientPolicyNewestWins {
+		evicted = s.clients
+		s.clients = nil
+	} else if s.maxClients > 0 && len(s.clients) >= s.maxClients {
+		s.Unlock()
+		return nil, errTooManyClients
+	}
+
+	client := &reverseClient{conn: conn, evicted: make(chan struct{})}
+	s.clients = append(s.clients, client)
+	s.Unlock()
+
+	for _, c := range evicted {
+		close(c.evicted)
+		c.conn.evict(conn)
+	}
+	return client, nil
+}
+
+// remove drops a client from the set, if it's still a member
+func (s *reverseClientSet) remove(client *reverseClient) {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, c := range s.clients {
+		if c == client {
+			s.clients = append(s.clients[:i:i], s.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *reverseClientSet) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.clients)
+}
+
+// order returns the clients in the order they should be tried for the next connection
+func (s *reverseClientSet) order() []*reverseClient {
+	s.Lock()
+	defer s.Unlock()
+
+	start := 0
+	if s.policy == ClientPolicyRoundRobin && len(s.clients) > 0 {
+		start = s.next % len(s.clients)
+		s.next++
+	}
+
+	order := make([]*reverseClient, len(s.clients))
+	for i := range s.clients {
+		order[i] = s.clients[(start+i)%len(s.clients)]
+	}
+	return order
+}
+
+// dial opens an upstream connection through the first client that accepts it
+func (s *reverseClientSet) dial() (io.ReadWriteCloser, error) {
+	clients := s.order()
+	if len(clients) == 0 {
+		return nil, errors.New("no clients connected")
+	}
+
+	var errs []string
+	for i, client := range clients {
+		conn, err := client.conn.Dial()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("client %d: %s", i, err.Error()))
+	}
+	return nil, errors.Errorf("no clients reachable: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+// testReverseClientConn is a port forward whose upstream connections identify the client they were dialed through
+func testReverseClientConn(name string, reachable bool) ReverseForwardingConnection {
+	return ReverseForwardingConnection{
+		Dial: func() (io.ReadWriteCloser, error) {
+			if !reachable {
+				return nil, errors.New("unreachable")
+			}
+			return testNamedConn{name}, nil
+		},
+	}
+}
+
+type testNamedConn struct {
+	name string
+}
+
+func (c testNamedConn) Read([]byte) (int, error)  { return 0, io.EOF }
+func (c testNamedConn) Write([]byte) (int, error) { return 0, io.EOF }
+func (c testNamedConn) Close() error              { return nil }
+
+func dialTestClientSet(t *testing.T, clients *reverseClientSet) string {
+	conn, err := clients.dial()
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	return conn.(testNamedConn).name
+}
+
+func TestReverseClientSet_NewestWins(t *testing.T) {
+	clients := newReverseClientSet(ClientPolicyNewestWins, 0)
+
+	firstConn := testReverseClientConn("first", true)
+	var firstCancelled, firstClosed bool
+	firstConn.cancel = func() { firstCancelled = true }
+	firstConn.closeConn = func() error {
+		firstClosed = true
+		return nil
+	}
+	first, err := clients.add(firstConn)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", dialTestClientSet(t, clients))
+
+	// A new client evicts the existing one
+	_, err = clients.add(testReverseClientConn("second", true))
+	assert.NoError(t, err)
+	select {
+	case <-first.evicted:
+	default:
+		t.Fatal("first client was not evicted")
+	}
+	assert.True(t, firstCancelled)
+	assert.True(t, firstClosed)
+	assert.Equal(t, 1, clients.count())
+	assert.Equal(t, "second", dialTestClientSet(t, clients))
+}
+
+func TestReverseClientSet_ActivePassive(t *testing.T) {
+	clients := newReverseClientSet(ClientPolicyActivePassive, 0)
+
+	active, _ := clients.add(testReverseClientConn("active", true))
+	_, _ = clients.add(testReverseClientConn("passive", true))
+
+	// Every connection goes to the active client
+	assert.Equal(t, "active", dialTestClientSet(t, clients))
+	assert.Equal(t, "active", dialTestClientSet(t, clients))
+
+	// The passive client takes over once the active client is gone
+	clients.remove(active)
+	assert.Equal(t, "passive", dialTestClientSet(t, clients))
+}
+
+func TestReverseClientSet_ActivePassiveFailover(t *testing.T) {
+	clients := newReverseClientSet(ClientPolicyActivePassive, 0)
+
+	_, _ = clients.add(testReverseClientConn("active", false))
+	_, _ = clients.add(testReverseClientConn("passive", true))
+
+	assert.Equal(t, "passive", dialTestClientSet(t, clients))
+}
+
+func TestReverseClientSet_RoundRobin(t *testing.T) {
+	clients := newReverseClientSet("", 0)
+
+	_, _ = clients.add(testReverseClientConn("a", true))
+	_, _ = clients.add(testReverseClientConn("b", true))
+
+	assert.Equal(t, "a", dialTestClientSet(t, clients))
+	assert.Equal(t, "b", dialTestClientSet(t, clients))
+	assert.Equal(t, "a", dialTestClientSet(t, clients))
+}
+
+func TestReverseClientSet_MaxClients(t *testing.T) {
+	clients := newReverseClientSet(ClientPolicyRoundRobin, 1)
+
+	first, err := clients.add(testReverseClientConn("first", true))
+	assert.NoError(t, err)
+
+	_, err = clients.add(testReverseClientConn("second", true))
+	assert.ErrorIs(t, err, errTooManyClients)
+
+	// A slot opens up once the first client disconnects
+	clients.remove(first)
+	_, err = clients.add(testReverseClientConn("third", true))
+	assert.NoError(t, err)
+}
+
+func TestReverseClientSet_NoClients(t *testing.T) {
+	clients := newReverseClientSet(ClientPolicyRoundRobin, 0)
+
+	_, err := clients.dial()
+	assert.Error(t, err)
+}
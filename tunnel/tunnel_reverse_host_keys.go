@@ -0,0 +1,312 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"slices"
+	"sync"
+)
+
+// ParseHostKeys parses one or more PEM encoded private keys, e.g. an RSA and an Ed25519 host key in the same file
+func ParseHostKeys(data []byte) ([]gossh.Signer, error) {
+	var keys []gossh.Signer
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := gossh.ParsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse host key %d", len(keys))
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		return nil, fmt.Errorf("could not parse host key %d: not PEM encoded", len(keys))
+	}
+	return keys, nil
+}
+
+// hostKeySet is the host keys of an SSH server, shared with the servers created from it by WithBindAddr, so that they
+// can be rotated together while the servers run
+type hostKeySet struct {
+	data    []byte
+	servers map[*SSHServer]*ssh.Server
+	sync.Mutex
+}
+
+func newHostKeySet(data []byte) *hostKeySet {
+	return &hostKeySet{
+		data:    data,
+		servers: make(map[*SSHServer]*ssh.Server),
+	}
+}
+
+// attach gives a server the current host keys, and keeps them up to date until it's detached
+func (h *hostKeySet) attach(s *SSHServer, server *ssh.Server) error {
+	h.Lock()
+	defer h.Unlock()
+
+	signers, err := s.getHostSigners(h.data)
+	if err != nil {
+		return err
+	}
+	s.useHostSigners(server, signers)
+	h.servers[s] = server
+	return nil
+}
+
+func (h *hostKeySet) detach(s *SSHServer) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.servers, s)
+}
+
+// set replaces the host keys of every attached server. The keys are checked against each server's crypto policy first,
+// so that no server changes its keys unless all of them can.
+func (h *hostKeySet) set(data []byte) error {
+	keys, err := ParseHostKeys(data)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no host keys")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	next := make(map[*SSHServer]hostSigners, len(h.servers))
+	for s := range h.servers {
+		signers, err := s.getHostSigners(data)
+		if err != nil {
+			return err
+		}
+		next[s] = signers
+	}
+
+	h.data = data
+	for s, server := range h.servers {
+		s.useHostSigners(server, next[s])
+	}
+	return nil
+}
+
+// hostSigners are the signers for an SSH server's host keys, after its crypto policy is applied
+type hostSigners struct {
+	// signers are offered in handshakes. A handshake negotiates a single key of each type, so when there are several
+	//	keys of the same type, the first one is used.
+	signers []gossh.Signer
+
+	// keys are announced to clients, so that they can learn keys which aren't used in handshakes yet
+	keys []gossh.Signer
+}
+
+func (s *SSHServer) getHostSigners(data []byte) (hostSigners, error) {
+	keys, err := ParseHostKeys(data)
+	if err != nil {
+		return hostSigners{}, err
+	}
+	if len(keys) == 0 {
+		return hostSigners{}, nil
+	}
+
+	var signers []gossh.Signer
+	for _, key := range keys {
+		signers = append(signers, getSignersForKey(key)...)
+	}
+
+	// Only offer the host key algorithms allowed by the crypto policy
+	if signers, err = s.CryptoPolicy.hostSigners(signers); err != nil {
+		return hostSigners{}, errors.Wrap(err, "apply crypto policy")
+	}
+
+	// Only announce the keys that can be offered
+	var allowed []gossh.Signer
+	for _, key := range keys {
+		if slices.ContainsFunc(signers, func(signer gossh.Signer) bool {
+			return keysEqual(signer.PublicKey(), key.PublicKey())
+		}) {
+			allowed = append(allowed, key)
+		}
+	}
+
+	return hostSigners{signers: signers, keys: allowed}, nil
+}
+
+// useHostSigners replaces the host keys of a running server. Connections that are already established are unaffected.
+func (s *SSHServer) useHostSigners(server *ssh.Server, next hostSigners) {
+	s.Lock()
+	previous := s.hostSigners
+	s.hostSigners = next
+	s.Unlock()
+
+	active := activeHostSigners(next.signers)
+
+	// The server can't remove host keys, so keys of a type that is no longer offered are retired instead
+	for _, signer := range activeHostSigners(previous.signers) {
+		if !slices.ContainsFunc(active, func(a gossh.Signer) bool {
+			return a.PublicKey().Type() == signer.PublicKey().Type()
+		}) {
+			server.AddHostKey(retiredHostSigner{signer})
+		}
+	}
+	for _, signer := range active {
+		server.AddHostKey(signer)
+	}
+}
+
+// getCurrentHostSigners returns the server's current host keys
+func (s *SSHServer) getCurrentHostSigners() hostSigners {
+	s.RLock()
+	defer s.RUnlock()
+	return s.hostSigners
+}
+
+// activeHostSigners returns the first signer of each type, which are the ones used in handshakes
+func activeHostSigners(signers []gossh.Signer) []gossh.Signer {
+	var active []gossh.Signer
+	for _, signer := range signers {
+		if !slices.ContainsFunc(active, func(a gossh.Signer) bool {
+			return a.PublicKey().Type() == signer.PublicKey().Type()
+		}) {
+			active = append(active, signer)
+		}
+	}
+	return active
+}
+
+// retiredHostSigner replaces a host key of a type that is no longer offered. It supports no signature algorithms, so
+// it's never negotiated.
+type retiredHostSigner struct {
+	gossh.Signer
+}
+
+func (s retiredHostSigner) Algorithms() []string {
+	return nil
+}
+
+func (s retiredHostSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	return nil, errors.New("host key is retired")
+}
+
+// Global requests of OpenSSH's host key rotation extension. The server announces all of its host keys after
+// authentication, and the client may ask it to prove that it holds them before trusting them.
+const (
+	hostKeysRequestType      = "hostkeys-00@openssh.com"
+	hostKeysProveRequestType = "hostkeys-prove-00@openssh.com"
+
+	hostKeysAnnouncedContextKey = "host_keys_announced"
+)
+
+type hostKeyBlob struct {
+	Blob []byte
+}
+
+// announceHostKeys sends the client every host key, including those not yet used in handshakes, once per connection
+func (s *SSHServer) announceHostKeys(ctx ssh.Context) {
+	ctx.Lock()
+	announced, _ := ctx.Value(hostKeysAnnouncedContextKey).(bool)
+	ctx.SetValue(hostKeysAnnouncedContextKey, true)
+	ctx.Unlock()
+	if announced {
+		return
+	}
+
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return
+	}
+	keys := s.getCurrentHostSigners().keys
+	if len(keys) == 0 {
+		return
+	}
+
+	var payload []byte
+	for _, key := range keys {
+		payload = append(payload, gossh.Marshal(hostKeyBlob{key.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequestType, false, payload); err != nil {
+		sshSessionLogger(s.logger, ctx).Debugw("Announce host keys", zap.Error(err))
+	}
+}
+
+// proveHostKeys signs the session ID with each host key that the client asks about, so that it can verify the keys
+// that were announced
+func (s *SSHServer) proveHostKeys(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return false, nil
+	}
+	blobs, ok := parseHostKeyBlobs(req.Payload)
+	if !ok {
+		return false, nil
+	}
+
+	keys := s.getCurrentHostSigners().keys
+	negotiatedAlgorithm := s.getHandshake(ctx).HostKeyAlgorithm
+
+	var proofs []byte
+	for _, blob := range blobs {
+		i := slices.IndexFunc(keys, func(key gossh.Signer) bool {
+			return bytes.Equal(key.PublicKey().Marshal(), blob)
+		})
+		if i < 0 {
+			return false, nil
+		}
+
+		signature, err := signHostKeyProof(keys[i], negotiatedAlgorithm, gossh.Marshal(struct {
+			RequestType string
+			SessionID   []byte
+			HostKey     []byte
+		}{hostKeysProveRequestType, conn.SessionID(), blob}))
+		if err != nil {
+			sshSessionLogger(s.logger, ctx).Errorw("Prove host key", zap.Error(err))
+			return false, nil
+		}
+		proofs = append(proofs, gossh.Marshal(hostKeyBlob{gossh.Marshal(signature)})...)
+	}
+	return true, proofs
+}
+
+// signHostKeyProof signs with the algorithm that OpenSSH clients verify. RSA keys sign with the algorithm negotiated
+// for the connection, if it was an RSA one, and otherwise with SHA-512.
+func signHostKeyProof(key gossh.Signer, negotiatedAlgorithm string, data []byte) (*gossh.Signature, error) {
+	algorithmSigner, ok := key.(gossh.AlgorithmSigner)
+	if !ok || key.PublicKey().Type() != gossh.KeyAlgoRSA {
+		return key.Sign(rand.Reader, data)
+	}
+
+	algorithm := gossh.KeyAlgoRSASHA512
+	if slices.Contains([]string{gossh.KeyAlgoRSA, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512}, negotiatedAlgorithm) {
+		algorithm = negotiatedAlgorithm
+	}
+	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
+
+// parseHostKeyBlobs parses the list of strings in a host key rotation request
+func parseHostKeyBlobs(payload []byte) ([][]byte, bool) {
+	var blobs [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, false
+		}
+		length := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < length {
+			return nil, false
+		}
+		blobs = append(blobs, payload[:length])
+		payload = payload[length:]
+	}
+	return blobs, true
+}
@@ -0,0 +1,212 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestHostKeyPEM generates a PEM encoded host key of the given type
+func newTestHostKeyPEM(t *testing.T, keyType string) ([]byte, gossh.Signer) {
+	var privateKey interface{}
+	var err error
+	switch keyType {
+	case gossh.KeyAlgoRSA:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case gossh.KeyAlgoED25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported key type %s", keyType)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := gossh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block), signer
+}
+
+// dialTestHostKey connects to the server, preferring the given host key algorithms, and returns the host key it
+// presents, even if authentication fails
+func dialTestHostKey(t *testing.T, addr string, clientKey gossh.Signer, algorithms ...string) (gossh.Conn, <-chan *gossh.Request, gossh.PublicKey, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hostKey gossh.PublicKey
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, addr, &gossh.ClientConfig{
+		User:              "passage",
+		Auth:              []gossh.AuthMethod{gossh.PublicKeys(clientKey)},
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, hostKey, err
+	}
+	t.Cleanup(func() {
+		_ = sshConn.Close()
+	})
+	go func() {
+		for newChannel := range chans {
+			_ = newChannel.Reject(gossh.Prohibited, "no channels")
+		}
+	}()
+	return sshConn, reqs, hostKey, nil
+}
+
+func TestParseHostKeys(t *testing.T) {
+	rsaKey, rsaSigner := newTestHostKeyPEM(t, gossh.KeyAlgoRSA)
+	ed25519Key, ed25519Signer := newTestHostKeyPEM(t, gossh.KeyAlgoED25519)
+
+	keys, err := ParseHostKeys(append(append(rsaKey, '\n'), ed25519Key...))
+	if assert.NoError(t, err) && assert.Len(t, keys, 2) {
+		assert.True(t, keysEqual(rsaSigner.PublicKey(), keys[0].PublicKey()))
+		assert.True(t, keysEqual(ed25519Signer.PublicKey(), keys[1].PublicKey()))
+	}
+
+	keys, err = ParseHostKeys(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = ParseHostKeys(append(rsaKey, []byte("not a key")...))
+	assert.ErrorContains(t, err, "could not parse host key 1")
+}
+
+func TestSSHServer_HostKeyRotation(t *testing.T) {
+	rsaKey, rsaSigner := newTestHostKeyPEM(t, gossh.KeyAlgoRSA)
+	ed25519Key, ed25519Signer := newTestHostKeyPEM(t, gossh.KeyAlgoED25519)
+	nextRSAKey, nextRSASigner := newTestHostKeyPEM(t, gossh.KeyAlgoRSA)
+
+	server, addr := startTestReverseSSHServer(t, func(server *SSHServer) {
+		assert.NoError(t, server.SetHostKeys(rsaKey))
+	})
+	clientKey := newTestSigner(t)
+	port := getFreePort()
+	connections := registerTestReverseTunnel(server, port, clientKey.PublicKey(), admitTestForward)
+
+	preferEd25519 := []string{gossh.KeyAlgoED25519, gossh.KeyAlgoRSASHA256}
+
+	// Only the RSA key is offered to begin with
+	_, _, hostKey, err := dialTestHostKey(t, addr, clientKey, preferEd25519...)
+	if assert.NoError(t, err) {
+		assert.True(t, keysEqual(rsaSigner.PublicKey(), hostKey))
+	}
+
+	// Add an Ed25519 key, without restarting the server
+	if !assert.NoError(t, server.SetHostKeys(append(rsaKey, ed25519Key...))) {
+		return
+	}
+	conn, reqs, hostKey, err := dialTestHostKey(t, addr, clientKey, preferEd25519...)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, keysEqual(ed25519Signer.PublicKey(), hostKey))
+
+	// Both keys are announced once the client forwards its tunnel
+	ok, _, err := conn.SendRequest(sshTCPForwardOpenEvent, true, gossh.Marshal(remoteForwardOpenRequest{"127.0.0.1", uint32(port)}))
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		return
+	}
+	receiveTestForward(t, connections)
+
+	select {
+	case req := <-reqs:
+		assert.Equal(t, hostKeysRequestType, req.Type)
+		assert.False(t, req.WantReply)
+		blobs, ok := parseHostKeyBlobs(req.Payload)
+		if assert.True(t, ok) {
+			assert.Equal(t, [][]byte{rsaSigner.PublicKey().Marshal(), ed25519Signer.PublicKey().Marshal()}, blobs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("host keys were not announced")
+	}
+
+	// The server proves that it holds the announced keys
+	ok, proofs, err := conn.SendRequest(hostKeysProveRequestType, true, gossh.Marshal(hostKeyBlob{rsaSigner.PublicKey().Marshal()}))
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		signatures, ok := parseHostKeyBlobs(proofs)
+		if assert.True(t, ok) && assert.Len(t, signatures, 1) {
+			var signature gossh.Signature
+			assert.NoError(t, gossh.Unmarshal(signatures[0], &signature))
+			assert.NoError(t, rsaSigner.PublicKey().Verify(gossh.Marshal(struct {
+				RequestType string
+				SessionID   []byte
+				HostKey     []byte
+			}{hostKeysProveRequestType, conn.SessionID(), rsaSigner.PublicKey().Marshal()}), &signature))
+		}
+	}
+
+	// Unknown keys can't be proven
+	ok, _, err = conn.SendRequest(hostKeysProveRequestType, true, gossh.Marshal(hostKeyBlob{nextRSASigner.PublicKey().Marshal()}))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Replace the RSA key and retire the Ed25519 key
+	if !assert.NoError(t, server.SetHostKeys(nextRSAKey)) {
+		return
+	}
+	_, _, hostKey, err = dialTestHostKey(t, addr, clientKey, preferEd25519...)
+	if assert.NoError(t, err) {
+		assert.True(t, keysEqual(nextRSASigner.PublicKey(), hostKey))
+	}
+	_, _, hostKey, err = dialTestHostKey(t, addr, clientKey, gossh.KeyAlgoED25519)
+	assert.Error(t, err)
+	assert.Nil(t, hostKey)
+
+	// Invalid keys are rejected, and the current keys are kept
+	assert.Error(t, server.SetHostKeys([]byte("not a key")))
+	assert.Error(t, server.SetHostKeys(nil))
+	_, _, hostKey, err = dialTestHostKey(t, addr, clientKey, preferEd25519...)
+	if assert.NoError(t, err) {
+		assert.True(t, keysEqual(nextRSASigner.PublicKey(), hostKey))
+	}
+}
+
+func TestSSHServer_HostKeyRotationSharedWithBindAddr(t *testing.T) {
+	rsaKey, _ := newTestHostKeyPEM(t, gossh.KeyAlgoRSA)
+	ed25519Key, ed25519Signer := newTestHostKeyPEM(t, gossh.KeyAlgoED25519)
+
+	shared, _ := startTestReverseSSHServer(t, func(server *SSHServer) {
+		assert.NoError(t, server.SetHostKeys(rsaKey))
+	})
+
+	// Rotating the shared server's keys rotates the keys of the servers created from it
+	dedicated := shared.WithBindAddr("127.0.0.1:0")
+	listener, err := net.Listen("tcp", dedicated.BindAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = dedicated.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = dedicated.Close()
+	})
+
+	if !assert.NoError(t, shared.SetHostKeys(append(rsaKey, ed25519Key...))) {
+		return
+	}
+	// No tunnels are registered, so authentication fails, but only after the host key is presented
+	_, _, hostKey, _ := dialTestHostKey(t, listener.Addr().String(), newTestSigner(t), gossh.KeyAlgoED25519)
+	if assert.NotNil(t, hostKey) {
+		assert.True(t, keysEqual(ed25519Signer.PublicKey(), hostKey))
+	}
+}
@@ -0,0 +1,249 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthorizedKeyOptions are the OpenSSH authorized_keys options of a reverse tunnel key that the SSH server enforces:
+// from, expiry-time, permitlisten, restrict, port-forwarding, and no-port-forwarding. Other options are ignored, as
+// the server doesn't provide the features that they restrict.
+type AuthorizedKeyOptions struct {
+	// from are the patterns that the client's address must match. Hostnames aren't resolved, so only IP address
+	//	patterns and CIDRs can match.
+	from []sourcePattern
+
+	// expiryTime is when the key stops being accepted. It's zero if the key doesn't expire.
+	expiryTime time.Time
+
+	// permitListen are the bind addresses that the client may forward. If there are none, any address may be forwarded.
+	permitListen []permittedListen
+
+	noPortForwarding bool
+}
+
+// sourcePattern is an element of a from option's pattern list: a CIDR, or an address with * and ? wildcards
+type sourcePattern struct {
+	negated  bool
+	network  *net.IPNet
+	wildcard string
+}
+
+// permittedListen is a permitlisten option. A host of "*" matches any bind address, and a port of -1 matches any port.
+type permittedListen struct {
+	host string
+	port int
+}
+
+// parseAuthorizedKey parses a reverse tunnel key, as it's stored in the keystore, and its authorized_keys options
+func parseAuthorizedKey(contents []byte) (ssh.PublicKey, AuthorizedKeyOptions, error) {
+	key, _, options, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return nil, AuthorizedKeyOptions{}, errors.Wrap(err, "could not parse key")
+	}
+
+	opts, err := ParseAuthorizedKeyOptions(options)
+	if err != nil {
+		return nil, AuthorizedKeyOptions{}, errors.Wrap(err, "could not parse options")
+	}
+	return key, opts, nil
+}
+
+// ParseAuthorizedKeyOptions parses the options that ssh.ParseAuthorizedKey returns for a key
+func ParseAuthorizedKeyOptions(options []string) (AuthorizedKeyOptions, error) {
+	var opts AuthorizedKeyOptions
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		if hasValue {
+			value = unquoteKeyOption(value)
+		}
+
+		switch strings.ToLower(name) {
+		case "restrict", "no-port-forwarding":
+			opts.noPortForwarding = true
+		case "port-forwarding":
+			opts.noPortForwarding = false
+
+		case "from":
+			if opts.from != nil {
+				return AuthorizedKeyOptions{}, fmt.Errorf("duplicate from option")
+			}
+			patterns, err := parseSourcePatterns(value)
+			if err != nil {
+				return AuthorizedKeyOptions{}, err
+			}
+			opts.from = patterns
+
+		case "expiry-time":
+			expiryTime, err := parseKeyExpiryTime(value)
+			if err != nil {
+				return AuthorizedKeyOptions{}, err
+			}
+			// Like OpenSSH, the earliest expiry time wins
+			if opts.expiryTime.IsZero() || expiryTime.Before(opts.expiryTime) {
+				opts.expiryTime = expiryTime
+			}
+
+		case "permitlisten":
+			listen, err := parsePermitListen(value)
+			if err != nil {
+				return AuthorizedKeyOptions{}, err
+			}
+			opts.permitListen = append(opts.permitListen, listen)
+		}
+	}
+	return opts, nil
+}
+
+// unquoteKeyOption removes the quotes around an option's value, and unescapes the quotes within it
+func unquoteKeyOption(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.ReplaceAll(value, `\"`, `"`)
+}
+
+func parseSourcePatterns(value string) ([]sourcePattern, error) {
+	var patterns []sourcePattern
+	for _, element := range strings.Split(value, ",") {
+		pattern := sourcePattern{negated: strings.HasPrefix(element, "!")}
+		element = strings.TrimPrefix(element, "!")
+		if element == "" {
+			return nil, fmt.Errorf("invalid from option %q", value)
+		}
+
+		if strings.Contains(element, "/") {
+			_, network, err := net.ParseCIDR(element)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q in from option", element)
+			}
+			pattern.network = network
+		} else {
+			pattern.wildcard = element
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseKeyExpiryTime parses an expiry-time option, YYYYMMDD[HHMM[SS]], which is in local time unless it ends with Z
+func parseKeyExpiryTime(value string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, location = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			if expiryTime, err := time.ParseInLocation(layout, value, location); err == nil {
+				return expiryTime, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time option %q", value)
+}
+
+// parsePermitListen parses a permitlisten option, [host:]port, where the port may be *
+func parsePermitListen(value string) (permittedListen, error) {
+	listen := permittedListen{host: "*"}
+	port := value
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		listen.host = strings.Trim(value[:i], "[]")
+		port = value[i+1:]
+	}
+	if listen.host == "" {
+		return permittedListen{}, fmt.Errorf("invalid permitlisten option %q", value)
+	}
+
+	if port == "*" {
+		listen.port = -1
+		return listen, nil
+	}
+	var err error
+	if listen.port, err = strconv.Atoi(port); err != nil || listen.port < 0 || listen.port > 65535 {
+		return permittedListen{}, fmt.Errorf("invalid port in permitlisten option %q", value)
+	}
+	return listen, nil
+}
+
+// checkConnection returns the reason that the key's options don't allow a client to connect, or "" if they do
+func (o AuthorizedKeyOptions) checkConnection(remote net.Addr, now time.Time) string {
+	if !o.expiryTime.IsZero() && now.After(o.expiryTime) {
+		return sshdRejectReasonKeyExpired
+	}
+	if o.from != nil && !matchSourcePatterns(o.from, net.ParseIP(remoteIP(remote))) {
+		return sshdRejectReasonSourceNotAllowed
+	}
+	return ""
+}
+
+// checkForward returns the reason that the key's options don't allow a port forward, or "" if they do
+func (o AuthorizedKeyOptions) checkForward(bindHost string, bindPort int) string {
+	if o.noPortForwarding {
+		return sshdRejectReasonForwardingNotPermitted
+	}
+	if len(o.permitListen) == 0 {
+		return ""
+	}
+	for _, listen := range o.permitListen {
+		if (listen.host == "*" || listen.host == bindHost) && (listen.port == -1 || listen.port == bindPort) {
+			return ""
+		}
+	}
+	return sshdRejectReasonListenNotPermitted
+}
+
+// matchSourcePatterns matches an IP address against a from option's patterns. As in OpenSSH, a match of a negated
+// pattern rejects the address, even if other patterns match it.
+func matchSourcePatterns(patterns []sourcePattern, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range patterns {
+		var ok bool
+		if pattern.network != nil {
+			ok = pattern.network.Contains(ip)
+		} else {
+			ok = matchWildcard(pattern.wildcard, ip.String())
+		}
+
+		if ok && pattern.negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// matchWildcard matches a string against a pattern, where * matches any sequence of characters and ? matches any
+// single character
+func matchWildcard(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchWildcard(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
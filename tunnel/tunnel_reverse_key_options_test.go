@@ -0,0 +1,207 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	keystoreInMemory "github.com/hightouchio/passage/tunnel/keystore/in_memory"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+)
+
+func parseTestKeyOptions(t *testing.T, line string) AuthorizedKeyOptions {
+	_, _, options, _, err := ssh.ParseAuthorizedKey(append([]byte(line+" "), gossh.MarshalAuthorizedKey(newTestPublicKey(t))...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := ParseAuthorizedKeyOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestParseAuthorizedKeyOptions(t *testing.T) {
+	opts := parseTestKeyOptions(t, `from="192.0.2.0/24,!192.0.2.13,198.51.100.*",expiry-time="20300102Z",permitlisten="localhost:8080",permitlisten="*",no-pty`)
+	if assert.Len(t, opts.from, 3) {
+		assert.Equal(t, "192.0.2.0/24", opts.from[0].network.String())
+		assert.True(t, opts.from[1].negated)
+		assert.Equal(t, "198.51.100.*", opts.from[2].wildcard)
+	}
+	assert.Equal(t, time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC), opts.expiryTime)
+	assert.Equal(t, []permittedListen{{"localhost", 8080}, {"*", -1}}, opts.permitListen)
+	assert.False(t, opts.noPortForwarding)
+
+	// Port forwarding may be re-enabled after restrict
+	assert.True(t, parseTestKeyOptions(t, `restrict`).noPortForwarding)
+	assert.False(t, parseTestKeyOptions(t, `restrict,port-forwarding`).noPortForwarding)
+	assert.True(t, parseTestKeyOptions(t, `no-port-forwarding`).noPortForwarding)
+
+	// The earliest expiry time wins
+	opts = parseTestKeyOptions(t, `expiry-time="203001021504",expiry-time="20250102150405"`)
+	assert.Equal(t, time.Date(2025, 1, 2, 15, 4, 5, 0, time.Local), opts.expiryTime)
+
+	for _, options := range [][]string{
+		{`from="192.0.2.0/33"`},
+		{`from=""`},
+		{`from="192.0.2.1"`, `from="192.0.2.2"`},
+		{`expiry-time="2030"`},
+		{`expiry-time="20301350"`},
+		{`permitlisten="localhost:http"`},
+		{`permitlisten=":8080"`},
+	} {
+		_, err := ParseAuthorizedKeyOptions(options)
+		assert.Error(t, err, options)
+	}
+}
+
+func TestAuthorizedKeyOptions_Check(t *testing.T) {
+	remote := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 2222}
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Keys without options allow everything
+	var opts AuthorizedKeyOptions
+	assert.Empty(t, opts.checkConnection(remote("198.51.100.1"), now))
+	assert.Empty(t, opts.checkForward("localhost", 8080))
+
+	opts = parseTestKeyOptions(t, `from="192.0.2.0/24,!192.0.2.13,198.51.100.?",expiry-time="20260102Z"`)
+	assert.Empty(t, opts.checkConnection(remote("192.0.2.1"), now))
+	assert.Empty(t, opts.checkConnection(remote("198.51.100.7"), now))
+	assert.Equal(t, sshdRejectReasonSourceNotAllowed, opts.checkConnection(remote("192.0.2.13"), now))
+	assert.Equal(t, sshdRejectReasonSourceNotAllowed, opts.checkConnection(remote("198.51.100.17"), now))
+	assert.Equal(t, sshdRejectReasonKeyExpired, opts.checkConnection(remote("192.0.2.1"), now.Add(48*time.Hour)))
+
+	opts = parseTestKeyOptions(t, `permitlisten="8080",permitlisten="tunnel:*"`)
+	assert.Empty(t, opts.checkForward("localhost", 8080))
+	assert.Empty(t, opts.checkForward("tunnel", 0))
+	assert.Equal(t, sshdRejectReasonListenNotPermitted, opts.checkForward("localhost", 8081))
+
+	opts = parseTestKeyOptions(t, `restrict,permitlisten="8080"`)
+	assert.Equal(t, sshdRejectReasonForwardingNotPermitted, opts.checkForward("localhost", 8080))
+}
+
+func TestReverseTunnel_GetAuthorizedKeys(t *testing.T) {
+	ctx := context.Background()
+	keystore := keystoreInMemory.New()
+	setKey := func(contents string) uuid.UUID {
+		keyID := uuid.New()
+		if err := keystore.Set(ctx, keyID, []byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		return keyID
+	}
+
+	// Keys whose options can't be parsed are left out, rather than failing the tunnel
+	key := newTestPublicKey(t)
+	goodKeyID := setKey(`from="192.0.2.0/24" ` + string(gossh.MarshalAuthorizedKey(key)))
+	badKeyID := setKey(`expiry-time="2030" ` + string(gossh.MarshalAuthorizedKey(newTestPublicKey(t))))
+	tunnel := ReverseTunnel{services: ReverseTunnelServices{
+		SQL:      testReverseTunnelSQL{keyID: goodKeyID, otherKeyIDs: []uuid.UUID{badKeyID}},
+		Keystore: keystore,
+	}}
+
+	authorizedKeys, keyOptions, err := tunnel.getAuthorizedKeys(ctx, log.Get())
+	if assert.NoError(t, err) && assert.Len(t, authorizedKeys, 1) {
+		assert.True(t, ssh.KeysEqual(key, authorizedKeys[0]))
+		assert.Len(t, keyOptions[gossh.FingerprintSHA256(key)].from, 1)
+	}
+
+	// Options are validated when keys are authorized for a tunnel
+	api := API{Keystore: keystore}
+	_, err = api.CreateReverseTunnel(ctx, CreateReverseTunnelRequest{Keys: []uuid.UUID{badKeyID}})
+	assert.True(t, isRequestError(err), err)
+}
+
+func TestAuthorizedKeyDigests(t *testing.T) {
+	ctx := context.Background()
+	keystore := keystoreInMemory.New()
+	keyID := uuid.New()
+	setKey := func(options string) {
+		if err := keystore.Set(ctx, keyID, append([]byte(options+" "), gossh.MarshalAuthorizedKey(newTestPublicKey(t))...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setKey(`from="192.0.2.0/24"`)
+
+	digests := newAuthorizedKeyDigests(keystore)
+	now := time.Now()
+	hash := digests.hash(ctx, [][]string{{keyID.String()}}, now)[0]
+	assert.NotEqual(t, hash, newAuthorizedKeyDigests(keystore).hash(ctx, [][]string{{}}, now)[0])
+
+	// Edited keys change the hash once their digests expire
+	setKey(`from="198.51.100.0/24"`)
+	assert.Equal(t, hash, digests.hash(ctx, [][]string{{keyID.String()}}, now.Add(time.Second))[0])
+	assert.NotEqual(t, hash, digests.hash(ctx, [][]string{{keyID.String()}}, now.Add(authorizedKeyDigestTTL))[0])
+}
+
+func TestMatchWildcard(t *testing.T) {
+	assert.True(t, matchWildcard("192.0.2.*", "192.0.2.10"))
+	assert.True(t, matchWildcard("*", ""))
+	assert.True(t, matchWildcard("192.0.?.1", "192.0.2.1"))
+	assert.False(t, matchWildcard("192.0.?.1", "192.0.20.1"))
+	assert.False(t, matchWildcard("192.0.2.1", "192.0.2.10"))
+}
+
+func TestSSHServer_KeyOptions(t *testing.T) {
+	server, addr := startTestReverseSSHServer(t)
+
+	connections := make(chan ReverseForwardingConnection)
+	go func() {
+		for conn := range connections {
+			conn.admit(nil)
+		}
+	}()
+	register := func(key ssh.PublicKey, options string) SSHServerRegisteredTunnel {
+		tunnel := SSHServerRegisteredTunnel{
+			ID:             uuid.New(),
+			RegisteredPort: getFreePort(),
+			AuthorizedKeys: []ssh.PublicKey{key},
+			KeyOptions:     map[string]AuthorizedKeyOptions{gossh.FingerprintSHA256(key): parseTestKeyOptions(t, options)},
+			Connections:    connections,
+		}
+		server.RegisterTunnel(tunnel)
+		return tunnel
+	}
+	dial := func(key gossh.Signer) (*gossh.Client, error) {
+		return gossh.Dial("tcp", addr, &gossh.ClientConfig{
+			User:            "passage",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(key)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	// Expired keys, and keys used from addresses that their from option doesn't match, are rejected
+	expiredKey := newTestSigner(t)
+	register(expiredKey.PublicKey(), `expiry-time="20200101"`)
+	_, err := dial(expiredKey)
+	assert.Error(t, err)
+
+	elsewhereKey := newTestSigner(t)
+	register(elsewhereKey.PublicKey(), `from="192.0.2.0/24"`)
+	_, err = dial(elsewhereKey)
+	assert.Error(t, err)
+
+	// Port forwards are limited by permitlisten
+	clientKey := newTestSigner(t)
+	permitted := register(clientKey.PublicKey(), `from="127.0.0.1",permitlisten="127.0.0.1:*"`)
+	client, err := dial(clientKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	forward := func(host string, port int) bool {
+		ok, _, err := client.SendRequest(sshTCPForwardOpenEvent, true, gossh.Marshal(remoteForwardOpenRequest{host, uint32(port)}))
+		assert.NoError(t, err)
+		return ok
+	}
+	assert.False(t, forward(permitted.ID.String(), 0))
+	assert.True(t, forward("127.0.0.1", permitted.RegisteredPort))
+}
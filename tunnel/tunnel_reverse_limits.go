@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// SSHServerLimits protect the reverse tunnel SSH server from brute force attacks and floods of connections. A zero
+// value disables each limit.
+type SSHServerLimits struct {
+	// HandshakeTimeout is how long a client has to complete the handshake and authenticate before it's disconnected
+	HandshakeTimeout time.Duration
+
+	// MaxUnauthenticatedConnections caps the number of connections that haven't authenticated yet. Connections beyond
+	//	the cap are closed as soon as they're accepted.
+	MaxUnauthenticatedConnections int
+
+	// An IP address that fails to authenticate MaxAuthFailures times within AuthFailureWindow is banned for
+	//	BanDuration. A connection fails if it attempts authentication without succeeding, or if its handshake times out.
+	//	Zero disables bans, since clients that share an address share its failures.
+	MaxAuthFailures   int
+	AuthFailureWindow time.Duration
+	BanDuration       time.Duration
+}
+
+// Reasons that connections are rejected, which tag StatSshdConnectionsRequests
+const (
+	sshdRejectReasonBanned                  = "banned"
+	sshdRejectReasonTooManyUnauthenticated  = "too_many_unauthenticated"
+	sshdRejectReasonHandshakeTimeout        = "handshake_timeout"
+	sshdRejectReasonAuthFailed              = "auth_failed"
+	sshdRejectReasonUnauthorizedKey         = "unauthorized_key"
+	sshdRejectReasonUnauthorizedCertificate = "unauthorized_certificate"
+	sshdRejectReasonSourceNotAllowed        = "source_not_allowed"
+	sshdRejectReasonKeyExpired              = "key_expired"
+
+	// Reasons that port forwards are rejected, which tag StatSshReversePortForwardingRequests
+	sshdRejectReasonUnauthorizedForward    = "unauthorized_forward"
+	sshdRejectReasonForwardingNotPermitted = "forwarding_not_permitted"
+	sshdRejectReasonListenNotPermitted     = "listen_not_permitted"
+)
+
+// sshConnectionLimiter counts unauthenticated connections and authentication failures. It's shared by an SSH server
+// and the servers created from it by WithBindAddr, so that a client is banned from all of them at once.
+type sshConnectionLimiter struct {
+	unauthenticated int
+	failures        map[string]*sshAuthFailures
+	lastPrune       time.Time
+	sync.Mutex
+}
+
+// sshAuthFailures are the recent authentication failures of an IP address
+type sshAuthFailures struct {
+	count       int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+func newSSHConnectionLimiter() *sshConnectionLimiter {
+	return &sshConnectionLimiter{
+		failures: make(map[string]*sshAuthFailures),
+	}
+}
+
+// open admits a new connection from an IP address, or returns the reason that it's rejected
+func (l *sshConnectionLimiter) open(limits SSHServerLimits, ip string) (*sshConnectionAttempt, string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if failures, ok := l.failures[ip]; ok && time.Now().Before(failures.bannedUntil) {
+		return nil, sshdRejectReasonBanned
+	}
+	if limits.MaxUnauthenticatedConnections > 0 && l.unauthenticated >= limits.MaxUnauthenticatedConnections {
+		return nil, sshdRejectReasonTooManyUnauthenticated
+	}
+
+	l.unauthenticated++
+	return &sshConnectionAttempt{limiter: l, limits: limits, ip: ip}, ""
+}
+
+func (l *sshConnectionLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	l.unauthenticated--
+}
+
+// recordFailure counts an authentication failure from an IP address, and reports whether it's now banned
+func (l *sshConnectionLimiter) recordFailure(limits SSHServerLimits, ip string) bool {
+	if limits.MaxAuthFailures <= 0 {
+		return false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.prune(limits, now)
+
+	failures, ok := l.failures[ip]
+	if !ok {
+		failures = &sshAuthFailures{windowStart: now}
+		l.failures[ip] = failures
+	} else if now.Sub(failures.windowStart) > limits.AuthFailureWindow {
+		failures.count, failures.windowStart = 0, now
+	}
+
+	failures.count++
+	if failures.count < limits.MaxAuthFailures {
+		return false
+	}
+	failures.count, failures.windowStart = 0, now
+	failures.bannedUntil = now.Add(limits.BanDuration)
+	return true
+}
+
+// prune forgets IP addresses whose failures have expired and that aren't banned, at most once per failure window, so
+// that scans from many addresses don't grow the failures without bound
+func (l *sshConnectionLimiter) prune(limits SSHServerLimits, now time.Time) {
+	if now.Sub(l.lastPrune) < limits.AuthFailureWindow {
+		return
+	}
+	for ip, failures := range l.failures {
+		if now.Sub(failures.windowStart) > limits.AuthFailureWindow && now.After(failures.bannedUntil) {
+			delete(l.failures, ip)
+		}
+	}
+	l.lastPrune = now
+}
+
+// sshConnectionAttempt is a connection that hasn't authenticated yet. It holds one of the limiter's unauthenticated
+// connections until it authenticates or closes.
+type sshConnectionAttempt struct {
+	limiter *sshConnectionLimiter
+	limits  SSHServerLimits
+	ip      string
+	timer   *time.Timer
+
+	attempted bool
+	timedOut  bool
+	done      bool
+	sync.Mutex
+}
+
+// startTimeout closes the connection if it hasn't authenticated before the handshake timeout
+func (a *sshConnectionAttempt) startTimeout(conn net.Conn) {
+	if a.limits.HandshakeTimeout <= 0 {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.timer = time.AfterFunc(a.limits.HandshakeTimeout, func() {
+		a.Lock()
+		if a.done {
+			a.Unlock()
+			return
+		}
+		a.timedOut = true
+		a.Unlock()
+
+		_ = conn.Close()
+	})
+}
+
+// authenticate records the result of an authentication attempt
+func (a *sshConnectionAttempt) authenticate(err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.done {
+		return
+	}
+	if err != nil {
+		a.attempted = true
+		return
+	}
+	a.finish()
+}
+
+// close ends the attempt when its connection closes. If the connection didn't authenticate, it returns the reason and
+// whether the IP address is now banned.
+func (a *sshConnectionAttempt) close() (string, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.done {
+		return "", false
+	}
+	a.finish()
+
+	var reason string
+	switch {
+	case a.timedOut:
+		reason = sshdRejectReasonHandshakeTimeout
+	case a.attempted:
+		reason = sshdRejectReasonAuthFailed
+	default:
+		// The client disconnected before attempting authentication, e.g. a port scan
+		return "", false
+	}
+	return reason, a.limiter.recordFailure(a.limits, a.ip)
+}
+
+func (a *sshConnectionAttempt) finish() {
+	a.done = true
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	a.limiter.release()
+}
+
+// limitedConn ends its connection attempt when it's closed
+type limitedConn struct {
+	net.Conn
+	onClose func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// remoteIP returns the IP address of a connection's remote address, or the whole address if it has no port
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSSHConnectionLimiter(t *testing.T) {
+	limits := SSHServerLimits{
+		MaxUnauthenticatedConnections: 2,
+		MaxAuthFailures:               2,
+		AuthFailureWindow:             time.Minute,
+		BanDuration:                   100 * time.Millisecond,
+	}
+	limiter := newSSHConnectionLimiter()
+
+	// Unauthenticated connections are capped, until one authenticates
+	first, reason := limiter.open(limits, "192.0.2.1")
+	assert.NotNil(t, first)
+	assert.Empty(t, reason)
+	second, _ := limiter.open(limits, "192.0.2.2")
+	assert.NotNil(t, second)
+	_, reason = limiter.open(limits, "192.0.2.3")
+	assert.Equal(t, sshdRejectReasonTooManyUnauthenticated, reason)
+
+	first.authenticate(nil)
+	third, _ := limiter.open(limits, "192.0.2.3")
+	assert.NotNil(t, third)
+
+	// Connections that close without attempting authentication aren't failures
+	reason, banned := second.close()
+	assert.Empty(t, reason)
+	assert.False(t, banned)
+
+	// Repeated failures from the same address ban it
+	third.authenticate(assert.AnError)
+	reason, banned = third.close()
+	assert.Equal(t, sshdRejectReasonAuthFailed, reason)
+	assert.False(t, banned)
+
+	fourth, _ := limiter.open(limits, "192.0.2.3")
+	fourth.authenticate(assert.AnError)
+	reason, banned = fourth.close()
+	assert.Equal(t, sshdRejectReasonAuthFailed, reason)
+	assert.True(t, banned)
+
+	_, reason = limiter.open(limits, "192.0.2.3")
+	assert.Equal(t, sshdRejectReasonBanned, reason)
+	other, _ := limiter.open(limits, "192.0.2.4")
+	assert.NotNil(t, other)
+
+	// Bans expire
+	time.Sleep(limits.BanDuration)
+	again, reason := limiter.open(limits, "192.0.2.3")
+	assert.NotNil(t, again)
+	assert.Empty(t, reason)
+}
+
+func TestSSHServer_Limits(t *testing.T) {
+	server, addr := startTestReverseSSHServer(t, func(server *SSHServer) {
+		server.Limits = SSHServerLimits{
+			HandshakeTimeout:  200 * time.Millisecond,
+			MaxAuthFailures:   2,
+			AuthFailureWindow: time.Minute,
+			BanDuration:       time.Minute,
+		}
+	})
+	clientKey := newTestSigner(t)
+	registerTestReverseTunnel(server, getFreePort(), clientKey.PublicKey(), admitTestForward)
+
+	dial := func(key gossh.Signer) error {
+		client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+			User:            "passage",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(key)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			_ = client.Close()
+		}
+		return err
+	}
+
+	// Authorized clients are unaffected
+	assert.NoError(t, dial(clientKey))
+
+	// A client that never completes its handshake is disconnected
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	for err == nil {
+		_, err = conn.Read(make([]byte, 256))
+	}
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// After a second failure, the address is banned, even for authorized keys. The server records the failure once it
+	//	closes the connection, so wait for the ban to take effect.
+	assert.Error(t, dial(newTestSigner(t)))
+	assert.Eventually(t, func() bool {
+		return dial(clientKey) != nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
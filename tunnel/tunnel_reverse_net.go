@@ -4,16 +4,111 @@ import (
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 	"io"
+	"net"
+	"strconv"
+	"sync"
 )
 
 type ReverseForwardingHandler struct {
-	GetTunnel func(bindPort int) (SSHServerRegisteredTunnel, bool)
+	GetTunnel func(ctx ssh.Context, bindAddr string, bindPort int) (SSHServerRegisteredTunnel, bool)
 }
 
+// ReverseForwardingConnection is a single port forward requested by an SSH connection. A connection may hold several,
+// one for each `-R` flag of the client.
 type ReverseForwardingConnection struct {
 	ssh.Context
 
+	// BindAddr and BindPort are the address that the client requested to forward
+	BindAddr string
+	BindPort uint32
+
 	Dial func() (io.ReadWriteCloser, error)
+
+	cancelled <-chan struct{}
+	admitted  chan<- error
+
+	// cancel stops the port forward, and closeConn closes its SSH connection
+	cancel    func()
+	closeConn func() error
+}
+
+// Cancelled is closed when the client cancels this port forward. The SSH connection, and its other port forwards,
+// may stay open.
+func (c ReverseForwardingConnection) Cancelled() <-chan struct{} {
+	return c.cancelled
+}
+
+// evict stops the port forward in favor of a newer one. Its SSH connection is closed too, so that the client
+// reconnects, unless the newer forward was requested over the same connection.
+func (c ReverseForwardingConnection) evict(newer ReverseForwardingConnection) {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	sameConnection := c.Context != nil && newer.Context != nil && c.SessionID() == newer.SessionID()
+	if c.closeConn != nil && !sameConnection {
+		_ = c.closeConn()
+	}
+}
+
+// admit reports whether the tunnel accepted the port forward, with the reason if it didn't
+func (c ReverseForwardingConnection) admit(err error) {
+	if c.admitted != nil {
+		c.admitted <- err
+	}
+}
+
+// reverseForwards are the port forwards open on an SSH connection, by bind address, so that each can be cancelled
+// without affecting the others
+type reverseForwards struct {
+	forwards map[string]chan struct{}
+	sync.Mutex
+}
+
+const reverseForwardsContextKey = "reverse_forwards"
+
+// getReverseForwards returns the port forwards open on the connection
+func getReverseForwards(ctx ssh.Context) *reverseForwards {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	forwards, ok := ctx.Value(reverseForwardsContextKey).(*reverseForwards)
+	if !ok {
+		forwards = &reverseForwards{forwards: make(map[string]chan struct{})}
+		ctx.SetValue(reverseForwardsContextKey, forwards)
+	}
+	return forwards
+}
+
+// open registers a port forward, and returns a channel which is closed when it is cancelled. It returns false if the
+// address is already being forwarded.
+func (f *reverseForwards) open(addr string) (chan struct{}, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.forwards[addr]; ok {
+		return nil, false
+	}
+	cancelled := make(chan struct{})
+	f.forwards[addr] = cancelled
+	return cancelled, true
+}
+
+// cancel stops a port forward. It returns false if the address isn't being forwarded.
+func (f *reverseForwards) cancel(addr string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	cancelled, ok := f.forwards[addr]
+	if !ok {
+		return false
+	}
+	close(cancelled)
+	delete(f.forwards, addr)
+	return true
+}
+
+func reverseForwardAddr(bindAddr string, bindPort uint32) string {
+	return net.JoinHostPort(bindAddr, strconv.FormatUint(uint64(bindPort), 10))
 }
 
 func (h *ReverseForwardingHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
@@ -45,33 +140,53 @@ func (h *ReverseForwardingHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Se
 	}
 }
 
-// closePortForwarding handles a request from the SSH client to open port forwarding
+// openPortForwarding handles a request from the SSH client to open port forwarding
 func (h *ReverseForwardingHandler) openPortForwarding(ctx ssh.Context, payload remoteForwardOpenRequest) (bool, []byte) {
-	tunnel, ok := h.GetTunnel(int(payload.BindPort))
+	tunnel, ok := h.GetTunnel(ctx, payload.BindAddr, int(payload.BindPort))
 	if !ok {
 		// Couldn't find a valid registered tunnel for this request
 		return false, []byte("Port forwarding is disabled")
 	}
 
+	// Forwards that are requested by tunnel ID may not know the port, so the tunnel's port is bound instead, and
+	//	returned to the client like a port that the server allocated.
+	bindPort := uint32(tunnel.RegisteredPort)
+
+	// Track the forward, so that the client can cancel it without closing its other forwards
+	forwards, addr := getReverseForwards(ctx), reverseForwardAddr(payload.BindAddr, bindPort)
+	cancelled, ok := forwards.open(addr)
+	if !ok {
+		return false, []byte("Port is already forwarded")
+	}
+
 	// Get a reference to the connection
 	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
 
 	// We've validated the connection and the port forwarding request.
-	//	Pass this off to the tunnel to re-establish the connection.
+	//	Pass this off to the tunnel to re-establish the connection, and wait for it to admit the client.
+	admitted := make(chan error, 1)
 	tunnel.Connections <- ReverseForwardingConnection{
-		Context: ctx,
+		Context:   ctx,
+		BindAddr:  payload.BindAddr,
+		BindPort:  bindPort,
+		cancelled: cancelled,
+		admitted:  admitted,
+		cancel: func() {
+			forwards.cancel(addr)
+		},
+		closeConn: conn.Close,
 
 		// Dial exposes an interface to make upstream connections through this SSH tunnel
 		Dial: func() (io.ReadWriteCloser, error) {
 			// Open an upstream connection through a new `forwarded-tcpip` channel
 			ch, reqs, err := conn.OpenChannel(forwardedTCPChannelType, gossh.Marshal(remoteForwardChannelData{
 				// Pass along a fake originator address and port, since we don't know what the client's address is.
-				OriginAddr: "[::1]",
+				OriginAddr: "::1",
 				OriginPort: 22,
 
 				// We should initiate an upstream connection to the port that was bound in this forwarding request.
 				DestAddr: payload.BindAddr,
-				DestPort: payload.BindPort,
+				DestPort: bindPort,
 			}))
 			if err != nil {
 				return nil, err
@@ -81,19 +196,23 @@ func (h *ReverseForwardingHandler) openPortForwarding(ctx ssh.Context, payload r
 			return ch, nil
 		},
 	}
-	return true, gossh.Marshal(&remoteForwardSuccess{payload.BindPort})
+	select {
+	case err := <-admitted:
+		if err != nil {
+			forwards.cancel(addr)
+			return false, []byte(err.Error())
+		}
+	case <-ctx.Done():
+		forwards.cancel(addr)
+		return false, []byte{}
+	}
+	return true, gossh.Marshal(&remoteForwardSuccess{bindPort})
 }
 
-// closePortForwarding handles a request from the SSH client to close port forwarding
+// closePortForwarding handles a request from the SSH client to close port forwarding. Only the forward indicated by
+// BindAddr and BindPort is stopped, and the connection's other forwards stay open.
 func (h *ReverseForwardingHandler) closePortForwarding(ctx ssh.Context, payload remoteForwardCancelRequest) (bool, []byte) {
-	// Get a reference to the connection
-	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
-
-	// We could just cancel the specific forwarder that was opened (indicated by BindAddr and BindPort on `payload`),
-	//	but today we only support one forwarder per connection, so we should just close the connection
-	conn.Close()
-
-	return true, nil
+	return getReverseForwards(ctx).cancel(reverseForwardAddr(payload.BindAddr, payload.BindPort)), nil
 }
 
 const (
@@ -0,0 +1,242 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/stats"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestReverseSSHServer starts an SSHServer, and waits for it to accept connections. Options configure the server
+// before it starts.
+func startTestReverseSSHServer(t *testing.T, options ...func(*SSHServer)) (*SSHServer, string) {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(getFreePort()))
+	server := NewSSHServer(addr, nil, log.Get(), stats.New(&statsd.NoOpClient{}))
+	for _, option := range options {
+		option(server)
+	}
+	go func() {
+		_ = server.Start()
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return server, addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("SSH server did not start")
+	return nil, ""
+}
+
+// registerTestReverseTunnel registers a tunnel with the SSH server, and returns the channel its admitted forwards are
+// sent to. admit decides whether each forward is admitted.
+func registerTestReverseTunnel(server *SSHServer, port int, key ssh.PublicKey, admit func() error) <-chan ReverseForwardingConnection {
+	connections := make(chan ReverseForwardingConnection)
+	server.RegisterTunnel(SSHServerRegisteredTunnel{
+		ID:             uuid.New(),
+		RegisteredPort: port,
+		AuthorizedKeys: []ssh.PublicKey{key},
+		Connections:    connections,
+	})
+
+	admitted := make(chan ReverseForwardingConnection, 1)
+	go func() {
+		for conn := range connections {
+			err := admit()
+			conn.admit(err)
+			if err == nil {
+				admitted <- conn
+			}
+		}
+	}()
+	return admitted
+}
+
+func admitTestForward() error {
+	return nil
+}
+
+func receiveTestForward(t *testing.T, connections <-chan ReverseForwardingConnection) ReverseForwardingConnection {
+	select {
+	case conn := <-connections:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("port forward was not received")
+		return ReverseForwardingConnection{}
+	}
+}
+
+func TestSSHServer_MultipleForwards(t *testing.T) {
+	server, addr := startTestReverseSSHServer(t)
+
+	clientKey := newTestSigner(t)
+	firstPort, secondPort := getFreePort(), getFreePort()
+	firstConnections := registerTestReverseTunnel(server, firstPort, clientKey.PublicKey(), admitTestForward)
+	secondConnections := registerTestReverseTunnel(server, secondPort, clientKey.PublicKey(), admitTestForward)
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "passage",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(clientKey)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	// Forward both tunnels over the same SSH connection
+	firstListener, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(firstPort)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	secondListener, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(secondPort)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer secondListener.Close()
+
+	first := receiveTestForward(t, firstConnections)
+	second := receiveTestForward(t, secondConnections)
+	assert.Equal(t, first.SessionID(), second.SessionID())
+
+	// Cancelling one forward leaves the other, and the connection, open
+	_ = firstListener.Close()
+	select {
+	case <-first.Cancelled():
+	case <-time.After(5 * time.Second):
+		t.Fatal("port forward was not cancelled")
+	}
+	select {
+	case <-second.Cancelled():
+		t.Fatal("other port forward was cancelled")
+	case <-second.Done():
+		t.Fatal("SSH connection was closed")
+	default:
+	}
+
+	// The remaining forward still reaches the client
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := secondListener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	upstream, err := second.Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer upstream.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-ctx.Done():
+		t.Fatal("forwarded connection was not accepted by the client")
+	}
+}
+
+func TestSSHServer_RejectedForward(t *testing.T) {
+	server, addr := startTestReverseSSHServer(t)
+
+	// The tunnel refuses the first forward, and admits the next
+	clientKey := newTestSigner(t)
+	port := getFreePort()
+	var attempts int
+	connections := registerTestReverseTunnel(server, port, clientKey.PublicKey(), func() error {
+		attempts++
+		if attempts == 1 {
+			return errTooManyClients
+		}
+		return nil
+	})
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "passage",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(clientKey)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	_, err = client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	assert.Error(t, err)
+
+	// The refused forward isn't left registered, so it can be requested again
+	listener, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if assert.NoError(t, err) {
+		defer listener.Close()
+		receiveTestForward(t, connections)
+	}
+}
+
+func TestSSHServer_EvictedForward(t *testing.T) {
+	server, addr := startTestReverseSSHServer(t)
+
+	// Clients are admitted to a newest-wins tunnel
+	clientKey := newTestSigner(t)
+	port := getFreePort()
+	clients := newReverseClientSet(ClientPolicyNewestWins, 0)
+	connections := make(chan ReverseForwardingConnection)
+	server.RegisterTunnel(SSHServerRegisteredTunnel{
+		ID:             uuid.New(),
+		RegisteredPort: port,
+		AuthorizedKeys: []ssh.PublicKey{clientKey.PublicKey()},
+		Connections:    connections,
+	})
+	go func() {
+		for conn := range connections {
+			_, err := clients.add(conn)
+			conn.admit(err)
+		}
+	}()
+
+	connect := func() *gossh.Client {
+		client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+			User:            "passage",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(clientKey)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	oldClient := connect()
+	defer oldClient.Close()
+	newClient := connect()
+	defer newClient.Close()
+
+	// The evicted client's connection is closed, so that it reconnects, and the newer client's stays open
+	closed := make(chan struct{})
+	go func() {
+		_ = oldClient.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("evicted client's connection was not closed")
+	}
+	_, _, err := newClient.SendRequest("keepalive@openssh.com", true, nil)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// validateAllowedSourceCIDRs checks that a reverse tunnel's allowed source addresses are CIDR ranges
+func validateAllowedSourceCIDRs(cidrs []string) error {
+	_, err := parseAllowedSourceCIDRs(cidrs)
+	return err
+}
+
+func parseAllowedSourceCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("allowedSourceCidrs must be CIDR ranges, e.g. 192.0.2.1/32, but got %q", cidr)
+		}
+		networks[i] = network
+	}
+	return networks, nil
+}
+
+// sourceAllowed reports whether a client may connect to the tunnel from its remote address. Tunnels without allowed
+// source CIDRs accept clients from any address.
+func (t SSHServerRegisteredTunnel) sourceAllowed(remote net.Addr) bool {
+	if len(t.AllowedSources) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(remoteIP(remote))
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.AllowedSources {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterSourceAllowedTunnels splits tunnels into those that allow a client's remote address, and those that don't
+func filterSourceAllowedTunnels(tunnels []SSHServerRegisteredTunnel, remote net.Addr) (allowed, rejected []SSHServerRegisteredTunnel) {
+	allowed = []SSHServerRegisteredTunnel{}
+	for _, tunnel := range tunnels {
+		if tunnel.sourceAllowed(remote) {
+			allowed = append(allowed, tunnel)
+		} else {
+			rejected = append(rejected, tunnel)
+		}
+	}
+	return allowed, rejected
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseAllowedSourceCIDRs(t *testing.T) {
+	networks, err := parseAllowedSourceCIDRs([]string{"192.0.2.0/24", "2001:db8::/32"})
+	if assert.NoError(t, err) && assert.Len(t, networks, 2) {
+		assert.Equal(t, "192.0.2.0/24", networks[0].String())
+		assert.Equal(t, "2001:db8::/32", networks[1].String())
+	}
+
+	_, err = parseAllowedSourceCIDRs([]string{"192.0.2.1"})
+	assert.ErrorContains(t, err, "allowedSourceCidrs must be CIDR ranges")
+	assert.NoError(t, validateAllowedSourceCIDRs(nil))
+}
+
+func TestSSHServerRegisteredTunnel_SourceAllowed(t *testing.T) {
+	networks, err := parseAllowedSourceCIDRs([]string{"192.0.2.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := SSHServerRegisteredTunnel{AllowedSources: networks}
+
+	assert.True(t, tunnel.sourceAllowed(&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 2222}))
+	assert.True(t, tunnel.sourceAllowed(&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.10"), Port: 2222}))
+	assert.True(t, tunnel.sourceAllowed(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2222}))
+	assert.False(t, tunnel.sourceAllowed(&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 2222}))
+
+	// Tunnels without allowed sources accept any address
+	assert.True(t, SSHServerRegisteredTunnel{}.sourceAllowed(&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 2222}))
+}
+
+func TestSSHServer_AllowedSources(t *testing.T) {
+	server, addr := startTestReverseSSHServer(t)
+	loopback, _ := parseAllowedSourceCIDRs([]string{"127.0.0.0/8"})
+	elsewhere, _ := parseAllowedSourceCIDRs([]string{"192.0.2.0/24"})
+
+	// The client's key is authorized for two tunnels, but it may only connect to one of them from the loopback address
+	clientKey := newTestSigner(t)
+	connections := make(chan ReverseForwardingConnection)
+	go func() {
+		for conn := range connections {
+			conn.admit(nil)
+		}
+	}()
+	allowed := SSHServerRegisteredTunnel{
+		ID:             uuid.New(),
+		RegisteredPort: getFreePort(),
+		AuthorizedKeys: []ssh.PublicKey{clientKey.PublicKey()},
+		AllowedSources: loopback,
+		Connections:    connections,
+	}
+	server.RegisterTunnel(allowed)
+	rejected := SSHServerRegisteredTunnel{
+		ID:             uuid.New(),
+		RegisteredPort: getFreePort(),
+		AuthorizedKeys: []ssh.PublicKey{clientKey.PublicKey()},
+		AllowedSources: elsewhere,
+	}
+	server.RegisterTunnel(rejected)
+
+	// A key that's only authorized for tunnels that don't allow the client's address is rejected
+	otherKey := newTestSigner(t)
+	server.RegisterTunnel(SSHServerRegisteredTunnel{
+		ID:             uuid.New(),
+		RegisteredPort: getFreePort(),
+		AuthorizedKeys: []ssh.PublicKey{otherKey.PublicKey()},
+		AllowedSources: elsewhere,
+	})
+
+	dial := func(key gossh.Signer) (*gossh.Client, error) {
+		return gossh.Dial("tcp", addr, &gossh.ClientConfig{
+			User:            "passage",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(key)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	_, err := dial(otherKey)
+	assert.Error(t, err)
+
+	client, err := dial(clientKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	forward := func(port int) bool {
+		ok, _, err := client.SendRequest(sshTCPForwardOpenEvent, true, gossh.Marshal(remoteForwardOpenRequest{"127.0.0.1", uint32(port)}))
+		assert.NoError(t, err)
+		return ok
+	}
+	assert.True(t, forward(allowed.RegisteredPort))
+	assert.False(t, forward(rejected.RegisteredPort))
+
+	// The client's address is checked again when it forwards, in case the tunnel's allowed sources have changed
+	allowed.AllowedSources = elsewhere
+	server.RegisterTunnel(allowed)
+	assert.False(t, forward(allowed.RegisteredPort))
+}
@@ -8,13 +8,33 @@ import (
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 // SSHServer runs a reverse SSH server that accepts connections from SSH clients and forwards them to the appropriate tunnel.
 type SSHServer struct {
 	BindAddr string
-	HostKey  []byte
+
+	// CryptoPolicy restricts the algorithms that clients may negotiate
+	CryptoPolicy CryptoPolicy
+
+	// Limits protect the server from brute force attacks and floods of connections
+	Limits SSHServerLimits
+
+	// TrustedUserCAKeys are CAs whose user certificates are accepted. A certificate authorizes the tunnels whose IDs
+	//	are among its principals, or are its key ID.
+	TrustedUserCAKeys []gossh.PublicKey
+
+	// hostKeys are shared with the servers created by WithBindAddr, and hostSigners are this server's signers for them
+	hostKeys    *hostKeySet
+	hostSigners hostSigners
+
+	// limiter is also shared with the servers created by WithBindAddr
+	limiter *sshConnectionLimiter
 
 	server  *ssh.Server
 	tunnels map[uuid.UUID]SSHServerRegisteredTunnel
@@ -22,6 +42,11 @@ type SSHServer struct {
 	logger  *log.Logger
 	stats   stats.Stats
 
+	// Indexes of the registered tunnels, so that authentication and port forward requests don't scan every tunnel.
+	//	tunnelsByKey is keyed by the fingerprints of the tunnels' authorized keys.
+	tunnelsByKey  map[string]map[uuid.UUID]struct{}
+	tunnelsByPort map[int]uuid.UUID
+
 	sync.RWMutex
 }
 
@@ -31,39 +56,126 @@ type SSHServerRegisteredTunnel struct {
 	RegisteredPort int
 	AuthorizedKeys []ssh.PublicKey
 	Connections    chan<- ReverseForwardingConnection
+
+	// AllowedSources restricts the addresses that clients may connect from. If it's empty, any address is allowed.
+	AllowedSources []*net.IPNet
+
+	// KeyOptions are the authorized_keys options of the authorized keys, by fingerprint
+	KeyOptions map[string]AuthorizedKeyOptions
+
+	// OnHandshake is called with the details of each SSH connection that forwards to the tunnel. It's called in its own
+	//	goroutine, so it may block. It may be nil.
+	OnHandshake func(SSHHandshake)
+}
+
+// NewSSHServer creates an SSH server with one or more PEM encoded host keys. If there are none, a key is generated.
+func NewSSHServer(addr string, hostKeys []byte, logger *log.Logger, st stats.Stats) *SSHServer {
+	return newSSHServer(addr, newHostKeySet(hostKeys), newSSHConnectionLimiter(), logger, st)
 }
 
-func NewSSHServer(addr string, hostKey []byte, logger *log.Logger, st stats.Stats) *SSHServer {
+func newSSHServer(addr string, hostKeys *hostKeySet, limiter *sshConnectionLimiter, logger *log.Logger, st stats.Stats) *SSHServer {
 	return &SSHServer{
 		BindAddr: addr,
-		HostKey:  hostKey,
+		hostKeys: hostKeys,
+		limiter:  limiter,
 
 		logger:  logger,
 		stats:   st,
 		tunnels: make(map[uuid.UUID]SSHServerRegisteredTunnel),
 		close:   make(chan bool),
+
+		tunnelsByKey:  make(map[string]map[uuid.UUID]struct{}),
+		tunnelsByPort: make(map[int]uuid.UUID),
 	}
 }
 
+// WithBindAddr returns a new SSH server, with the same host keys and configuration, that listens on another address
+func (s *SSHServer) WithBindAddr(addr string) *SSHServer {
+	server := newSSHServer(addr, s.hostKeys, s.limiter, s.logger, s.stats)
+	server.CryptoPolicy = s.CryptoPolicy
+	server.Limits = s.Limits
+	server.TrustedUserCAKeys = s.TrustedUserCAKeys
+	return server
+}
+
 var ErrSshServerClosed = ssh.ErrServerClosed
 
+// SetHostKeys replaces the host keys of this server, and of the servers created from it by WithBindAddr, while they
+// run. New connections are offered the new keys, and established connections are unaffected.
+func (s *SSHServer) SetHostKeys(hostKeys []byte) error {
+	return s.hostKeys.set(hostKeys)
+}
+
+// Start listens on BindAddr, and serves SSH connections until the server is closed
 func (s *SSHServer) Start() error {
+	listener, err := net.Listen("tcp", s.BindAddr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves SSH connections from the listener until the server is closed
+func (s *SSHServer) Serve(listener net.Listener) error {
 	server := &ssh.Server{
 		Addr: s.BindAddr,
 		ChannelHandlers: map[string]ssh.ChannelHandler{
 			"session": ssh.DefaultSessionHandler,
 		},
+
+		ConnCallback: func(ctx ssh.Context, conn net.Conn) net.Conn {
+			// Reject banned clients, and connections beyond the limit of unauthenticated connections
+			attempt, reason := s.limiter.open(s.Limits, remoteIP(conn.RemoteAddr()))
+			if attempt == nil {
+				s.logger.With(zap.String("remote_addr", conn.RemoteAddr().String()), zap.String("reason", reason)).Debug("Reject connection")
+				s.stats.Incr(StatSshdConnectionRejections, stats.Tags{"reason": reason}, 1)
+				return nil
+			}
+			attempt.startTimeout(conn)
+			ctx.SetValue(connectionAttemptContextKey, attempt)
+
+			// Record the version and key exchange of each connection, so that they can be reported to its tunnel
+			recorder := newHandshakeRecorder(conn)
+			ctx.SetValue(handshakeRecorderContextKey, recorder)
+
+			// Count connections that close without authenticating as failures
+			return &limitedConn{Conn: recorder, onClose: func() {
+				reason, banned := attempt.close()
+				if reason == "" {
+					return
+				}
+				s.stats.Incr(StatSshdConnectionRejections, stats.Tags{"reason": reason}, 1)
+				if banned {
+					s.logger.With(zap.String("remote_ip", attempt.ip), zap.Duration("ban_duration", s.Limits.BanDuration)).Warn("Banned client after repeated authentication failures")
+				}
+			}}
+		},
+
+		// Restrict the key exchanges, ciphers, and MACs to the crypto policy
+		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
+			config := &gossh.ServerConfig{Config: s.CryptoPolicy.config()}
+
+			// Release the connection's unauthenticated slot, and stop its handshake timeout, once it authenticates
+			if attempt, ok := ctx.Value(connectionAttemptContextKey).(*sshConnectionAttempt); ok {
+				config.AuthLogCallback = func(conn gossh.ConnMetadata, method string, err error) {
+					attempt.authenticate(err)
+				}
+			}
+			return config
+		},
 	}
 
-	// Set sshd host key
-	hostSigners, err := s.getHostSigners()
-	if err != nil {
+	// Set sshd host keys, and keep them up to date as they're rotated
+	if err := s.hostKeys.attach(s, server); err != nil {
+		_ = listener.Close()
 		return errors.Wrap(err, "get host signers")
 	}
-	server.HostSigners = hostSigners
+	defer s.hostKeys.detach(s)
 
 	// SSH session handler. Hold connections open until cancelled.
 	server.Handler = func(session ssh.Session) {
+		s.announceHostKeys(session.Context())
+
 		select {
 		// Close session if client closes
 		case <-session.Context().Done():
@@ -80,17 +192,51 @@ func (s *SSHServer) Start() error {
 	if err := server.SetOption(ssh.PublicKeyAuth(func(ctx ssh.Context, incomingKey ssh.PublicKey) bool {
 		logger := sshSessionLogger(s.logger, ctx)
 
-		success, authorizedTunnels := func() (bool, []SSHServerRegisteredTunnel) {
-			// Identify the set of tunnels that match the incoming public key
-			authorizedTunnels := s.getAuthorizedTunnels(incomingKey)
+		success, authorizedTunnels, reason := func() (bool, []SSHServerRegisteredTunnel, string) {
+			// Identify the set of tunnels that match the incoming public key, or that the certificate was issued for
+			var authorizedTunnels []SSHServerRegisteredTunnel
+			if cert, ok := incomingKey.(*gossh.Certificate); ok {
+				var err error
+				if authorizedTunnels, err = s.getCertificateAuthorizedTunnels(ctx, cert); err != nil {
+					logger.Debugw("Reject certificate", zap.Error(err))
+					return false, []SSHServerRegisteredTunnel{}, sshdRejectReasonUnauthorizedCertificate
+				}
+			} else {
+				authorizedTunnels = s.getAuthorizedTunnels(incomingKey)
+			}
 
 			// Reject the SSH session if there are no authorized tunnels
 			if len(authorizedTunnels) == 0 {
 				logger.Debug("No authorized tunnels for public key")
-				return false, []SSHServerRegisteredTunnel{}
+				return false, []SSHServerRegisteredTunnel{}, sshdRejectReasonUnauthorizedKey
+			}
+
+			// Drop the tunnels that don't allow the client's source address
+			authorizedTunnels, rejectedTunnels := filterSourceAllowedTunnels(authorizedTunnels, ctx.RemoteAddr())
+			if len(rejectedTunnels) > 0 {
+				s.rejectSource(logger, rejectedTunnels, "auth")
+			}
+			if len(authorizedTunnels) == 0 {
+				return false, authorizedTunnels, sshdRejectReasonSourceNotAllowed
 			}
 
-			return true, authorizedTunnels
+			// Drop the tunnels whose options for the key don't allow the connection, e.g. because the key has expired
+			fingerprint := gossh.FingerprintSHA256(incomingKey)
+			allowedTunnels := []SSHServerRegisteredTunnel{}
+			var keyReason string
+			for _, tunnel := range authorizedTunnels {
+				if reason := tunnel.KeyOptions[fingerprint].checkConnection(ctx.RemoteAddr(), time.Now()); reason != "" {
+					logger.With(zap.String("tunnel_id", tunnel.ID.String()), zap.String("reason", reason)).Warn("Reject key by its options")
+					keyReason = reason
+					continue
+				}
+				allowedTunnels = append(allowedTunnels, tunnel)
+			}
+			if len(allowedTunnels) == 0 {
+				return false, allowedTunnels, keyReason
+			}
+
+			return true, allowedTunnels, ""
 		}()
 
 		logger.With(
@@ -101,7 +247,14 @@ func (s *SSHServer) Start() error {
 			zap.Bool("success", success),
 			zap.Int("authorized_tunnels", len(authorizedTunnels)),
 		).Debug("Handle authentication attempt")
-		s.stats.Incr(StatSshdConnectionsRequests, stats.Tags{"success": success}, 1)
+		tags := stats.Tags{"success": success}
+		if !success {
+			tags["reason"] = reason
+		}
+		s.stats.Incr(StatSshdConnectionsRequests, tags, 1)
+
+		// Like the authorized tunnels, only the last key is authenticated
+		ctx.SetValue(clientKeyFingerprintContextKey, gossh.FingerprintSHA256(incomingKey))
 
 		// Register the authorized tunnels onto the ssh.Context
 		//	Note: This must override the set of authorized tunnels, as only the last key passed to this function
@@ -110,6 +263,7 @@ func (s *SSHServer) Start() error {
 
 		return success
 	})); err != nil {
+		_ = listener.Close()
 		return err
 	}
 
@@ -117,53 +271,96 @@ func (s *SSHServer) Start() error {
 	server.ReversePortForwardingCallback = func(ctx ssh.Context, bindHost string, bindPort uint32) bool {
 		logger := sshSessionLogger(s.logger, ctx)
 
-		success, tunnelId := func() (bool, string) {
+		success, tunnel, reason := func() (bool, SSHServerRegisteredTunnel, string) {
 			tunnels := getAuthorizedTunnels(ctx)
 
 			// If there are no valid tunnels, reject the forwarding request
 			if len(tunnels) == 0 {
 				logger.Debug("No authorized tunnels for session")
-				return false, ""
+				return false, SSHServerRegisteredTunnel{}, sshdRejectReasonUnauthorizedForward
 			}
 
-			// Check the requested bind port against the set of authorized tunnels
-			var tunnelId uuid.UUID
-			var success bool
-			for _, tunnel := range tunnels {
-				// If the requested port matches a valid tunnel port, we're good to go
-				if int(bindPort) == tunnel.RegisteredPort {
-					success = true
-					tunnelId = tunnel.ID
-					break
-				}
+			// Check the requested bind address and port against the set of authorized tunnels
+			tunnel, ok := matchForwardTunnel(tunnels, bindHost, int(bindPort))
+			if !ok {
+				return false, tunnel, sshdRejectReasonUnauthorizedForward
+			}
+
+			// Check the client's source address again, as the tunnel's allowed sources may have changed since the
+			//	client authenticated
+			if current, ok := s.getTunnelForForward(ctx, bindHost, int(bindPort)); ok && current.ID == tunnel.ID {
+				tunnel = current
+			}
+			if !tunnel.sourceAllowed(ctx.RemoteAddr()) {
+				s.rejectSource(logger, []SSHServerRegisteredTunnel{tunnel}, "forward")
+				return false, tunnel, sshdRejectReasonSourceNotAllowed
+			}
+
+			// Check the connection and the forward against the options of the client's key, e.g. permitlisten
+			fingerprint, _ := ctx.Value(clientKeyFingerprintContextKey).(string)
+			options := tunnel.KeyOptions[fingerprint]
+			reason := options.checkConnection(ctx.RemoteAddr(), time.Now())
+			if reason == "" {
+				reason = options.checkForward(bindHost, int(bindPort))
 			}
-			return success, tunnelId.String()
+			if reason != "" {
+				logger.With(zap.String("tunnel_id", tunnel.ID.String()), zap.String("reason", reason)).Warn("Reject port forward by key options")
+				return false, tunnel, reason
+			}
+			return true, tunnel, ""
 		}()
 
+		// Report the connection's handshake to the tunnel it forwards to, without holding up the forward
+		if success && tunnel.OnHandshake != nil {
+			go tunnel.OnHandshake(s.getHandshake(ctx))
+		}
+
 		logger.With(
-			zap.String("tunnel_id", tunnelId),
+			zap.String("tunnel_id", tunnel.ID.String()),
 			zap.Dict("req",
 				zap.String("bind_address", bindHost),
 				zap.Uint32("bind_port", bindPort)),
 			zap.Bool("success", success),
 		).Debug("Reverse port forwarding request")
-		s.stats.Incr(StatSshReversePortForwardingRequests, stats.Tags{"success": success}, 1)
+		tags := stats.Tags{"success": success}
+		if !success {
+			tags["reason"] = reason
+		}
+		s.stats.Incr(StatSshReversePortForwardingRequests, tags, 1)
 
 		return success
 	}
 
 	// Handle reverse port forwarding requests
 	handler := &ReverseForwardingHandler{
-		GetTunnel: s.getTunnelFromRegisteredPort,
+		GetTunnel: s.getTunnelForForward,
 	}
 	server.RequestHandlers = map[string]ssh.RequestHandler{
-		"tcpip-forward":        handler.HandleSSHRequest,
-		"cancel-tcpip-forward": handler.HandleSSHRequest,
+		"tcpip-forward": func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+			// Announce the host keys once the client has authenticated. Reverse tunnel clients usually don't open a
+			//	session, so their first port forward is the first chance to do so.
+			s.announceHostKeys(ctx)
+			return handler.HandleSSHRequest(ctx, srv, req)
+		},
+		"cancel-tcpip-forward":   handler.HandleSSHRequest,
+		hostKeysProveRequestType: s.proveHostKeys,
 	}
 
 	s.logger.With(zap.String("bind_addr", s.BindAddr)).Infof("Listening on %s", s.BindAddr)
-	s.server = server
-	if err := s.server.ListenAndServe(); err != nil {
+
+	// The server may have been closed before it started serving
+	s.Lock()
+	select {
+	case <-s.close:
+		s.Unlock()
+		_ = listener.Close()
+		return ErrSshServerClosed
+	default:
+		s.server = server
+	}
+	s.Unlock()
+
+	if err := server.Serve(listener); err != nil {
 		return err
 	}
 
@@ -172,18 +369,61 @@ func (s *SSHServer) Start() error {
 
 func (s *SSHServer) Close() error {
 	close(s.close)
-	if s.server == nil {
+
+	s.RLock()
+	server := s.server
+	s.RUnlock()
+	if server == nil {
 		return nil
 	}
-	return s.server.Close()
+	return server.Close()
 }
 
-// getTunnelFromRegisteredPort resolves a given port to the registered tunnel associated with it
-func (s *SSHServer) getTunnelFromRegisteredPort(port int) (SSHServerRegisteredTunnel, bool) {
+// rejectSource logs and counts the tunnels that a client was refused because of its source address
+func (s *SSHServer) rejectSource(logger *log.Logger, tunnels []SSHServerRegisteredTunnel, stage string) {
+	ids := make([]string, len(tunnels))
+	for i, tunnel := range tunnels {
+		ids[i] = tunnel.ID.String()
+	}
+	logger.With(zap.Strings("tunnel_ids", ids), zap.String("stage", stage)).Warn("Reject client source address")
+	s.stats.Count(StatSshdSourceRejections, int64(len(tunnels)), stats.Tags{"stage": stage}, 1)
+}
+
+// getTunnelForForward resolves a port forward's bind address and port to the registered tunnel associated with it,
+// among those that the connection is authorized for
+func (s *SSHServer) getTunnelForForward(ctx ssh.Context, bindAddr string, port int) (SSHServerRegisteredTunnel, bool) {
 	s.RLock()
 	defer s.RUnlock()
 
-	for _, tunnel := range s.tunnels {
+	authorizedTunnels := getAuthorizedTunnels(ctx)
+	isAuthorized := func(id uuid.UUID) bool {
+		return slices.ContainsFunc(authorizedTunnels, func(tunnel SSHServerRegisteredTunnel) bool {
+			return tunnel.ID == id
+		})
+	}
+
+	// The authorized tunnels in the context may be stale, so use the currently registered ones. As in
+	//	matchForwardTunnel, a tunnel ID takes precedence over a port.
+	if id, err := uuid.Parse(bindAddr); err == nil && id.String() == bindAddr && isAuthorized(id) {
+		if tunnel, ok := s.tunnels[id]; ok {
+			return tunnel, true
+		}
+	}
+	if id, ok := s.tunnelsByPort[port]; ok && isAuthorized(id) {
+		return s.tunnels[id], true
+	}
+	return SSHServerRegisteredTunnel{}, false
+}
+
+// matchForwardTunnel finds the tunnel that a port forward is for. Clients may forward the tunnel's registered port,
+// or use the tunnel's ID as the bind address so that they don't need to know its port.
+func matchForwardTunnel(tunnels []SSHServerRegisteredTunnel, bindAddr string, port int) (SSHServerRegisteredTunnel, bool) {
+	for _, tunnel := range tunnels {
+		if tunnel.ID.String() == bindAddr {
+			return tunnel, true
+		}
+	}
+	for _, tunnel := range tunnels {
 		if tunnel.RegisteredPort == port {
 			return tunnel, true
 		}
@@ -201,7 +441,12 @@ func (s *SSHServer) RegisterTunnel(tunnel SSHServerRegisteredTunnel) {
 		zap.Int("registered_port", tunnel.RegisteredPort),
 	).Debug("Registering tunnel")
 
+	// Replace the tunnel's index entries if it's already registered
+	if existing, ok := s.tunnels[tunnel.ID]; ok {
+		s.unindexTunnel(existing)
+	}
 	s.tunnels[tunnel.ID] = tunnel
+	s.indexTunnel(tunnel)
 }
 
 // DeregisterTunnel removes the reverse tunnel from the SSH server
@@ -213,9 +458,40 @@ func (s *SSHServer) DeregisterTunnel(tunnelId uuid.UUID) {
 		zap.String("tunnel_id", tunnelId.String()),
 	).Debug("Deregistering tunnel")
 
+	if tunnel, ok := s.tunnels[tunnelId]; ok {
+		s.unindexTunnel(tunnel)
+	}
 	delete(s.tunnels, tunnelId)
 }
 
+// indexTunnel adds a tunnel to the indexes. The caller must hold the write lock.
+func (s *SSHServer) indexTunnel(tunnel SSHServerRegisteredTunnel) {
+	for _, key := range tunnel.AuthorizedKeys {
+		fingerprint := gossh.FingerprintSHA256(key)
+		if s.tunnelsByKey[fingerprint] == nil {
+			s.tunnelsByKey[fingerprint] = make(map[uuid.UUID]struct{})
+		}
+		s.tunnelsByKey[fingerprint][tunnel.ID] = struct{}{}
+	}
+	s.tunnelsByPort[tunnel.RegisteredPort] = tunnel.ID
+}
+
+// unindexTunnel removes a tunnel from the indexes. The caller must hold the write lock.
+func (s *SSHServer) unindexTunnel(tunnel SSHServerRegisteredTunnel) {
+	for _, key := range tunnel.AuthorizedKeys {
+		fingerprint := gossh.FingerprintSHA256(key)
+		delete(s.tunnelsByKey[fingerprint], tunnel.ID)
+		if len(s.tunnelsByKey[fingerprint]) == 0 {
+			delete(s.tunnelsByKey, fingerprint)
+		}
+	}
+
+	// Another tunnel may have since registered the same port
+	if s.tunnelsByPort[tunnel.RegisteredPort] == tunnel.ID {
+		delete(s.tunnelsByPort, tunnel.RegisteredPort)
+	}
+}
+
 // getAuthorizedTunnels matches an incoming ssh.PublicKey against tunnels registered with this SSH server.
 // This serves to determine the set of authorized bind ports that a given SSH connection can forward to.
 func (s *SSHServer) getAuthorizedTunnels(incomingKey ssh.PublicKey) []SSHServerRegisteredTunnel {
@@ -223,31 +499,47 @@ func (s *SSHServer) getAuthorizedTunnels(incomingKey ssh.PublicKey) []SSHServerR
 	defer s.RUnlock()
 
 	var authorizedTunnels []SSHServerRegisteredTunnel
-	for _, tunnel := range s.tunnels {
-		for _, authorizedKey := range tunnel.AuthorizedKeys {
-			if ssh.KeysEqual(authorizedKey, incomingKey) {
-				authorizedTunnels = append(authorizedTunnels, tunnel)
-			}
-		}
+	for id := range s.tunnelsByKey[gossh.FingerprintSHA256(incomingKey)] {
+		authorizedTunnels = append(authorizedTunnels, s.tunnels[id])
 	}
 
 	return authorizedTunnels
 }
 
-func (s *SSHServer) getHostSigners() ([]ssh.Signer, error) {
-	var hostSigners []ssh.Signer
-	if len(s.HostKey) != 0 {
-		signers, err := getSignersForPrivateKey(s.HostKey)
-		if err != nil {
-			return hostSigners, err
-		}
-		for _, signer := range signers {
-			// Convert from `x/crypto/ssh` Signer to `gliderlabs/ssh` Signer
-			hostSigners = append(hostSigners, signer)
-		}
+// Keys for the values that describe a connection's handshake in the ssh.Context
+const (
+	handshakeRecorderContextKey    = "handshake_recorder"
+	clientKeyFingerprintContextKey = "client_key_fingerprint"
+)
+
+const connectionAttemptContextKey = "connection_attempt"
+
+// getHandshake describes how an authenticated SSH connection was negotiated
+func (s *SSHServer) getHandshake(ctx ssh.Context) SSHHandshake {
+	handshake := SSHHandshake{
+		Host:       ctx.RemoteAddr().String(),
+		AuthMethod: "publickey",
+		Time:       time.Now(),
+	}
+	if recorder, ok := ctx.Value(handshakeRecorderContextKey).(*handshakeRecorder); ok {
+		recorder.describe(&handshake, false)
+	}
+	if fingerprint, ok := ctx.Value(clientKeyFingerprintContextKey).(string); ok {
+		handshake.ClientKeyFingerprint = fingerprint
 	}
+	handshake.HostKeyFingerprint = hostKeyFingerprint(s.getCurrentHostSigners().signers, handshake.HostKeyAlgorithm)
+	return handshake
+}
 
-	return hostSigners, nil
+// hostKeyFingerprint returns the fingerprint of the host key that was negotiated with a host key algorithm
+func hostKeyFingerprint(signers []gossh.Signer, algorithm string) string {
+	for _, signer := range signers {
+		keyType := signer.PublicKey().Type()
+		if keyType == algorithm || (keyType == gossh.KeyAlgoRSA && strings.HasPrefix(algorithm, "rsa-sha2-")) {
+			return gossh.FingerprintSHA256(signer.PublicKey())
+		}
+	}
+	return ""
 }
 
 func sshSessionLogger(logger *log.Logger, ctx ssh.Context) *log.Logger {
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/stats"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"testing"
+)
+
+// testSSHContext is an ssh.Context that only holds values, for calling the SSH server's callbacks directly
+type testSSHContext struct {
+	ssh.Context
+	values map[interface{}]interface{}
+}
+
+func newTestSSHContext() testSSHContext {
+	return testSSHContext{values: make(map[interface{}]interface{})}
+}
+
+func (c testSSHContext) Value(key interface{}) interface{} {
+	return c.values[key]
+}
+
+func (c testSSHContext) SetValue(key, value interface{}) {
+	c.values[key] = value
+}
+
+func newTestPublicKey(t testing.TB) ssh.PublicKey {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func tunnelIDs(tunnels []SSHServerRegisteredTunnel) []uuid.UUID {
+	ids := make([]uuid.UUID, len(tunnels))
+	for i, tunnel := range tunnels {
+		ids[i] = tunnel.ID
+	}
+	return ids
+}
+
+func TestSSHServer_TunnelIndexes(t *testing.T) {
+	server := NewSSHServer("127.0.0.1:0", nil, log.Get(), stats.New(&statsd.NoOpClient{}))
+	sharedKey, firstKey, nextKey := newTestPublicKey(t), newTestPublicKey(t), newTestPublicKey(t)
+
+	first := SSHServerRegisteredTunnel{ID: uuid.New(), RegisteredPort: 1000, AuthorizedKeys: []ssh.PublicKey{sharedKey, firstKey}}
+	second := SSHServerRegisteredTunnel{ID: uuid.New(), RegisteredPort: 1001, AuthorizedKeys: []ssh.PublicKey{sharedKey}}
+	server.RegisterTunnel(first)
+	server.RegisterTunnel(second)
+
+	assert.ElementsMatch(t, []uuid.UUID{first.ID, second.ID}, tunnelIDs(server.getAuthorizedTunnels(sharedKey)))
+	assert.ElementsMatch(t, []uuid.UUID{first.ID}, tunnelIDs(server.getAuthorizedTunnels(firstKey)))
+	assert.Empty(t, server.getAuthorizedTunnels(nextKey))
+
+	// Forwards are matched by port or tunnel ID, among the tunnels that the connection is authorized for
+	ctx := newTestSSHContext()
+	setAuthorizedTunnels(ctx, []SSHServerRegisteredTunnel{first})
+	tunnel, ok := server.getTunnelForForward(ctx, "localhost", 1000)
+	assert.True(t, ok)
+	assert.Equal(t, first.ID, tunnel.ID)
+	tunnel, ok = server.getTunnelForForward(ctx, first.ID.String(), 0)
+	assert.True(t, ok)
+	assert.Equal(t, first.ID, tunnel.ID)
+	_, ok = server.getTunnelForForward(ctx, "localhost", 1001)
+	assert.False(t, ok)
+	_, ok = server.getTunnelForForward(ctx, second.ID.String(), 0)
+	assert.False(t, ok)
+
+	// Registering a tunnel again replaces its keys and port
+	first.AuthorizedKeys = []ssh.PublicKey{nextKey}
+	first.RegisteredPort = 1002
+	server.RegisterTunnel(first)
+
+	assert.ElementsMatch(t, []uuid.UUID{second.ID}, tunnelIDs(server.getAuthorizedTunnels(sharedKey)))
+	assert.Empty(t, server.getAuthorizedTunnels(firstKey))
+	assert.ElementsMatch(t, []uuid.UUID{first.ID}, tunnelIDs(server.getAuthorizedTunnels(nextKey)))
+	_, ok = server.getTunnelForForward(ctx, "localhost", 1000)
+	assert.False(t, ok)
+	tunnel, ok = server.getTunnelForForward(ctx, "localhost", 1002)
+	assert.True(t, ok)
+	assert.Equal(t, 1002, tunnel.RegisteredPort)
+
+	// Deregistered tunnels are removed from the indexes
+	server.DeregisterTunnel(first.ID)
+	server.DeregisterTunnel(second.ID)
+	assert.Empty(t, server.getAuthorizedTunnels(sharedKey))
+	assert.Empty(t, server.getAuthorizedTunnels(nextKey))
+	_, ok = server.getTunnelForForward(ctx, "localhost", 1002)
+	assert.False(t, ok)
+	assert.Empty(t, server.tunnelsByKey)
+	assert.Empty(t, server.tunnelsByPort)
+}
+
+// newBenchmarkSSHServer registers tunnels, each with its own key, and returns the key and tunnel of the last one
+func newBenchmarkSSHServer(b *testing.B, tunnels int) (*SSHServer, ssh.PublicKey, SSHServerRegisteredTunnel) {
+	server := NewSSHServer("127.0.0.1:0", nil, log.Get(), stats.New(&statsd.NoOpClient{}))
+
+	var key ssh.PublicKey
+	var tunnel SSHServerRegisteredTunnel
+	for i := 0; i < tunnels; i++ {
+		key = newTestPublicKey(b)
+		tunnel = SSHServerRegisteredTunnel{ID: uuid.New(), RegisteredPort: 10000 + i, AuthorizedKeys: []ssh.PublicKey{key}}
+		server.RegisterTunnel(tunnel)
+	}
+	return server, key, tunnel
+}
+
+var benchmarkTunnelCounts = []int{10, 1000, 10000}
+
+func BenchmarkSSHServer_GetAuthorizedTunnels(b *testing.B) {
+	for _, count := range benchmarkTunnelCounts {
+		b.Run(fmt.Sprintf("tunnels=%d", count), func(b *testing.B) {
+			server, key, _ := newBenchmarkSSHServer(b, count)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if len(server.getAuthorizedTunnels(key)) != 1 {
+					b.Fatal("tunnel not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSSHServer_GetTunnelForForward(b *testing.B) {
+	for _, count := range benchmarkTunnelCounts {
+		b.Run(fmt.Sprintf("tunnels=%d", count), func(b *testing.B) {
+			server, _, tunnel := newBenchmarkSSHServer(b, count)
+			ctx := newTestSSHContext()
+			setAuthorizedTunnels(ctx, []SSHServerRegisteredTunnel{tunnel})
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, ok := server.getTunnelForForward(ctx, "localhost", tunnel.RegisteredPort); !ok {
+					b.Fatal("tunnel not found")
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,22 @@
 package tunnel
 
+import (
+	"context"
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/log"
+	"github.com/hightouchio/passage/stats"
+	keystoreInMemory "github.com/hightouchio/passage/tunnel/keystore/in_memory"
+	"github.com/hightouchio/passage/tunnel/postgres"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
 // import (
 //
 //	"context"
@@ -145,3 +162,120 @@ package tunnel
 //func (d MockReverseDatabase) GetReverseTunnelAuthorizedKeys(ctx context.Context, tunnelID uuid.UUID) ([]postgres.Key, error) {
 //	return []postgres.Key{}, nil
 //}
+
+type testReverseTunnelSQL struct {
+	keyID       uuid.UUID
+	otherKeyIDs []uuid.UUID
+}
+
+func (s testReverseTunnelSQL) GetReverseTunnelAuthorizedKeys(ctx context.Context, tunnelID uuid.UUID) ([]postgres.Key, error) {
+	keys := []postgres.Key{{ID: s.keyID}}
+	for _, keyID := range s.otherKeyIDs {
+		keys = append(keys, postgres.Key{ID: keyID})
+	}
+	return keys, nil
+}
+
+func (s testReverseTunnelSQL) SetTunnelHandshake(ctx context.Context, handshake postgres.Handshake) error {
+	return nil
+}
+
+func TestReverseTunnel_DedicatedSSHServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(stats.InjectContext(context.Background(), stats.New(&statsd.NoOpClient{})))
+	defer cancel()
+
+	// Authorize the client's key
+	clientKey := newTestSigner(t)
+	keystore := keystoreInMemory.New()
+	keyID := uuid.New()
+	if err := keystore.Set(ctx, keyID, gossh.MarshalAuthorizedKey(clientKey.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shared server is never started, so the tunnel can only be reached through its dedicated server
+	sharedServer := NewSSHServer("127.0.0.1:0", nil, log.Get(), stats.New(&statsd.NoOpClient{}))
+	tunnel := ReverseTunnel{
+		ID:         uuid.New(),
+		SSHDPort:   getFreePort(),
+		TunnelPort: getFreePort(),
+		services: ReverseTunnelServices{
+			SQL:       testReverseTunnelSQL{keyID: keyID},
+			SSHServer: sharedServer,
+			Keystore:  keystore,
+			NewDedicatedSSHServer: func(sshdPort int) *SSHServer {
+				return sharedServer.WithBindAddr(net.JoinHostPort("127.0.0.1", strconv.Itoa(sshdPort)))
+			},
+		},
+	}
+
+	listener, err := newEphemeralTCPListener("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	statusUpdates := make(chan StatusUpdate)
+	go func() {
+		for range statusUpdates {
+		}
+	}()
+	tunnelErr := make(chan error, 1)
+	go func() {
+		tunnelErr <- tunnel.Start(ctx, listener, statusUpdates)
+	}()
+
+	// Connect to the tunnel's dedicated server, and forward the tunnel to an echo handler
+	var client *gossh.Client
+	for i := 0; i < 50; i++ {
+		if client, err = gossh.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.SSHDPort)), &gossh.ClientConfig{
+			User:            "passage",
+			Auth:            []gossh.AuthMethod{gossh.PublicKeys(clientKey)},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		}); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	forward, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.TunnelPort)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer forward.Close()
+	go func() {
+		for {
+			conn, err := forward.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Connections to the tunnel reach the client
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(response))
+
+	// The dedicated server stops with the tunnel
+	cancel()
+	assert.NoError(t, <-tunnelErr)
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.SSHDPort)))
+	assert.Error(t, err)
+}
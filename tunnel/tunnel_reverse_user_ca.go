@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"slices"
+	"strings"
+)
+
+// ParseTrustedUserCAKeys parses CA public keys in authorized_keys format, as in OpenSSH's `TrustedUserCAKeys` file
+func ParseTrustedUserCAKeys(data []byte) ([]gossh.PublicKey, error) {
+	var keys []gossh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse CA key %d", len(keys))
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// Critical options that certificates may carry. Anything else is rejected, as OpenSSH does.
+//
+//	force-command has no effect, because the SSH server never runs commands.
+const (
+	certificateSourceAddressOption = "source-address"
+	certificateForceCommandOption  = "force-command"
+)
+
+// getCertificateAuthorizedTunnels validates a user certificate against the trusted user CAs, and matches its principals
+// and key ID against the IDs of registered tunnels
+func (s *SSHServer) getCertificateAuthorizedTunnels(ctx ssh.Context, cert *gossh.Certificate) ([]SSHServerRegisteredTunnel, error) {
+	if len(s.TrustedUserCAKeys) == 0 {
+		return nil, errors.New("certificate authentication is not enabled")
+	}
+	if cert.CertType != gossh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+
+	checker := gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			for _, caKey := range s.TrustedUserCAKeys {
+				if bytes.Equal(caKey.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		SupportedCriticalOptions: []string{certificateForceCommandOption},
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by unrecognized authority")
+	}
+
+	// Principals are matched to tunnels below, so any of them satisfies the checker. This also checks the certificate's
+	//	validity window, signature, and critical options, apart from the source address.
+	var principal string
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return nil, err
+	}
+	if sourceAddress, ok := cert.CriticalOptions[certificateSourceAddressOption]; ok {
+		if err := checkCertificateSourceAddress(ctx.RemoteAddr(), sourceAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var authorizedTunnels []SSHServerRegisteredTunnel
+	for _, name := range append(slices.Clone(cert.ValidPrincipals), cert.KeyId) {
+		id, err := uuid.Parse(name)
+		if err != nil || id.String() != name {
+			continue
+		}
+		tunnel, ok := s.tunnels[id]
+		if ok && !slices.ContainsFunc(authorizedTunnels, func(t SSHServerRegisteredTunnel) bool { return t.ID == id }) {
+			authorizedTunnels = append(authorizedTunnels, tunnel)
+		}
+	}
+	return authorizedTunnels, nil
+}
+
+// checkCertificateSourceAddress checks the client's address against a certificate's comma separated list of addresses
+// and CIDRs
+func checkCertificateSourceAddress(remote net.Addr, sourceAddress string) error {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("remote address %s is not a TCP address", remote)
+	}
+
+	for _, source := range strings.Split(sourceAddress, ",") {
+		if ip := net.ParseIP(source); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return errors.Wrapf(err, "invalid source-address %q", source)
+		}
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("remote address %s is not allowed by the certificate's source-address", tcpAddr.IP)
+}
@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestUserCertSigner returns a signer for a new key, with a user certificate signed by the CA
+func newTestUserCertSigner(t *testing.T, ca gossh.Signer, modify func(cert *gossh.Certificate)) gossh.Signer {
+	key := newTestSigner(t)
+	cert := &gossh.Certificate{
+		Key:         key.PublicKey(),
+		CertType:    gossh.UserCert,
+		ValidAfter:  uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore: uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	modify(cert)
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := gossh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSSHServer_UserCertificates(t *testing.T) {
+	ca := newTestSigner(t)
+	server, addr := startTestReverseSSHServer(t, func(server *SSHServer) {
+		server.TrustedUserCAKeys = []gossh.PublicKey{ca.PublicKey()}
+	})
+
+	// The tunnel authorizes no public keys, so it can only be reached with a certificate
+	tunnelID, port := uuid.New(), getFreePort()
+	connections := make(chan ReverseForwardingConnection)
+	server.RegisterTunnel(SSHServerRegisteredTunnel{
+		ID:             tunnelID,
+		RegisteredPort: port,
+		Connections:    connections,
+	})
+	go func() {
+		for conn := range connections {
+			conn.admit(nil)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		ca      gossh.Signer
+		modify  func(cert *gossh.Certificate)
+		success bool
+	}{
+		{
+			name:    "principal",
+			modify:  func(cert *gossh.Certificate) { cert.ValidPrincipals = []string{"other", tunnelID.String()} },
+			success: true,
+		},
+		{
+			name:    "key ID",
+			modify:  func(cert *gossh.Certificate) { cert.KeyId = tunnelID.String() },
+			success: true,
+		},
+		{
+			name:   "other tunnel",
+			modify: func(cert *gossh.Certificate) { cert.ValidPrincipals = []string{uuid.New().String()} },
+		},
+		{
+			name:   "untrusted CA",
+			ca:     newTestSigner(t),
+			modify: func(cert *gossh.Certificate) { cert.ValidPrincipals = []string{tunnelID.String()} },
+		},
+		{
+			name: "expired",
+			modify: func(cert *gossh.Certificate) {
+				cert.ValidPrincipals = []string{tunnelID.String()}
+				cert.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+			},
+		},
+		{
+			name: "not yet valid",
+			modify: func(cert *gossh.Certificate) {
+				cert.ValidPrincipals = []string{tunnelID.String()}
+				cert.ValidAfter = uint64(time.Now().Add(time.Hour).Unix())
+			},
+		},
+		{
+			name: "allowed source address",
+			modify: func(cert *gossh.Certificate) {
+				cert.ValidPrincipals = []string{tunnelID.String()}
+				cert.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8,127.0.0.1/32"}
+			},
+			success: true,
+		},
+		{
+			name: "disallowed source address",
+			modify: func(cert *gossh.Certificate) {
+				cert.ValidPrincipals = []string{tunnelID.String()}
+				cert.CriticalOptions = map[string]string{"source-address": "10.0.0.0/8"}
+			},
+		},
+		{
+			name: "unsupported critical option",
+			modify: func(cert *gossh.Certificate) {
+				cert.ValidPrincipals = []string{tunnelID.String()}
+				cert.CriticalOptions = map[string]string{"verify-required": ""}
+			},
+		},
+		{
+			name: "host certificate",
+			modify: func(cert *gossh.Certificate) {
+				cert.ValidPrincipals = []string{tunnelID.String()}
+				cert.CertType = gossh.HostCert
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signingCA := ca
+			if test.ca != nil {
+				signingCA = test.ca
+			}
+
+			client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+				User:            "passage",
+				Auth:            []gossh.AuthMethod{gossh.PublicKeys(newTestUserCertSigner(t, signingCA, test.modify))},
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			})
+			if !test.success {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer client.Close()
+
+			listener, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if assert.NoError(t, err) {
+				_ = listener.Close()
+			}
+		})
+	}
+}
+
+func TestParseTrustedUserCAKeys(t *testing.T) {
+	first, second := newTestSigner(t), newTestSigner(t)
+	data := append(gossh.MarshalAuthorizedKey(first.PublicKey()), []byte("\n# comment\n")...)
+	data = append(data, gossh.MarshalAuthorizedKey(second.PublicKey())...)
+
+	keys, err := ParseTrustedUserCAKeys(data)
+	if assert.NoError(t, err) && assert.Len(t, keys, 2) {
+		assert.Equal(t, first.PublicKey().Marshal(), keys[0].Marshal())
+		assert.Equal(t, second.PublicKey().Marshal(), keys[1].Marshal())
+	}
+
+	_, err = ParseTrustedUserCAKeys([]byte("not a key"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upstream selection policies, for tunnels with more than one upstream target
+const (
+	UpstreamPolicyFailover   = "failover"
+	UpstreamPolicyRoundRobin = "round-robin"
+)
+
+// UpstreamTarget is an upstream host and port that a normal tunnel can forward to
+type UpstreamTarget struct {
+	ServiceHost string `json:"serviceHost"`
+	ServicePort int    `json:"servicePort"`
+}
+
+func (u UpstreamTarget) addr() string {
+	return net.JoinHostPort(u.ServiceHost, strconv.Itoa(u.ServicePort))
+}
+
+func validateUpstreamPolicy(policy string) error {
+	switch policy {
+	case "", UpstreamPolicyFailover, UpstreamPolicyRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("upstreamPolicy must be one of %q or %q", UpstreamPolicyFailover, UpstreamPolicyRoundRobin)
+	}
+}
+
+// validateUpstreamTargets validates that every upstream target has a host and port
+func validateUpstreamTargets(targets []UpstreamTarget) error {
+	for i, target := range targets {
+		if target.ServiceHost == "" {
+			return fmt.Errorf("upstreamTargets[%d].serviceHost is required", i)
+		}
+		if target.ServicePort == 0 {
+			return fmt.Errorf("upstreamTargets[%d].servicePort is required", i)
+		}
+	}
+	return nil
+}
+
+// upstreamSelector chooses which upstream target to dial, according to a selection policy.
+//
+//	Targets that the upstream healthcheck found to be unreachable are skipped, unless no targets are reachable.
+type upstreamSelector struct {
+	targets []UpstreamTarget
+	policy  string
+
+	// unreachable records which targets failed their last healthcheck
+	unreachable []bool
+	lock        sync.RWMutex
+
+	// next is the round-robin cursor, the index of the target to try first
+	next int
+}
+
+func newUpstreamSelector(targets []UpstreamTarget, policy string) *upstreamSelector {
+	return &upstreamSelector{
+		targets:     targets,
+		policy:      firstNotEmptyString(policy, UpstreamPolicyFailover),
+		unreachable: make([]bool, len(targets)),
+	}
+}
+
+// order returns the indexes of targets in the order they should be tried, with unreachable targets omitted
+func (s *upstreamSelector) order() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start := 0
+	if s.policy == UpstreamPolicyRoundRobin {
+		start = s.next
+	}
+
+	order := make([]int, 0, len(s.targets))
+	for i := range s.targets {
+		if idx := (start + i) % len(s.targets); !s.unreachable[idx] {
+			order = append(order, idx)
+		}
+	}
+
+	// If every target is unreachable, it's still worth trying them
+	if len(order) == 0 {
+		for i := range s.targets {
+			order = append(order, (start+i)%len(s.targets))
+		}
+	}
+
+	// Advance the cursor past the target picked first, rather than by one, so that the target after an unreachable
+	//	one isn't picked twice in a row
+	if s.policy == UpstreamPolicyRoundRobin {
+		s.next = (order[0] + 1) % len(s.targets)
+	}
+	return order
+}
+
+// dial connects to the first target that accepts the connection
+func (s *upstreamSelector) dial(dial func(network, addr string) (net.Conn, error)) (io.ReadWriteCloser, error) {
+	var errs []string
+	for _, idx := range s.order() {
+		conn, err := dial("tcp", s.targets[idx].addr())
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", s.targets[idx].addr(), err.Error()))
+	}
+	return nil, errors.Errorf("no upstream targets reachable: %s", strings.Join(errs, "; "))
+}
+
+// check tests the reachability of every target and records the result.
+//
+//	It returns a connection to a reachable target so that it fits the upstream healthcheck, or an error if none are.
+func (s *upstreamSelector) check(dial func(network, addr string) (net.Conn, error)) (io.ReadWriteCloser, error) {
+	var reachable io.ReadWriteCloser
+	var errs []string
+	for idx, target := range s.targets {
+		conn, err := dial("tcp", target.addr())
+
+		s.lock.Lock()
+		s.unreachable[idx] = err != nil
+		s.lock.Unlock()
+
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", target.addr(), err.Error()))
+			continue
+		}
+		if reachable == nil {
+			reachable = conn
+		} else {
+			conn.Close()
+		}
+	}
+
+	if reachable == nil {
+		return nil, errors.Errorf("no upstream targets reachable: %s", strings.Join(errs, "; "))
+	}
+	return reachable, nil
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// testUpstreamDialer records dialed addresses, and fails to dial unreachable ones
+type testUpstreamDialer struct {
+	unreachable map[string]bool
+	dialed      []string
+}
+
+func (d *testUpstreamDialer) dial(network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	if d.unreachable[addr] {
+		return nil, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+var testUpstreamTargets = []UpstreamTarget{
+	{ServiceHost: "primary", ServicePort: 5432},
+	{ServiceHost: "secondary", ServicePort: 5432},
+	{ServiceHost: "tertiary", ServicePort: 5432},
+}
+
+func TestUpstreamSelector_Failover(t *testing.T) {
+	selector := newUpstreamSelector(testUpstreamTargets, UpstreamPolicyFailover)
+	dialer := &testUpstreamDialer{unreachable: map[string]bool{"primary:5432": true}}
+
+	// Before the healthcheck runs, the primary is tried first
+	_, err := selector.dial(dialer.dial)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"primary:5432", "secondary:5432"}, dialer.dialed)
+
+	// Once the healthcheck marks the primary unreachable, it is skipped
+	_, err = selector.check(dialer.dial)
+	assert.NoError(t, err)
+	dialer.dialed = nil
+	_, err = selector.dial(dialer.dial)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"secondary:5432"}, dialer.dialed)
+
+	// Once it recovers, it is used again
+	dialer.unreachable = nil
+	_, err = selector.check(dialer.dial)
+	assert.NoError(t, err)
+	dialer.dialed = nil
+	_, err = selector.dial(dialer.dial)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"primary:5432"}, dialer.dialed)
+}
+
+func TestUpstreamSelector_RoundRobin(t *testing.T) {
+	selector := newUpstreamSelector(testUpstreamTargets, UpstreamPolicyRoundRobin)
+	dialer := &testUpstreamDialer{unreachable: map[string]bool{"secondary:5432": true}}
+
+	_, err := selector.check(dialer.dial)
+	assert.NoError(t, err)
+
+	dialer.dialed = nil
+	for i := 0; i < 4; i++ {
+		_, err := selector.dial(dialer.dial)
+		assert.NoError(t, err)
+	}
+	// The reachable targets take turns, without the one after the unreachable target being picked twice
+	assert.Equal(t, []string{"primary:5432", "tertiary:5432", "primary:5432", "tertiary:5432"}, dialer.dialed)
+}
+
+func TestUpstreamSelector_AllUnreachable(t *testing.T) {
+	selector := newUpstreamSelector(testUpstreamTargets, UpstreamPolicyFailover)
+	dialer := &testUpstreamDialer{unreachable: map[string]bool{
+		"primary:5432":   true,
+		"secondary:5432": true,
+		"tertiary:5432":  true,
+	}}
+
+	_, err := selector.check(dialer.dial)
+	assert.Error(t, err)
+
+	// Every target is still tried, in case the healthcheck is stale
+	dialer.dialed = nil
+	_, err = selector.dial(dialer.dial)
+	assert.ErrorContains(t, err, "no upstream targets reachable")
+	assert.Len(t, dialer.dialed, 3)
+}
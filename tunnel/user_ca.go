@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/tunnel/keystore"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+// UserCertificateAuthority signs short-lived OpenSSH user certificates for normal tunnel SSH clients, so that bastions
+// only need to trust the CA (via `TrustedUserCAKeys`) rather than individual tunnel public keys.
+type UserCertificateAuthority struct {
+	Keystore keystore.Keystore
+
+	// KeyID identifies the CA private key in the keystore
+	KeyID uuid.UUID
+
+	// TTL is how long minted certificates are valid for
+	TTL time.Duration
+}
+
+// certificateClockSkew backdates certificates so that bastions with slightly slow clocks still accept them
+const certificateClockSkew = 1 * time.Minute
+
+// getSigner reads the CA private key from the keystore
+func (ca UserCertificateAuthority) getSigner(ctx context.Context) (ssh.Signer, error) {
+	keyBytes, err := ca.Keystore.Get(ctx, ca.KeyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get CA key %s", ca.KeyID)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse CA key")
+	}
+	return signer, nil
+}
+
+// PublicKey returns the CA public key in authorized_keys format, for use in a bastion's `TrustedUserCAKeys` file
+func (ca UserCertificateAuthority) PublicKey(ctx context.Context) ([]byte, error) {
+	signer, err := ca.getSigner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(signer.PublicKey()), nil
+}
+
+// NewCertSigner generates an ephemeral key pair, and returns a signer for it with a freshly minted user certificate
+func (ca UserCertificateAuthority) NewCertSigner(ctx context.Context, keyID string, principals []string) (ssh.Signer, error) {
+	caSigner, err := ca.getSigner(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate an ephemeral key pair for this connection
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate key")
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "create signer")
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, errors.Wrap(err, "generate serial")
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(ca.TTL).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{"permit-port-forwarding": ""},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		return nil, errors.Wrap(err, "sign certificate")
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/google/uuid"
+	"github.com/hightouchio/passage/tunnel/keystore/in_memory"
+	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+func newTestUserCA(t *testing.T) (UserCertificateAuthority, gossh.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPublicKey, err := gossh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyID := uuid.New()
+	ks := in_memory.New()
+	if err := ks.Set(context.Background(), keyID, pem.EncodeToMemory(block)); err != nil {
+		t.Fatal(err)
+	}
+
+	return UserCertificateAuthority{Keystore: ks, KeyID: keyID, TTL: 5 * time.Minute}, caPublicKey
+}
+
+func TestUserCertificateAuthority_NewCertSigner(t *testing.T) {
+	ctx := context.Background()
+	ca, caPublicKey := newTestUserCA(t)
+
+	signer, err := ca.NewCertSigner(ctx, "passage-tunnel-test", []string{"passage"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cert, ok := signer.PublicKey().(*gossh.Certificate)
+	if !assert.True(t, ok, "signer should present a certificate") {
+		return
+	}
+	assert.Equal(t, "passage-tunnel-test", cert.KeyId)
+	assert.Contains(t, cert.Extensions, "permit-port-forwarding")
+
+	checker := gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return keysEqual(auth, caPublicKey)
+		},
+	}
+	assert.NoError(t, checker.CheckCert("passage", cert))
+
+	// The certificate is only valid for the requested principals
+	assert.Error(t, checker.CheckCert("root", cert))
+
+	// The certificate expires after the TTL
+	checker.Clock = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	assert.Error(t, checker.CheckCert("passage", cert))
+}
+
+func TestUserCertificateAuthority_PublicKey(t *testing.T) {
+	ca, caPublicKey := newTestUserCA(t)
+
+	authorizedKey, err := ca.PublicKey(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	parsed, _, _, _, err := gossh.ParseAuthorizedKey(authorizedKey)
+	if assert.NoError(t, err) {
+		assert.True(t, keysEqual(parsed, caPublicKey))
+	}
+}
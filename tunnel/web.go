@@ -13,12 +13,19 @@ func (s API) ConfigureWebRoutes(router *mux.Router) {
 	// Create tunnel endpoints.
 	router.HandleFunc("/tunnel/normal", s.handleWebCreateNormalTunnel).Methods(http.MethodPost)
 	router.HandleFunc("/tunnel/reverse", s.handleWebCreateReverseTunnel).Methods(http.MethodPost)
+	router.HandleFunc("/tunnel/dynamic", s.handleWebCreateDynamicTunnel).Methods(http.MethodPost)
+
+	// Certificate authority endpoints.
+	router.HandleFunc("/user_ca", s.handleWebUserCAGet).Methods(http.MethodGet)
 
 	tunnelRouter := router.PathPrefix("/tunnel/{tunnelID}").Subrouter()
 	tunnelRouter.HandleFunc("", s.handleWebTunnelGet).Methods(http.MethodGet)
 	tunnelRouter.HandleFunc("/check", s.handleWebTunnelCheck).Methods(http.MethodGet)
 	tunnelRouter.HandleFunc("", s.handleWebTunnelUpdate).Methods(http.MethodPut)
 	tunnelRouter.HandleFunc("", s.handleWebTunnelDelete).Methods(http.MethodDelete)
+	tunnelRouter.HandleFunc("/known_hosts", s.handleWebKnownHostsGet).Methods(http.MethodGet)
+	tunnelRouter.HandleFunc("/known_hosts", s.handleWebKnownHostsSet).Methods(http.MethodPut)
+	tunnelRouter.HandleFunc("/known_hosts", s.handleWebKnownHostsReset).Methods(http.MethodDelete)
 }
 
 func (s API) handleWebTunnelGet(w http.ResponseWriter, r *http.Request) {
@@ -78,8 +85,13 @@ func (s API) handleWebTunnelUpdate(w http.ResponseWriter, r *http.Request) {
 
 	response, err := s.UpdateTunnel(r.Context(), request)
 	if err != nil {
-		setRequestError(r, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch {
+		case isRequestError(err):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			setRequestError(r, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -108,6 +120,94 @@ func (s API) handleWebTunnelDelete(w http.ResponseWriter, r *http.Request) {
 	renderJSON(w, response)
 }
 
+func (s API) handleWebKnownHostsGet(w http.ResponseWriter, r *http.Request) {
+	var request KnownHostsRequest
+	if err := getTunnelID(r, &request.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.GetKnownHosts(r.Context(), request)
+	if err != nil {
+		switch err {
+		case postgres.ErrTunnelNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			setRequestError(r, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	renderJSON(w, response)
+}
+
+func (s API) handleWebKnownHostsSet(w http.ResponseWriter, r *http.Request) {
+	var request SetKnownHostsRequest
+	if err := getTunnelID(r, &request.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := read(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.SetKnownHosts(r.Context(), request)
+	if err != nil {
+		switch {
+		case err == postgres.ErrTunnelNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case isRequestError(err):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			setRequestError(r, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	renderJSON(w, response)
+}
+
+func (s API) handleWebKnownHostsReset(w http.ResponseWriter, r *http.Request) {
+	var request KnownHostsRequest
+	if err := getTunnelID(r, &request.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.ResetKnownHosts(r.Context(), request)
+	if err != nil {
+		switch err {
+		case postgres.ErrTunnelNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			setRequestError(r, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	renderJSON(w, response)
+}
+
+func (s API) handleWebUserCAGet(w http.ResponseWriter, r *http.Request) {
+	response, err := s.GetUserCA(r.Context())
+	if err != nil {
+		switch err {
+		case ErrUserCANotConfigured:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			setRequestError(r, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	renderJSON(w, response)
+}
+
 func (s API) handleWebCreateNormalTunnel(w http.ResponseWriter, r *http.Request) {
 	var request CreateNormalTunnelRequest
 	if err := read(r, &request); err != nil {
@@ -125,6 +225,23 @@ func (s API) handleWebCreateNormalTunnel(w http.ResponseWriter, r *http.Request)
 	renderJSON(w, response)
 }
 
+func (s API) handleWebCreateDynamicTunnel(w http.ResponseWriter, r *http.Request) {
+	var request CreateDynamicTunnelRequest
+	if err := read(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.CreateDynamicTunnel(r.Context(), request)
+	if err != nil {
+		setRequestError(r, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderJSON(w, response)
+}
+
 func (s API) handleWebCreateReverseTunnel(w http.ResponseWriter, r *http.Request) {
 	var request CreateReverseTunnelRequest
 	if err := read(r, &request); err != nil {